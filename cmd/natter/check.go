@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"natter/internal/config"
+	"natter/internal/stun"
+)
+
+// runCheck 加载并校验配置、解析 STUN 与保活主机名（STUN 服务器列表 URL 改为获取一次并打印内容），打印计划开放的端口与转发，
+// 不启动 orchestrator；返回进程退出码，有任何问题时非 0
+func runCheck(path string) int {
+	cfg, err := config.Load(path)
+	if err != nil {
+		fmt.Printf("FAIL  %v\n", err)
+		return 1
+	}
+	fmt.Printf("OK    config %s\n", path)
+
+	failed := false
+	resolve := func(kind, server string) {
+		if config.IsServerURL(server) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			servers, err := stun.FetchServers(ctx, server)
+			if err != nil {
+				fmt.Printf("FAIL  %s %s: %v\n", kind, server, err)
+				failed = true
+				return
+			}
+			fmt.Printf("OK    %s %s -> %s\n", kind, server, strings.Join(servers, ", "))
+			return
+		}
+		host := server
+		if h, _, err := net.SplitHostPort(server); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			fmt.Printf("FAIL  %s %s: %v\n", kind, server, err)
+			failed = true
+			return
+		}
+		fmt.Printf("OK    %s %s -> %s\n", kind, server, strings.Join(addrs, ", "))
+	}
+	for _, s := range cfg.StunServer.TCP {
+		resolve("stun/tcp", s)
+	}
+	for _, s := range cfg.StunServer.UDP {
+		resolve("stun/udp", s)
+	}
+	for _, h := range cfg.KeepAlive {
+		resolve("keepalive", h)
+	}
+
+	fmt.Println("Plan:")
+	printPlan("tcp", cfg.OpenPort.TCP, cfg.ForwardPort.TCP)
+	printPlan("udp", cfg.OpenPort.UDP, cfg.ForwardPort.UDP)
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// printPlan 打印开放端口、单独设置的间隔与外部端口及其一一对应的转发目标
+func printPlan(proto string, open config.PortList, targets config.TargetList) {
+	for i, a := range open {
+		line := fmt.Sprintf("  %s %s", proto, a.Addr)
+		if a.Interval > 0 {
+			line += fmt.Sprintf(" (interval %ds)", a.Interval)
+		}
+		if a.ExternalPort > 0 {
+			line += fmt.Sprintf(" (external port %d)", a.ExternalPort)
+		}
+		if i < len(targets) {
+			line += " -> " + targets[i].Target
+		}
+		fmt.Println(line)
+	}
+}
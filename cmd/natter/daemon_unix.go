@@ -0,0 +1,49 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// daemonEnv 标记已脱离终端的子进程，避免子进程再次 fork
+const daemonEnv = "NATTER_DAEMON"
+
+// daemonize 以相同参数在新会话中重新启动自身并脱离终端：stdin 指向 /dev/null，
+// stdout/stderr 追加写入 logFile（为空时丢弃）。在父进程中返回 false（父进程随后退出），
+// 在脱离后的子进程中返回 true
+func daemonize(logFile string) (bool, error) {
+	if os.Getenv(daemonEnv) == "1" {
+		return true, nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return false, fmt.Errorf("locate executable: %w", err)
+	}
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		return false, err
+	}
+	defer null.Close()
+	out := null
+	if logFile != "" {
+		if out, err = os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+			return false, fmt.Errorf("open log file: %w", err)
+		}
+		defer out.Close()
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdin = null
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return false, fmt.Errorf("start background process: %w", err)
+	}
+	fmt.Printf("natter started in background, pid %d\n", cmd.Process.Pid)
+	return false, cmd.Process.Release()
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package main
+
+import "errors"
+
+// daemonize 在 Windows 上不可用：没有 fork/setsid，应注册为 Windows 服务运行
+func daemonize(string) (bool, error) {
+	return false, errors.New("-daemon is not supported on Windows; run natter as a Windows service instead (e.g. sc.exe create, NSSM or WinSW)")
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"natter/internal/config"
+)
+
+// defaultStalePeriods 是未指定 -stale 时允许映射多少个检测周期未刷新
+const defaultStalePeriods = 3
+
+// statusRecord 是状态文件中单条映射里 healthcheck 关心的字段
+type statusRecord struct {
+	Protocol    string    `json:"protocol"` // 仅 flat 格式自带，其余格式由解析时补上
+	Inner       string    `json:"inner"`
+	Outer       string    `json:"outer"`
+	LastUpdated time.Time `json:"last_updated"`
+}
+
+// runHealthcheck 实现 "natter healthcheck"：读取状态文件（-http 时改为请求 status_report.http_addr 的 /status），
+// 所有启用 STUN 检测的开放端口都有未过期的映射时返回 0，否则返回 1；参数错误返回 2。
+// 供 Docker HEALTHCHECK、Kubernetes exec 探针等使用
+func runHealthcheck(args []string) int {
+	fs := flag.NewFlagSet("healthcheck", flag.ContinueOnError)
+	configPath := fs.String("c", "", "Path to config file (JSON, or YAML for .yaml/.yml)")
+	stale := fs.Duration("stale", 0, "Treat mappings not refreshed within this duration as unhealthy (default 3 poll periods)")
+	useHTTP := fs.Bool("http", false, "Query /status on status_report.http_addr instead of reading the status file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *configPath == "" {
+		fmt.Fprintln(os.Stderr, "healthcheck requires -c <config>")
+		return 2
+	}
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Printf("FAIL  %v\n", err)
+		return 1
+	}
+
+	var data []byte
+	if *useHTTP {
+		data, err = fetchStatus(cfg.StatusReport.HTTPAddr)
+	} else {
+		data, err = os.ReadFile(cfg.StatusReport.StatusFile)
+	}
+	if err != nil {
+		fmt.Printf("FAIL  read status: %v\n", err)
+		return 1
+	}
+	records, err := parseStatus(data, cfg.StatusReport.Format)
+	if err != nil {
+		fmt.Printf("FAIL  parse status: %v\n", err)
+		return 1
+	}
+
+	// 按协议、地址与端口匹配；状态文件中 0.0.0.0 会被替换为出口 IP，
+	// 所以监听通配地址或主机名的开放端口只按协议与端口匹配
+	latest := map[string]statusRecord{}
+	keep := func(key string, r statusRecord) {
+		if old, ok := latest[key]; !ok || r.LastUpdated.After(old.LastUpdated) {
+			latest[key] = r
+		}
+	}
+	for _, r := range records {
+		host, port, err := net.SplitHostPort(r.Inner)
+		if err != nil {
+			continue
+		}
+		keep(r.Protocol+"/"+port, r)
+		if ip := net.ParseIP(host); ip != nil {
+			keep(r.Protocol+"/"+net.JoinHostPort(ip.String(), port), r)
+		}
+	}
+
+	healthy := true
+	now := time.Now()
+	check := func(proto string, open config.PortList, servers []string) {
+		if len(servers) == 0 {
+			return // 该协议未启用 STUN 检测，不会有映射
+		}
+		// 只写了服务器列表 URL 同样算启用：运行时 URL 全部获取失败就没有可用服务器，
+		// 端口因没有映射判为不健康，而不是当作未启用跳过
+		onlyURLs := !slices.ContainsFunc(servers, func(s string) bool { return !config.IsServerURL(s) })
+		for _, a := range open {
+			host, port, _ := net.SplitHostPort(a.Addr)
+			key := proto + "/" + port
+			if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+				key = proto + "/" + net.JoinHostPort(ip.String(), port)
+			}
+			limit := *stale
+			if limit <= 0 {
+				limit = defaultStalePeriods * pollPeriod(cfg, a)
+			}
+			r, ok := latest[key]
+			switch {
+			case !ok && onlyURLs:
+				fmt.Printf("FAIL  %s %s: no mapping (stun_server.%s only lists server list URLs, check that they can be fetched)\n",
+					proto, a.Addr, proto)
+				healthy = false
+			case !ok:
+				fmt.Printf("FAIL  %s %s: no mapping\n", proto, a.Addr)
+				healthy = false
+			case now.Sub(r.LastUpdated) > limit:
+				fmt.Printf("FAIL  %s %s -> %s: not refreshed for %s (limit %s)\n", proto, a.Addr, r.Outer,
+					now.Sub(r.LastUpdated).Round(time.Second), limit)
+				healthy = false
+			default:
+				fmt.Printf("OK    %s %s -> %s (updated %s ago)\n", proto, a.Addr, r.Outer, now.Sub(r.LastUpdated).Round(time.Second))
+			}
+		}
+	}
+	check("tcp", cfg.OpenPort.TCP, cfg.StunServer.TCP)
+	check("udp", cfg.OpenPort.UDP, cfg.StunServer.UDP)
+	if !healthy {
+		return 1
+	}
+	return 0
+}
+
+// pollPeriod 返回开放端口 a 两次 STUN 检测之间的最长间隔：端口或全局 interval，退避时为 stun_max_interval
+func pollPeriod(cfg *config.Config, a config.OpenAddr) time.Duration {
+	sec := cfg.Interval
+	if a.Interval > 0 {
+		sec = a.Interval
+	}
+	if cfg.StunMaxInterval > sec {
+		sec = cfg.StunMaxInterval
+	}
+	return time.Duration(sec) * time.Second
+}
+
+// fetchStatus 请求 addr 上的 /status；监听通配地址时改连本机
+func fetchStatus(addr string) ([]byte, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("status_report.http_addr is not set")
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + net.JoinHostPort(host, port) + "/status")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status endpoint returned %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// parseStatus 按 status_report.format 解析状态文件中的映射
+func parseStatus(data []byte, format string) ([]statusRecord, error) {
+	var out []statusRecord
+	switch format {
+	case "flat":
+		if err := json.Unmarshal(data, &out); err != nil {
+			return nil, err
+		}
+	case "keyed":
+		var keyed map[string]map[string]statusRecord
+		if err := json.Unmarshal(data, &keyed); err != nil {
+			return nil, err
+		}
+		for _, byProto := range keyed {
+			for proto, r := range byProto {
+				r.Protocol = proto
+				out = append(out, r)
+			}
+		}
+	default:
+		var grouped struct {
+			TCP []statusRecord `json:"tcp"`
+			UDP []statusRecord `json:"udp"`
+		}
+		if err := json.Unmarshal(data, &grouped); err != nil {
+			return nil, err
+		}
+		for _, r := range grouped.TCP {
+			r.Protocol = "tcp"
+			out = append(out, r)
+		}
+		for _, r := range grouped.UDP {
+			r.Protocol = "udp"
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
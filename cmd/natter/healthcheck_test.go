@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"natter/internal/status"
+
+	"go.uber.org/zap"
+)
+
+// TestParseStatusRoundTrip 用 StatusManager 按每种格式写出状态文件，再交给 parseStatus 解析
+func TestParseStatusRoundTrip(t *testing.T) {
+	for _, format := range []status.Format{"", status.FormatGrouped, status.FormatFlat, status.FormatKeyed} {
+		name := string(format)
+		if name == "" {
+			name = "default"
+		}
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "status.json")
+			m, err := status.NewManager(path, "", zap.NewNop(), status.WithFormat(format))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go m.Run(ctx)
+			m.Updates <- status.UpdateEvent{Protocol: "tcp", InnerAddr: "10.0.0.2:5000", OuterAddr: "203.0.113.7:5000"}
+			m.Updates <- status.UpdateEvent{Protocol: "udp", InnerAddr: "10.0.0.2:5000", OuterAddr: "203.0.113.7:6000"}
+
+			var records []statusRecord
+			deadline := time.Now().Add(2 * time.Second)
+			for len(records) < 2 {
+				if time.Now().After(deadline) {
+					t.Fatalf("parsed %d records, want 2", len(records))
+				}
+				time.Sleep(5 * time.Millisecond)
+				data, err := os.ReadFile(path)
+				if err != nil {
+					continue // 第一次写入之前文件不存在
+				}
+				if records, err = parseStatus(data, string(format)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			sort.Slice(records, func(i, j int) bool { return records[i].Protocol < records[j].Protocol })
+			want := [][2]string{{"tcp", "203.0.113.7:5000"}, {"udp", "203.0.113.7:6000"}}
+			for i, w := range want {
+				r := records[i]
+				if r.Protocol != w[0] || r.Inner != "10.0.0.2:5000" || r.Outer != w[1] || r.LastUpdated.IsZero() {
+					t.Errorf("record %d = %+v, want %s 10.0.0.2:5000 -> %s with last_updated", i, r, w[0], w[1])
+				}
+			}
+		})
+	}
+}
+
+// healthcheckWith 写出带 udpServers 的配置与只含一条新鲜 TCP 映射的状态文件，返回 healthcheck 的退出码
+func healthcheckWith(t *testing.T, udpServers string) int {
+	t.Helper()
+	dir := t.TempDir()
+	statusPath := filepath.Join(dir, "status.json")
+	updated := time.Now().UTC().Format(time.RFC3339)
+	st := fmt.Sprintf(`{"tcp": [{"inner": "10.0.0.2:5000", "outer": "203.0.113.7:5000", "last_updated": %q}], "udp": []}`, updated)
+	if err := os.WriteFile(statusPath, []byte(st), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := fmt.Sprintf(`{
+		"open_port": {"tcp": ["0.0.0.0:5000"], "udp": ["0.0.0.0:5001"]},
+		"stun_server": {"tcp": ["stun.example.com:3478"], "udp": %s},
+		"status_report": {"status_file": %q}
+	}`, udpServers, statusPath)
+	cfgPath := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(cfgPath, []byte(cfg), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return runHealthcheck([]string{"-c", cfgPath})
+}
+
+func TestHealthcheckSkipsProtocolWithoutServers(t *testing.T) {
+	if code := healthcheckWith(t, `[]`); code != 0 {
+		t.Fatalf("exit code %d, want 0: udp has no STUN servers and is not checked", code)
+	}
+}
+
+func TestHealthcheckRequiresMappingForURLOnlyServers(t *testing.T) {
+	// 服务器列表 URL 获取失败时没有 UDP 映射，不能因为 TCP 正常就返回 0
+	if code := healthcheckWith(t, `["http://127.0.0.1:1/stun.txt"]`); code != 1 {
+		t.Fatalf("exit code %d, want 1 for a udp port without mapping", code)
+	}
+	if code := healthcheckWith(t, `["stun.example.com:3478"]`); code != 1 {
+		t.Fatalf("exit code %d, want 1 for a udp port without mapping", code)
+	}
+}
+
+func TestHealthcheckMatchesHost(t *testing.T) {
+	dir := t.TempDir()
+	statusPath := filepath.Join(dir, "status.json")
+	updated := time.Now().UTC().Format(time.RFC3339)
+	// 10.0.0.2:5000 有新鲜映射，10.0.0.3:5000 只有过期映射
+	st := fmt.Sprintf(`{"tcp": [
+		{"inner": "10.0.0.2:5000", "outer": "203.0.113.7:5000", "last_updated": %q},
+		{"inner": "10.0.0.3:5000", "outer": "203.0.113.7:6000", "last_updated": "2000-01-01T00:00:00Z"}
+	], "udp": []}`, updated)
+	if err := os.WriteFile(statusPath, []byte(st), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	run := func(open string) int {
+		cfg := fmt.Sprintf(`{
+			"open_port": {"tcp": [%s]},
+			"stun_server": {"tcp": ["stun.example.com:3478"]},
+			"status_report": {"status_file": %q}
+		}`, open, statusPath)
+		cfgPath := filepath.Join(dir, "config.json")
+		if err := os.WriteFile(cfgPath, []byte(cfg), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return runHealthcheck([]string{"-c", cfgPath})
+	}
+	if code := run(`"10.0.0.2:5000"`); code != 0 {
+		t.Errorf("exit code %d for 10.0.0.2:5000, want 0", code)
+	}
+	if code := run(`"10.0.0.3:5000"`); code != 1 {
+		t.Errorf("exit code %d for 10.0.0.3:5000, want 1: its own mapping is stale", code)
+	}
+	if code := run(`"0.0.0.0:5000"`); code != 0 {
+		t.Errorf("exit code %d for 0.0.0.0:5000, want 0: matched by port", code)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
@@ -19,18 +20,70 @@ import (
 
 func usage() {
 	prog := os.Args[0]
-	fmt.Fprintf(os.Stderr, "Usage:\n  %s [options] [host] <port>\n", prog)
-	fmt.Fprintf(os.Stderr, "Options:\n  -c string   Path to JSON config file\n  -v          Enable debug logging\n  -t          Enable HTTP test server (port mode only)\n")
-	fmt.Fprintf(os.Stderr, "Examples:\n  %s 2888\n  %s 127.0.0.1 2888\n  %s -c config.json\n  %s -t 2888\n", prog, prog, prog, prog)
+	fmt.Fprintf(os.Stderr, "Usage:\n  %s [options] [host] <port>\n  %s install|uninstall|start|stop [options]   (Windows service)\n", prog, prog)
+	fmt.Fprintf(os.Stderr, "  %s healthcheck -c <config> [-stale 90s] [-http]   (exit 0 when every open port has a fresh mapping)\n", prog)
+	fmt.Fprintf(os.Stderr, "Options:\n  -c string   Path to config file (JSON, or YAML for .yaml/.yml)\n  -v          Enable debug logging\n  -t          Enable HTTP test server (port mode only)\n  -tdir path  Serve files from this directory with the test server (implies -t)\n  -probe port Query the external address of a local port once via STUN and exit\n  -check      Validate the config given by -c and print the plan without starting\n  -daemon     Detach and run in the background (Unix only)\n  -version    Print version information and exit\n")
+	fmt.Fprintf(os.Stderr, "Examples:\n  %s 2888\n  %s 127.0.0.1 2888\n  %s -c config.json\n  %s -check -c config.json\n  %s -probe 2888 -c config.json\n  %s -t 2888\n", prog, prog, prog, prog, prog, prog)
 }
 
 func main() {
+	// 健康检查子命令，供容器编排探针使用
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		os.Exit(runHealthcheck(os.Args[2:]))
+	}
+	// Windows 服务管理子命令
+	if len(os.Args) > 1 {
+		if code, ok := serviceCommand(os.Args[1], os.Args[2:]); ok {
+			os.Exit(code)
+		}
+	}
+
 	// 解析命令行参数
-	configPath := flag.String("c", "", "Path to JSON config file")
+	configPath := flag.String("c", "", "Path to config file (JSON, or YAML for .yaml/.yml)")
 	verbose := flag.Bool("v", false, "Enable debug logging")
 	testHTTP := flag.Bool("t", false, "Enable HTTP test server (port mode only)")
+	testDir := flag.String("tdir", "", "Serve files from this directory with the test server (implies -t)")
+	showVersion := flag.Bool("version", false, "Print version information and exit")
+	check := flag.Bool("check", false, "Validate the config given by -c and print the plan without starting")
+	probePort := flag.Int("probe", 0, "Query the external address of a local port once via STUN and exit")
+	daemon := flag.Bool("daemon", false, "Detach and run in the background (Unix only)")
 	flag.Usage = usage
 	flag.Parse()
+	if *showVersion {
+		printVersion()
+		return
+	}
+	if *check {
+		if *configPath == "" {
+			fmt.Fprintln(os.Stderr, "-check requires -c <config>")
+			os.Exit(2)
+		}
+		os.Exit(runCheck(*configPath))
+	}
+	if *probePort != 0 {
+		// STUN 服务器取自配置文件，未指定 -c 时取自 NATTER_STUN_* 环境变量
+		cfg := &config.Config{}
+		if *configPath != "" {
+			var err error
+			if cfg, err = config.Load(*configPath); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+				os.Exit(1)
+			}
+		} else if err := cfg.ApplyEnv(); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid environment: %v\n", err)
+			os.Exit(1)
+		}
+		level := "warn"
+		if *verbose {
+			level = "debug"
+		}
+		logger, err := ilog.New(level, "")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to init logger: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(runProbe(cfg, *probePort, logger))
+	}
 	args := flag.Args()
 
 	// 构造配置
@@ -63,60 +116,180 @@ func main() {
 			os.Exit(1)
 		}
 
-		// 临时配置
+		// 临时配置，其余字段使用缺省值
 		cfg = &config.Config{
-			StunServer:   config.StunServer{TCP: nil, UDP: nil},
-			KeepAlive:    "www.qq.com",
-			Interval:     10,
-			OpenPort:     config.OpenPort{TCP: []string{fmt.Sprintf("%s:%d", host, port)}},
-			ForwardPort:  config.ForwardPort{},
-			StatusReport: config.StatusReport{StatusFile: "status.json"},
-			Logging:      config.Logging{},
-		}
-
-		// 如果启用 HTTP 测试服务器
-		if *testHTTP {
-			mux := http.NewServeMux()
+			StunServer:  config.StunServer{TCP: nil, UDP: nil},
+			OpenPort:    config.OpenPort{TCP: config.PortList{{Addr: fmt.Sprintf("%s:%d", host, port)}}},
+			ForwardPort: config.ForwardPort{},
+			Logging:     config.Logging{},
+		}
+		if err := cfg.ApplyEnv(); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid environment: %v\n", err)
+			os.Exit(1)
+		}
+		cfg.ApplyDefaults()
+		// 与 config.Load 一样校验，端口越界、主机不是 IP 等在启动前报告
+		if err := cfg.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid arguments: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// 后台运行：父进程启动脱离终端的子进程后退出，子进程继续往下执行
+	if *daemon {
+		child, err := daemonize(cfg.Logging.LogFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to daemonize: %v\n", err)
+			os.Exit(1)
+		}
+		if !child {
+			return
+		}
+	}
+
+	// 端口模式下如果启用 HTTP 测试服务器；指定 -tdir 时提供该目录下的静态文件
+	if *configPath == "" && (*testHTTP || *testDir != "") {
+		mux := http.NewServeMux()
+		if *testDir != "" {
+			if fi, err := os.Stat(*testDir); err != nil || !fi.IsDir() {
+				fmt.Fprintf(os.Stderr, "Invalid -tdir %q: not a directory\n", *testDir)
+				os.Exit(1)
+			}
+			mux.Handle("/", http.FileServer(http.Dir(*testDir)))
+		} else {
 			mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 				w.Header().Set("Content-Type", "text/html")
 				fmt.Fprint(w, "<h1>It works!</h1><hr/>Natter")
 			})
-			addr := fmt.Sprintf("%s:%d", host, port)
-			fmt.Printf("[INFO] HTTP test server listening on %s\n", addr)
-			go func() {
-				if err := http.ListenAndServe(addr, mux); err != nil {
-					fmt.Fprintf(os.Stderr, "HTTP test server error: %v\n", err)
-				}
-			}()
 		}
+		addr := fmt.Sprintf("%s:%d", host, port)
+		fmt.Printf("[INFO] HTTP test server listening on %s\n", addr)
+		if *testDir != "" {
+			fmt.Printf("[INFO] Serving files from %s\n", *testDir)
+		}
+		go func() {
+			if err := http.ListenAndServe(addr, mux); err != nil {
+				fmt.Fprintf(os.Stderr, "HTTP test server error: %v\n", err)
+			}
+		}()
 	}
 
-	// 初始化日志
+	// 初始化日志：-v 强制 debug，否则使用配置中的级别，默认 info
 	level := "info"
 	if *verbose {
 		level = "debug"
+	} else if cfg.Logging.Level != "" {
+		level = cfg.Logging.Level
 	}
-	logger, err := ilog.New(level, cfg.Logging.LogFile)
+	logOpts := []ilog.Option{
+		ilog.WithFormat(cfg.Logging.Format),
+		ilog.WithRotation(cfg.Logging.MaxSizeMB, cfg.Logging.MaxBackups, cfg.Logging.MaxAgeDays),
+	}
+	if *daemon {
+		logOpts = append(logOpts, ilog.WithoutStdout())
+	}
+	logger, err := ilog.New(level, cfg.Logging.LogFile, logOpts...)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to init logger: %v\n", err)
 		os.Exit(1)
 	}
 
+	if cfg.PidFile != "" {
+		if err := writePidFile(cfg.PidFile); err != nil {
+			logger.Fatal("Failed to write pid file", zap.Error(err))
+		}
+		defer os.Remove(cfg.PidFile)
+	}
+	// fatal 记录错误后以退出码 1 结束；os.Exit 不会执行 defer，所以先删除 pid 文件
+	fatal := func(msg string, err error) {
+		logger.Error(msg, zap.Error(err))
+		if cfg.PidFile != "" {
+			os.Remove(cfg.PidFile)
+		}
+		os.Exit(1)
+	}
+
+	// 审计日志独立于主日志，只写文件
+	var opts []orchestrator.Option
+	if cfg.Logging.AuditFile != "" {
+		audit, err := ilog.NewAudit(cfg.Logging.AuditFile)
+		if err != nil {
+			fatal("Failed to open audit log", err)
+		}
+		defer audit.Sync()
+		opts = append(opts, orchestrator.WithAuditLogger(audit))
+	}
+
 	// 创建 orchestrator
-	n, err := orchestrator.New(cfg, logger)
+	n, err := orchestrator.New(cfg, logger, opts...)
 	if err != nil {
-		logger.Fatal("Failed to create Natter", zap.Error(err))
+		fatal("Failed to create Natter", err)
 	}
 
 	// 捕捉中断信号，优雅退出
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
+	// 由 Windows SCM 启动时，服务停止请求同样取消 ctx
+	ctx, serviceDone := serviceContext(ctx)
+	defer serviceDone()
+
+	// SIGHUP 重新加载配置文件（仅配置文件模式）
+	if *configPath != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+		go reloadOnSignal(ctx, hup, *configPath, n, logger)
+	}
 
 	logger.Info("Starting natter")
-	n.Run(ctx)
+	if err := n.Start(ctx); errors.Is(err, orchestrator.ErrNoPortsBound) {
+		// 没有任何端口能监听：以非零退出码交给 systemd 等进程管理器决定重启或告警
+		fatal("Natter failed to start", err)
+	}
+	// systemd Type=notify：启动完成后通知就绪，退出时通知正在停止
+	if err := sdNotify("READY=1"); err != nil {
+		logger.Warn("sd_notify failed", zap.Error(err))
+	}
+	go func() {
+		<-ctx.Done()
+		_ = sdNotify("STOPPING=1")
+	}()
+	n.Wait()
 	logger.Info("Exited natter")
 }
 
+// writePidFile 把当前进程号写入 path
+func writePidFile(path string) error {
+	return os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// reloadOnSignal 每收到一次信号就重新加载一次配置，并向 systemd 报告重载状态
+func reloadOnSignal(ctx context.Context, sig <-chan os.Signal, path string, n *orchestrator.Natter, logger *zap.Logger) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sig:
+		}
+		logger.Info("Reloading config", zap.String("path", path))
+		_ = sdNotify("RELOADING=1")
+		reload(path, n, logger)
+		_ = sdNotify("READY=1")
+	}
+}
+
+// reload 重新读取配置并应用；读取或应用失败时保留当前配置
+func reload(path string, n *orchestrator.Natter, logger *zap.Logger) {
+	cfg, err := config.Load(path)
+	if err != nil {
+		logger.Warn("Config reload failed, keeping current config", zap.Error(err))
+		return
+	}
+	if err := n.Reload(cfg); err != nil {
+		logger.Warn("Config reload failed, keeping current config", zap.Error(err))
+	}
+}
+
 // cd /d/go/natter/
 // export CGO_ENABLED=0
 // GOOS=linux GOARCH=amd64 go build -ldflags="-s -w" -o natter-linux-amd64 ./cmd/natter
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"natter/internal/config"
+	"natter/internal/stun"
+
+	"go.uber.org/zap"
+)
+
+// runProbe 对本地端口执行一次 TCP/UDP STUN 检测并打印外部地址，不启动转发、保活，也不写状态文件；
+// 服务器取自 cfg（-c 或 NATTER_STUN_* 环境变量），其中的服务器列表 URL 先获取一次。返回进程退出码，全部失败时非 0
+func runProbe(cfg *config.Config, port int, logger *zap.Logger) int {
+	tcp, udp := fetchServers(cfg.StunServer.TCP), fetchServers(cfg.StunServer.UDP)
+	if len(tcp)+len(udp) == 0 {
+		fmt.Printf("no STUN servers configured: use -c or %s/%s\n", config.EnvStunTCP, config.EnvStunUDP)
+		return 1
+	}
+	c := stun.NewClient(tcp, udp, time.Second, logger,
+		stun.WithRace(cfg.StunServer.Race),
+		stun.WithFamily(cfg.StunServer.Family),
+		stun.WithCredentials(cfg.StunServer.Username, cfg.StunServer.Password, cfg.StunServer.Realm),
+	)
+	if ip := net.ParseIP(cfg.BindIP); ip != nil {
+		c.SetBindIP(ip)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	ok := false
+	probe := func(proto string, servers []string, get func(context.Context, int) (*stun.Mapping, error)) {
+		if len(servers) == 0 {
+			return
+		}
+		m, err := get(ctx, port)
+		if err != nil {
+			fmt.Printf("%s :%d  FAIL %v\n", proto, port, err)
+			return
+		}
+		ok = true
+		fmt.Printf("%s :%d -> %s\n", proto, port, m.ExternalAddr())
+	}
+	probe("tcp", tcp, c.GetTCPMapping)
+	probe("udp", udp, c.GetUDPMapping)
+	if !ok {
+		return 1
+	}
+	return 0
+}
+
+// fetchServers 把 list 中的服务器列表 URL 替换为获取到的服务器，获取失败时打印并跳过该 URL
+func fetchServers(list []string) []string {
+	var out []string
+	for _, s := range list {
+		if !config.IsServerURL(s) {
+			out = append(out, s)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		servers, err := stun.FetchServers(ctx, s)
+		cancel()
+		if err != nil {
+			fmt.Printf("server list %s  FAIL %v\n", s, err)
+			continue
+		}
+		out = append(out, servers...)
+	}
+	return out
+}
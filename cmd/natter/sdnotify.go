@@ -0,0 +1,21 @@
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// sdNotify 向 systemd 发送状态（如 "READY=1"）；未在 Type=notify 服务中运行（无 NOTIFY_SOCKET）时什么也不做
+func sdNotify(state string) error {
+	sock := os.Getenv("NOTIFY_SOCKET")
+	if sock == "" {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
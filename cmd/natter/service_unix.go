@@ -0,0 +1,24 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// serviceCommand 在 Linux/macOS 上只提示改用 systemd 等进程管理器；cmd 不是服务子命令时返回 false
+func serviceCommand(cmd string, _ []string) (int, bool) {
+	switch cmd {
+	case "install", "uninstall", "start", "stop":
+		fmt.Fprintf(os.Stderr, "%q is only available on Windows; use systemd (Type=notify) or -daemon instead\n", cmd)
+		return 2, true
+	}
+	return 0, false
+}
+
+// serviceContext 在 Linux/macOS 上原样返回 ctx，退出由 SIGINT/SIGTERM 触发
+func serviceContext(ctx context.Context) (context.Context, func()) {
+	return ctx, func() {}
+}
@@ -0,0 +1,173 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceName 是注册到 SCM 的服务名
+const serviceName = "natter"
+
+// serviceCommand 处理 install/uninstall/start/stop 子命令；cmd 不是这些子命令时返回 false。
+// install 之后的参数原样作为服务启动参数，其中 -c 的路径转为绝对路径（服务的工作目录是 System32）
+func serviceCommand(cmd string, args []string) (int, bool) {
+	var run func(*mgr.Mgr) error
+	switch cmd {
+	case "install":
+		run = func(m *mgr.Mgr) error { return installService(m, args) }
+	case "uninstall":
+		run = func(m *mgr.Mgr) error {
+			return withService(m, func(s *mgr.Service) error { return s.Delete() })
+		}
+	case "start":
+		run = func(m *mgr.Mgr) error {
+			return withService(m, func(s *mgr.Service) error { return s.Start() })
+		}
+	case "stop":
+		run = func(m *mgr.Mgr) error {
+			return withService(m, func(s *mgr.Service) error {
+				_, err := s.Control(svc.Stop)
+				return err
+			})
+		}
+	default:
+		return 0, false
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to connect to service manager (run as administrator): %v\n", err)
+		return 1, true
+	}
+	defer m.Disconnect()
+	if err := run(m); err != nil {
+		fmt.Fprintf(os.Stderr, "Service %s failed: %v\n", cmd, err)
+		return 1, true
+	}
+	fmt.Printf("Service %s: %s done\n", serviceName, cmd)
+	return 0, true
+}
+
+func installService(m *mgr.Mgr, args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", serviceName)
+	}
+	args, err = absConfigArg(args)
+	if err != nil {
+		return err
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "Natter",
+		Description: "Expose ports behind NAT via STUN hole punching",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	return s.Close()
+}
+
+func withService(m *mgr.Mgr, fn func(*mgr.Service) error) error {
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("open service %s: %w", serviceName, err)
+	}
+	defer s.Close()
+	return fn(s)
+}
+
+// absConfigArg 把 "-c path"、"-c=path"（也接受 "--c"）中的路径转为绝对路径
+func absConfigArg(args []string) ([]string, error) {
+	out := append([]string(nil), args...)
+	for i := 0; i < len(out); i++ {
+		flagName, val, hasVal := strings.Cut(strings.TrimLeft(out[i], "-"), "=")
+		if !strings.HasPrefix(out[i], "-") || flagName != "c" {
+			continue
+		}
+		if !hasVal {
+			if i+1 >= len(out) {
+				return nil, fmt.Errorf("-c requires a path")
+			}
+			i++
+			val = out[i]
+		}
+		abs, err := filepath.Abs(val)
+		if err != nil {
+			return nil, err
+		}
+		if hasVal {
+			out[i] = "-c=" + abs
+		} else {
+			out[i] = abs
+		}
+	}
+	return out, nil
+}
+
+// serviceContext 在由 SCM 启动时向 SCM 报告运行状态，收到停止/关机请求时取消返回的 ctx；
+// 返回的 done 需在退出前调用，报告服务已停止。不在服务中运行时原样返回 ctx
+func serviceContext(ctx context.Context) (context.Context, func()) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return ctx, func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	h := &serviceHandler{cancel: cancel, exited: make(chan struct{})}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		if err := svc.Run(serviceName, h); err != nil {
+			fmt.Fprintf(os.Stderr, "Service run failed: %v\n", err)
+		}
+		cancel()
+	}()
+	return ctx, func() {
+		close(h.exited)
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// serviceHandler 把 SCM 的停止请求转换为 ctx 取消，并等待 natter 退出后再报告已停止
+type serviceHandler struct {
+	cancel context.CancelFunc
+	exited chan struct{}
+}
+
+func (h *serviceHandler) Execute(_ []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	const accepts = svc.AcceptStop | svc.AcceptShutdown
+	changes <- svc.Status{State: svc.StartPending}
+	changes <- svc.Status{State: svc.Running, Accepts: accepts}
+	for {
+		select {
+		case <-h.exited:
+			// natter 自行退出（如启动失败）
+			return false, 0
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				changes <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				h.cancel()
+				<-h.exited
+				return false, 0
+			}
+		}
+	}
+}
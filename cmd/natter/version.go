@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// 构建信息，发布时通过 -ldflags 注入，例如：
+// go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse --short HEAD) -X main.date=$(date -u +%Y-%m-%dT%H:%M:%SZ)" ./cmd/natter
+var (
+	version = "dev"
+	commit  = "unknown"
+	date    = "unknown"
+)
+
+// printVersion 输出版本、提交、构建时间以及 Go 版本与平台
+func printVersion() {
+	fmt.Printf("natter %s (commit %s, built %s) %s %s/%s\n",
+		version, commit, date, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
@@ -0,0 +1,48 @@
+// Package clock 抽象 time.Now / time.After / time.NewTicker，
+// 让保活、STUN 轮询等定时循环可以在测试中由 Fake 驱动，而不必真实等待。
+package clock
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Clock 是定时循环依赖的最小时间接口。
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker 对应 *time.Ticker，C 改为方法以便 Fake 实现。
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// New 返回基于标准库 time 的真实时钟。
+func New() Clock { return realClock{} }
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTicker(d time.Duration) Ticker       { return realTicker{time.NewTicker(d)} }
+
+type realTicker struct{ t *time.Ticker }
+
+func (r realTicker) C() <-chan time.Time { return r.t.C }
+func (r realTicker) Stop()               { r.t.Stop() }
+
+// Jitter 在 d 上叠加 ±frac 比例的均匀随机偏移（frac=0.2 即 ±20%），
+// 用于错开多个实例的定时器。frac <= 0 时原样返回。
+func Jitter(d time.Duration, frac float64) time.Duration {
+	if frac <= 0 || d <= 0 {
+		return d
+	}
+	if frac > 1 {
+		frac = 1
+	}
+	delta := (rand.Float64()*2 - 1) * frac * float64(d)
+	return d + time.Duration(delta)
+}
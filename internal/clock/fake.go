@@ -0,0 +1,120 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Fake 是手动推进的时钟，只有调用 Add/Set 时时间才会前进，
+// 到期的 After/Ticker 会在推进时依次触发。
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+type fakeWaiter struct {
+	at     time.Time
+	period time.Duration // 0 表示一次性 After
+	ch     chan time.Time
+	done   bool
+}
+
+// NewFake 创建一个起始时间为 t 的 Fake 时钟。
+func NewFake(t time.Time) *Fake {
+	return &Fake{now: t}
+}
+
+// Now 返回当前的虚拟时间。
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// After 返回在虚拟时间前进 d 后触发的通道。
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	return f.add(d, 0).ch
+}
+
+// NewTicker 返回每经过 d 虚拟时间触发一次的 Ticker。
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	return &fakeTicker{f: f, w: f.add(d, d)}
+}
+
+// Waiters 返回尚未触发的 After/Ticker 数量，测试可据此判断循环已进入等待。
+func (f *Fake) Waiters() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, w := range f.waiters {
+		if !w.done {
+			n++
+		}
+	}
+	return n
+}
+
+// Add 将虚拟时间推进 d，并触发期间到期的所有等待者。
+func (f *Fake) Add(d time.Duration) {
+	f.Set(f.Now().Add(d))
+}
+
+// Set 将虚拟时间设置为 t（不会倒退），并触发到期的等待者。
+func (f *Fake) Set(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if t.Before(f.now) {
+		return
+	}
+	f.now = t
+
+	live := f.waiters[:0]
+	for _, w := range f.waiters {
+		for !w.done && !w.at.After(t) {
+			// 与 time.Ticker 一致：接收方来不及读取时丢弃本次触发
+			select {
+			case w.ch <- w.at:
+			default:
+			}
+			if w.period == 0 {
+				w.done = true
+			} else {
+				w.at = w.at.Add(w.period)
+			}
+		}
+		if !w.done {
+			live = append(live, w)
+		}
+	}
+	f.waiters = live
+}
+
+func (f *Fake) add(d, period time.Duration) *fakeWaiter {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w := &fakeWaiter{at: f.now.Add(d), period: period, ch: make(chan time.Time, 1)}
+	if d <= 0 {
+		w.ch <- f.now
+		w.done = true
+		return w
+	}
+	f.waiters = append(f.waiters, w)
+	return w
+}
+
+type fakeTicker struct {
+	f *Fake
+	w *fakeWaiter
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.w.ch }
+
+func (t *fakeTicker) Stop() {
+	t.f.mu.Lock()
+	t.w.done = true
+	t.f.mu.Unlock()
+}
@@ -4,61 +4,502 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/yaml"
 )
 
 // StunServer 配置 STUN 服务器列表
+// 每项可写 "host" 或 "host:port"（IPv6 需加方括号，如 "[2001:db8::1]:3478"），未写端口时默认 3478；
+// 也可写 http(s) URL，指向按行或以 JSON 字符串数组列出服务器的文件，见 IsServerURL
 type StunServer struct {
-	TCP []string `json:"tcp"`
-	UDP []string `json:"udp"`
+	TCP  HostList `json:"tcp"`
+	UDP  HostList `json:"udp"`
+	Race bool     `json:"race"` // 同时向所有服务器发起请求，取最先成功的结果
+
+	// 服务器列表 URL 的刷新间隔（秒）：0 使用默认 3600，负数只在启动与重载时获取；获取失败时沿用上次成功的列表
+	RefreshInterval int `json:"refresh_interval"`
+
+	// 地址族："ipv4"、"ipv6"，为空时根据绑定 IP 自动选择
+	Family string `json:"family"`
+
+	// 可选的长期凭据（RFC 5389 MESSAGE-INTEGRITY），Username 为空时不认证
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Realm    string `json:"realm"` // 服务器质询未带 REALM 时使用
+
+	// UDP 查询直接使用同端口转发器的监听 socket，映射与客户端实际看到的 5 元组一致；
+	// 没有转发器的端口与 TCP 查询不受影响
+	ShareSocket bool `json:"share_socket"`
 }
 
 // OpenPort 配置待检测的开放端口
 type OpenPort struct {
-	TCP []string `json:"tcp"` // 形式: "IP:Port"
-	UDP []string `json:"udp"`
+	TCP PortList `json:"tcp"` // 形式: "IP:Port"、"IP:8000-8010"、"IP:80,443"、"IP:Port->外部端口" 或 {"addr": ..., "interval": 5}
+	UDP PortList `json:"udp"`
+}
+
+// OpenAddr 是单个开放端口；Interval（秒）非 0 时覆盖全局 interval，用于该端口的 STUN 检测与保活；
+// ExternalPort 非 0 时向路由器（enable_upnp）申请该外部端口，而不是与内部端口相同的端口
+type OpenAddr struct {
+	Addr         string
+	Interval     int
+	ExternalPort int
+}
+
+// PortList 是开放端口列表，每一项可以是 "IP:Port" 或 {"addr": "IP:Port", "interval": 5, "external_port": 9090}；
+// 端口可写成区间 "IP:8000-8010" 或列表 "IP:80,443"，解析时展开为逐个端口；
+// 字符串末尾的 "->9090" 指定路由器映射的外部端口，见 splitExternal
+type PortList []OpenAddr
+
+// UnmarshalJSON 兼容字符串与对象混写，并展开端口区间
+func (p *PortList) UnmarshalJSON(data []byte) error {
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		return fmt.Errorf("expect a list of open ports: %w", err)
+	}
+	out := make(PortList, 0, len(items))
+	for _, item := range items {
+		var addr string
+		if err := json.Unmarshal(item, &addr); err == nil {
+			out = append(out, expandOpen(OpenAddr{Addr: addr})...)
+			continue
+		}
+		var obj struct {
+			Addr         string `json:"addr"`
+			Interval     int    `json:"interval"`
+			ExternalPort int    `json:"external_port"`
+		}
+		if err := json.Unmarshal(item, &obj); err != nil {
+			return fmt.Errorf("expect an open port string or object: %w", err)
+		}
+		out = append(out, expandOpen(OpenAddr{Addr: obj.Addr, Interval: obj.Interval, ExternalPort: obj.ExternalPort})...)
+	}
+	*p = out
+	return nil
+}
+
+// expandOpen 拆出 "->外部端口" 并把端口区间展开为多个开放端口，Interval 沿用；
+// 外部端口随内部端口依次递增，写成区间时数量须与内部端口一致
+func expandOpen(a OpenAddr) []OpenAddr {
+	addr, exts, ok := splitExternal(a.Addr)
+	if !ok {
+		return []OpenAddr{a} // 原样保留，交给 Validate 报告
+	}
+	addrs, ok := expandPorts(addr)
+	if !ok {
+		addrs = []string{addr}
+	}
+	if exts != nil && len(exts) != 1 && len(exts) != len(addrs) {
+		return []OpenAddr{a}
+	}
+	out := make([]OpenAddr, len(addrs))
+	for i, addr := range addrs {
+		ext := a.ExternalPort
+		switch {
+		case len(exts) == 1:
+			ext = exts[0] + i
+		case exts != nil:
+			ext = exts[i]
+		case ext != 0:
+			ext += i
+		}
+		out[i] = OpenAddr{Addr: addr, Interval: a.Interval, ExternalPort: ext}
+	}
+	return out
+}
+
+// Addrs 返回全部 "IP:Port"
+func (p PortList) Addrs() []string {
+	out := make([]string, len(p))
+	for i, a := range p {
+		out[i] = a.Addr
+	}
+	return out
 }
 
 // ForwardPort 配置需要转发的目标地址
+// 每项可写成地址字符串或 ForwardTarget 对象；TCP 目标还可写逗号分隔的多个地址或地址数组，按 forward.balance 负载均衡
 type ForwardPort struct {
-	TCP []string `json:"tcp"`
-	UDP []string `json:"udp"`
+	TCP TargetList `json:"tcp"`
+	UDP TargetList `json:"udp"` // UDP 只支持单个目标
+}
+
+// ForwardTarget 是单个转发项；留空的选项沿用全局 forward 配置
+type ForwardTarget struct {
+	Target        string    // "host:port" 或 "unix:/path"（仅 TCP），多个目标以逗号分隔
+	ProxyProtocol string    // "v1"、"v2" 或留空（仅 TCP）
+	AllowCIDRs    []string  // 非 nil 时覆盖 forward.allow_cidrs
+	DenyCIDRs     []string  // 非 nil 时覆盖 forward.deny_cidrs
+	TLS           TLSConfig // 设置证书时对该端口做 TLS 终止（仅 TCP）
+}
+
+// TLSConfig 配置转发端口的 TLS 终止：客户端以 TLS 连入，解密后以明文转发给目标。
+// Cert/Key 为 PEM 文件路径；Certs 可再列出多组证书，按客户端 SNI 选择匹配的证书
+type TLSConfig struct {
+	Cert  string     `json:"cert"`
+	Key   string     `json:"key"`
+	Certs []CertKey  `json:"certs"`
+	ACME  ACMEConfig `json:"acme"` // 设置 domain 时改为通过 ACME（Let's Encrypt）自动申请与续期证书，与 cert/certs 互斥
+}
+
+// ACMEConfig 配置自动证书；证书缓存在 CacheDir（默认 "acme-cache"），
+// HTTPAddr 非空时在该地址应答 HTTP-01 验证，否则只能通过 TLS 端口本身完成 TLS-ALPN-01 验证
+type ACMEConfig struct {
+	Domain   HostList `json:"domain"`    // 单个域名或域名列表
+	Email    string   `json:"email"`     // 可选，证书到期等通知的联系邮箱
+	CacheDir string   `json:"cache_dir"` // 证书与账户密钥的缓存目录
+	HTTPAddr string   `json:"http_addr"` // 如 "0.0.0.0:80"，可以同时列在 open_port.tcp 中借用打通的端口
+}
+
+// CertKey 是一组证书与私钥文件路径
+type CertKey struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// Enabled 报告是否配置了证书或 ACME
+func (t TLSConfig) Enabled() bool { return t.Cert != "" || len(t.Certs) > 0 || len(t.ACME.Domain) > 0 }
+
+// Pairs 返回全部证书，Cert/Key 在前
+func (t TLSConfig) Pairs() []CertKey {
+	var out []CertKey
+	if t.Cert != "" || t.Key != "" {
+		out = append(out, CertKey{Cert: t.Cert, Key: t.Key})
+	}
+	return append(out, t.Certs...)
+}
+
+// TargetList 是转发目标列表，每一项可以是：
+//   - "host:port"（可用逗号分隔多个）；"host:8000-8010"、"host:80,443" 展开为逐个端口的多项，与 open_port 一一对应
+//   - ["host1:port", "host2:port"]，合并为逗号分隔的字符串
+//   - {"target": "host:port" 或数组, "proxy_protocol": "v2", "allow_cidrs": [...], "deny_cidrs": [...], "tls": {...}}
+type TargetList []ForwardTarget
+
+// UnmarshalJSON 兼容字符串、数组与对象混写
+func (t *TargetList) UnmarshalJSON(data []byte) error {
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		return fmt.Errorf("expect a list of targets: %w", err)
+	}
+	out := make(TargetList, 0, len(items))
+	for _, item := range items {
+		var one HostList
+		if err := json.Unmarshal(item, &one); err == nil {
+			out = append(out, expandTarget(ForwardTarget{Target: strings.Join(one, ",")}, len(one))...)
+			continue
+		}
+		var obj struct {
+			Target        HostList  `json:"target"`
+			ProxyProtocol string    `json:"proxy_protocol"`
+			AllowCIDRs    []string  `json:"allow_cidrs"`
+			DenyCIDRs     []string  `json:"deny_cidrs"`
+			TLS           TLSConfig `json:"tls"`
+		}
+		if err := json.Unmarshal(item, &obj); err != nil {
+			return fmt.Errorf("expect a target string, list or object: %w", err)
+		}
+		out = append(out, expandTarget(ForwardTarget{
+			Target:        strings.Join(obj.Target, ","),
+			ProxyProtocol: obj.ProxyProtocol,
+			AllowCIDRs:    obj.AllowCIDRs,
+			DenyCIDRs:     obj.DenyCIDRs,
+			TLS:           obj.TLS,
+		}, len(obj.Target))...)
+	}
+	*t = out
+	return nil
+}
+
+// expandTarget 把单个目标的端口区间展开为多项，其余选项沿用；
+// n 为 JSON 中给出的地址个数，写成数组的多个地址是负载均衡的后端，不展开
+func expandTarget(t ForwardTarget, n int) []ForwardTarget {
+	if n != 1 {
+		return []ForwardTarget{t}
+	}
+	addrs, ok := expandPorts(t.Target)
+	if !ok {
+		return []ForwardTarget{t}
+	}
+	out := make([]ForwardTarget, len(addrs))
+	for i, addr := range addrs {
+		out[i] = t
+		out[i].Target = addr
+	}
+	return out
+}
+
+// ForwardOptions 是转发器的通用参数
+type ForwardOptions struct {
+	UDPBufferSize int         `json:"udp_buffer_size"` // UDP 数据报缓冲区字节数，默认 65536
+	UDPIdleTTL    int         `json:"udp_idle_ttl"`    // UDP 会话空闲多少秒后由后台清理，0 为关闭
+	UDPMaxClients int         `json:"udp_max_clients"` // 每个 UDP 转发器的最大会话数，超出时淘汰最久未活动的会话，0 为不限制
+	UDPTimeout    *int        `json:"udp_timeout"`     // UDP 会话两个方向都无数据多少秒后关闭，未设置时为 60，0 表示不因空闲关闭
+	UDPSourcePort string      `json:"udp_source_port"` // 连接 UDP 目标的本地端口：留空随机，"client" 同客户端端口，"listen" 复用监听端口
+	IdleTimeout   int         `json:"idle_timeout"`    // TCP 连接空闲超时（秒），默认 600
+	MaxConns      int         `json:"max_conns"`       // 每个 TCP 转发器的最大并发连接数，0 为不限制
+	Balance       string      `json:"balance"`         // 多目标负载均衡策略：round_robin（默认）或 random
+	HealthCheck   HealthCheck `json:"health_check"`    // 多目标健康检查，interval 为 0 时关闭
+	ProxyProtocol string      `json:"proxy_protocol"`  // 向 TCP 目标发送 PROXY 头："v1"、"v2"，留空关闭
+	// 连接（含解析）转发目标的超时（秒），默认 5；TCP 目标全部拨号失败后最多重试 DialRetries 次，
+	// 间隔从 DialRetryDelay 秒（默认 1）起翻倍
+	DialTimeout    int `json:"target_dial_timeout"`
+	DialRetries    int `json:"dial_retries"`
+	DialRetryDelay int `json:"dial_retry_delay"`
+	// TCP 限速（每秒字节数），如 "10MB"、"512KB"，留空不限速
+	RateLimit     string `json:"rate_limit"`      // 整个转发器每个方向的上限
+	RateLimitUp   string `json:"rate_limit_up"`   // 客户端 -> 目标，覆盖 rate_limit
+	RateLimitDown string `json:"rate_limit_down"` // 目标 -> 客户端，覆盖 rate_limit
+	ConnRateLimit string `json:"conn_rate_limit"` // 单个连接每个方向的上限
+	// 来源地址访问控制（CIDR 或单个 IP）：命中 deny 拒绝；allow 非空时只放行命中项
+	AllowCIDRs []string `json:"allow_cidrs"`
+	DenyCIDRs  []string `json:"deny_cidrs"`
+	// 调试用：以十六进制在 debug 日志中记录每个 TCP 连接每个方向、每个 UDP 数据报的前 DumpBytes 字节，0 为关闭
+	DumpBytes int `json:"dump_bytes"`
+	// UDP 监听 socket 与连接目标的 socket 的 SO_SNDBUF/SO_RCVBUF（字节），0 保持系统默认
+	UDPSndBuf int `json:"udp_sndbuf"`
+	UDPRcvBuf int `json:"udp_rcvbuf"`
+	// 目标主机名解析：DNSCacheTTL 秒内复用解析结果（拨号失败时立即重新解析），0 为每次拨号都解析；
+	// TargetFamily 为 "ipv4"/"ipv6" 时优先使用该地址族，留空按系统解析顺序
+	DNSCacheTTL  int    `json:"dns_cache_ttl"`
+	TargetFamily string `json:"target_family"`
+	// TCP 目标同时有 IPv4 与 IPv6 地址时，先连首选地址族、等待多少毫秒后并行连另一族（Happy Eyeballs），
+	// 0 使用默认 300，-1 关闭并行、按顺序逐个尝试
+	FallbackDelayMs int `json:"fallback_delay_ms"`
+}
+
+// HealthCheck 配置 TCP 转发目标的健康检查
+type HealthCheck struct {
+	Interval  int    `json:"interval"`  // 探测周期（秒），0 表示关闭
+	Threshold int    `json:"threshold"` // 连续失败多少次后摘除目标，默认 3
+	HTTPPath  string `json:"http_path"` // 非空时发送 HTTP GET 并要求 2xx/3xx，否则只检查 TCP 连接
 }
 
 // StatusReport 配置状态报告文件及 Hook
 type StatusReport struct {
-	Hook       string `json:"hook"`
-	StatusFile string `json:"status_file"`
+	Hook         HookList `json:"hook"`         // 单个命令，或命令/Webhook 定义的列表
+	HookTimeout  int      `json:"hook_timeout"` // Hook 命令最长运行时间（秒），默认 30
+	StatusFile   string   `json:"status_file"`
+	Format       string   `json:"format"`        // 状态文件格式：grouped（默认）、flat 或 keyed
+	ForwardStats bool     `json:"forward_stats"` // 定期将各转发器的流量统计写入状态文件
+	HTTPAddr     string   `json:"http_addr"`     // 非空时在该地址提供 /status 与 /healthz
+	// 映射连续多少个检测周期未刷新即从状态中移除：0 使用默认 10，负数关闭
+	StaleIntervals int `json:"stale_intervals"`
+	// 映射变化时 POST JSON {protocol, inner, outer, timestamp} 到该地址
+	WebhookURL     string `json:"webhook_url"`
+	WebhookTimeout int    `json:"webhook_timeout"` // 单次请求超时（秒），默认 5
+	WebhookRetries *int   `json:"webhook_retries"` // 失败重试次数，默认 3
+}
+
+// HookDef 定义一个映射变化 Hook：Command 与 Webhook 二选一
+type HookDef struct {
+	Command string `json:"command"` // 直接执行的命令行
+	Webhook string `json:"webhook"` // POST JSON 的地址
+	Timeout int    `json:"timeout"` // 超时（秒），0 使用 hook_timeout / webhook_timeout
+	Retries *int   `json:"retries"` // Webhook 失败重试次数，默认 3
+}
+
+// HookList 是 Hook 列表，JSON 中可写单个命令字符串，
+// 或由命令字符串与 {"command": ...} / {"webhook": ...} 对象组成的数组
+type HookList []HookDef
+
+// UnmarshalJSON 兼容 "cmd"、["cmd1", {"webhook": "https://..."}] 等写法
+func (h *HookList) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		if one == "" {
+			*h = nil
+		} else {
+			*h = HookList{{Command: one}}
+		}
+		return nil
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		return fmt.Errorf("expect a hook command or a list of hooks: %w", err)
+	}
+	out := make(HookList, 0, len(items))
+	for _, item := range items {
+		var cmd string
+		if err := json.Unmarshal(item, &cmd); err == nil {
+			out = append(out, HookDef{Command: cmd})
+			continue
+		}
+		var def HookDef
+		if err := json.Unmarshal(item, &def); err != nil {
+			return fmt.Errorf("expect a hook command or object: %w", err)
+		}
+		if (def.Command == "") == (def.Webhook == "") {
+			return fmt.Errorf("hook must set exactly one of command or webhook")
+		}
+		out = append(out, def)
+	}
+	*h = out
+	return nil
+}
+
+// HostList 是主机列表，JSON 中既可写单个字符串也可写字符串数组
+type HostList []string
+
+// UnmarshalJSON 兼容 "host" 与 ["host1", "host2"] 两种写法
+func (h *HostList) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		if one == "" {
+			*h = nil
+		} else {
+			*h = HostList{one}
+		}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("expect a host string or a list of hosts: %w", err)
+	}
+	*h = many
+	return nil
+}
+
+// IsServerURL 报告 stun_server 列表中的一项是否为服务器列表 URL（http:// 或 https://），而不是服务器地址
+func IsServerURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// KeepAliveRequest 自定义 TCP 保活发送的 HTTP 请求，留空字段使用默认值
+type KeepAliveRequest struct {
+	Method  string            `json:"method"`  // 默认 "HEAD"
+	Path    string            `json:"path"`    // 默认 "/natter-keep-alive"
+	Headers map[string]string `json:"headers"` // 附加请求头，Host/Connection 会覆盖默认值
 }
 
 // Logging 配置日志等级和文件
 type Logging struct {
 	Level   string `json:"level"`    // "debug", "info", etc.
 	LogFile string `json:"log_file"` // 可选路径，"" 表示不写文件
+	Format  string `json:"format"`   // "console"（默认）或 "json"
+
+	// 审计日志：非空时把客户端接入、映射变化与 Hook 执行以 JSON Lines 追加写入该文件，与 level 无关
+	AuditFile string `json:"audit_file"`
+
+	// 日志文件轮转，任一项非 0 时启用
+	MaxSizeMB  int `json:"max_size_mb"`  // 单个文件上限（MB），0 为默认 100
+	MaxBackups int `json:"max_backups"`  // 保留的旧文件个数，0 为不限
+	MaxAgeDays int `json:"max_age_days"` // 旧文件保留天数，0 为不限
+}
+
+// UPnPDiscover 配置端口映射发现失败时的重试（路由器刚开机时服务可能尚未就绪）
+// 最多尝试 Attempts 次（默认 3），间隔从 Interval 秒（默认 5）起翻倍；
+// 全部失败后若 RediscoverInterval > 0，每隔该秒数重新发现一次，否则放弃
+type UPnPDiscover struct {
+	Attempts           int `json:"attempts"`
+	Interval           int `json:"interval"`
+	RediscoverInterval int `json:"rediscover_interval"`
 }
 
 // Config 是整个配置文件结构
 // Interval 单位为秒，用于控制映射检测和保活间隔
+// StunMaxInterval 单位为秒：映射稳定时 STUN 检测间隔按指数增长的上限，<= Interval 时不退避
 type Config struct {
-	EnableUPnP   bool         `json:"enable_upnp"` // 是否启用 UPnP 映射
-	StunServer   StunServer   `json:"stun_server"`
-	KeepAlive    string       `json:"keep_alive"`
-	Interval     int          `json:"interval"`
-	OpenPort     OpenPort     `json:"open_port"`
-	ForwardPort  ForwardPort  `json:"forward_port"`
-	StatusReport StatusReport `json:"status_report"`
-	Logging      Logging      `json:"logging"`
+	EnableUPnP      bool             `json:"enable_upnp"` // 是否启用 UPnP 映射
+	UPnPLease       int              `json:"upnp_lease"`  // 映射租期（秒），Natter 每半个租期续期一次；0 表示申请永久映射
+	UPnPDiscover    UPnPDiscover     `json:"upnp_discover"`
+	UPnPTimeout     int              `json:"upnp_timeout"` // 端口映射每次发现或请求的超时（秒），0 时发现 3 秒、请求 5 秒
+	StunServer      StunServer       `json:"stun_server"`
+	KeepAlive       HostList         `json:"keep_alive"`        // 单个主机或主机列表，当前主机连续失败后切换到下一个
+	KeepAlivePort   int              `json:"keep_alive_port"`   // TCP 保活目标端口，默认 80（https 为 443）
+	KeepAliveScheme string           `json:"keep_alive_scheme"` // "http"（默认）或 "https"
+	KeepAliveReq    KeepAliveRequest `json:"keep_alive_request"`
+	KeepAliveMode   string           `json:"keep_alive_mode"`        // ""（默认，每个端口 TCP/UDP 保活）或 "icmp"（单一 ICMP Echo 保活）
+	KeepAliveUDP    string           `json:"keep_alive_udp_payload"` // "dns"（默认）、"stun"、"empty"、"hex:..."、"file:..."
+	Interval        int              `json:"interval"`
+	StunMaxInterval int              `json:"stun_max_interval"`
+	Jitter          *float64         `json:"jitter"` // 保活与 STUN 间隔的随机抖动比例，未设置时为 DefaultJitter，0 表示关闭
+	OpenPort        OpenPort         `json:"open_port"`
+	ForwardPort     ForwardPort      `json:"forward_port"`
+	Forward         ForwardOptions   `json:"forward"`
+	StatusReport    StatusReport     `json:"status_report"`
+	MetricsAddr     string           `json:"metrics_addr"`     // 非空时在该地址提供 Prometheus /metrics
+	ShutdownTimeout int              `json:"shutdown_timeout"` // 退出或重载时等待转发连接自然结束的秒数，超时后强制关闭；0 使用默认 10，负数无效
+	StatsInterval   int              `json:"stats_interval"`   // 每隔多少秒在日志中输出一行运行统计，0 为关闭
+	BindIP          string           `json:"bind_ip"`          // STUN 与保活使用的本机源 IP，为空时通过 bind_probe 自动探测
+	BindInterface   string           `json:"bind_interface"`   // 网卡名（如 "eth1"），启动时取其 IPv4 地址作为源 IP，与 bind_ip 互斥
+	BindProbe       HostList         `json:"bind_probe"`       // 探测出口 IP 时 UDP "连接"的目标 "IP:Port"，依次尝试；为空时使用内置列表
+	Proxy           string           `json:"proxy"`            // "socks5://[user:pass@]host:port"，TCP STUN 与 TCP 保活经该代理连出，UDP 与转发不受影响
+	Logging         Logging          `json:"logging"`
+
+	// PID 文件：非空时启动后写入进程号，正常退出时删除；与 -daemon 配合供 init 脚本管理进程
+	PidFile string `json:"pid_file"`
+}
+
+// ParseByteSize 解析 "10MB"、"512KB"、"1G"、"2048" 形式的字节数（1K = 1024），空串返回 0
+func ParseByteSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if s == "" {
+		return 0, nil
+	}
+	num := strings.TrimRight(strings.TrimSuffix(s, "B"), "KMG")
+	unit := strings.TrimSuffix(s[len(num):], "B")
+	var mult int64
+	switch unit {
+	case "":
+		mult = 1
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	default:
+		return 0, fmt.Errorf("无效的字节数 %q", s)
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("无效的字节数 %q", s)
+	}
+	return int64(v * float64(mult)), nil
+}
+
+// DefaultJitter 是未配置 jitter 时使用的抖动比例（±10%）
+const DefaultJitter = 0.1
+
+// JitterRatio 返回生效的抖动比例
+func (c *Config) JitterRatio() float64 {
+	if c.Jitter == nil {
+		return DefaultJitter
+	}
+	return *c.Jitter
 }
 
-// Load 从 JSON 配置文件加载 Config
+// Load 从配置文件加载 Config；扩展名为 .yaml/.yml 时按 YAML 解析，其余按 JSON 解析。
+// 解析后依次应用环境变量覆盖（见 ApplyEnv）与缺省值（见 ApplyDefaults），再校验最终结果
 func Load(path string) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("读取配置文件失败: %w", err)
 	}
 
+	// YAML 先转换为 JSON，复用同一套 json 标签与自定义解析（如 TargetList、HostList）
+	format := "JSON"
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		format = "YAML"
+		if data, err = yaml.YAMLToJSON(data); err != nil {
+			return nil, fmt.Errorf("解析 %s 配置文件失败: %w", format, err)
+		}
+	}
+
 	var cfg Config
 	if err := json.Unmarshal(data, &cfg); err != nil {
-		return nil, fmt.Errorf("解析配置文件失败: %w", err)
+		return nil, fmt.Errorf("解析 %s 配置文件失败: %w", format, err)
+	}
+	if err := cfg.ApplyEnv(); err != nil {
+		return nil, err
+	}
+	cfg.ApplyDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("配置无效:\n%w", err)
 	}
 
 	return &cfg, nil
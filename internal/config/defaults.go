@@ -0,0 +1,31 @@
+package config
+
+// 缺省配置，Load 在应用环境变量之后为未设置的字段填入
+const (
+	DefaultInterval   = 10            // 检测与保活间隔（秒）
+	DefaultStatusFile = "status.json" // 状态文件路径
+	DefaultKeepAlive  = "www.qq.com"  // 保活主机
+	DefaultUDPTimeout = 60            // UDP 转发会话的空闲超时（秒）
+
+	DefaultShutdownTimeout = 10 // 退出时等待转发连接结束的时长（秒）
+)
+
+// ApplyDefaults 为未设置（零值）的字段填入缺省值，保证各代码路径拿到安全的取值
+func (c *Config) ApplyDefaults() {
+	if c.Interval == 0 {
+		c.Interval = DefaultInterval
+	}
+	if c.StatusReport.StatusFile == "" {
+		c.StatusReport.StatusFile = DefaultStatusFile
+	}
+	if len(c.KeepAlive) == 0 {
+		c.KeepAlive = HostList{DefaultKeepAlive}
+	}
+	if c.Forward.UDPTimeout == nil {
+		t := DefaultUDPTimeout
+		c.Forward.UDPTimeout = &t
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = DefaultShutdownTimeout
+	}
+}
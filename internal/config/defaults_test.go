@@ -0,0 +1,75 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// clearEnv 在测试期间移除 NATTER_* 覆盖变量，结束后恢复
+func clearEnv(t *testing.T) {
+	t.Helper()
+	for _, name := range []string{EnvInterval, EnvStunTCP, EnvStunUDP, EnvKeepAlive, EnvStatusFile} {
+		if v, ok := os.LookupEnv(name); ok {
+			os.Unsetenv(name)
+			t.Cleanup(func() { os.Setenv(name, v) })
+		}
+	}
+}
+
+// loadJSON 把 data 写入临时配置文件并用 Load 加载
+func loadJSON(t *testing.T, data string) (*Config, error) {
+	t.Helper()
+	clearEnv(t)
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return Load(path)
+}
+
+func TestLoadAppliesDefaults(t *testing.T) {
+	cfg, err := loadJSON(t, `{
+		"open_port": {"tcp": ["0.0.0.0:34567"]}
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Interval != 10 {
+		t.Errorf("interval = %d, want 10", cfg.Interval)
+	}
+	if cfg.StatusReport.StatusFile != "status.json" {
+		t.Errorf("status_file = %q, want %q", cfg.StatusReport.StatusFile, "status.json")
+	}
+	if len(cfg.KeepAlive) != 1 || cfg.KeepAlive[0] != "www.qq.com" {
+		t.Errorf("keep_alive = %v, want [www.qq.com]", cfg.KeepAlive)
+	}
+	if cfg.Forward.UDPTimeout == nil || *cfg.Forward.UDPTimeout != 60 {
+		t.Errorf("forward.udp_timeout = %v, want 60", cfg.Forward.UDPTimeout)
+	}
+	if cfg.ShutdownTimeout != 10 {
+		t.Errorf("shutdown_timeout = %d, want 10", cfg.ShutdownTimeout)
+	}
+}
+
+func TestLoadKeepsExplicitValues(t *testing.T) {
+	cfg, err := loadJSON(t, `{
+		"open_port": {"tcp": ["0.0.0.0:34567"]},
+		"interval": 30,
+		"keep_alive": ["a.example", "b.example"],
+		"status_report": {"status_file": "/tmp/natter.json"},
+		"forward": {"udp_timeout": 0},
+		"shutdown_timeout": 3
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Interval != 30 || cfg.StatusReport.StatusFile != "/tmp/natter.json" || len(cfg.KeepAlive) != 2 || cfg.ShutdownTimeout != 3 {
+		t.Errorf("explicit values overwritten: interval=%d status_file=%q keep_alive=%v shutdown_timeout=%d",
+			cfg.Interval, cfg.StatusReport.StatusFile, cfg.KeepAlive, cfg.ShutdownTimeout)
+	}
+	// udp_timeout 显式写 0 表示不因空闲关闭，不能被缺省值替换
+	if cfg.Forward.UDPTimeout == nil || *cfg.Forward.UDPTimeout != 0 {
+		t.Errorf("forward.udp_timeout = %v, want explicit 0", cfg.Forward.UDPTimeout)
+	}
+}
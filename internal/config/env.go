@@ -0,0 +1,52 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// 可覆盖配置的环境变量，优先级：环境变量 > 配置文件 > 内置默认值
+const (
+	EnvInterval   = "NATTER_INTERVAL"    // 检测间隔（秒）
+	EnvStunTCP    = "NATTER_STUN_TCP"    // 逗号分隔的 TCP STUN 服务器
+	EnvStunUDP    = "NATTER_STUN_UDP"    // 逗号分隔的 UDP STUN 服务器
+	EnvKeepAlive  = "NATTER_KEEPALIVE"   // 逗号分隔的保活主机
+	EnvStatusFile = "NATTER_STATUS_FILE" // 状态文件路径
+)
+
+// ApplyEnv 用已设置的环境变量覆盖对应字段；未设置的变量不影响配置
+func (c *Config) ApplyEnv() error {
+	if v, ok := os.LookupEnv(EnvInterval); ok {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return fmt.Errorf("%s=%q 不是整数", EnvInterval, v)
+		}
+		c.Interval = n
+	}
+	if v, ok := os.LookupEnv(EnvStunTCP); ok {
+		c.StunServer.TCP = splitList(v)
+	}
+	if v, ok := os.LookupEnv(EnvStunUDP); ok {
+		c.StunServer.UDP = splitList(v)
+	}
+	if v, ok := os.LookupEnv(EnvKeepAlive); ok {
+		c.KeepAlive = splitList(v)
+	}
+	if v, ok := os.LookupEnv(EnvStatusFile); ok {
+		c.StatusReport.StatusFile = strings.TrimSpace(v)
+	}
+	return nil
+}
+
+// splitList 拆分逗号分隔的列表，忽略空项
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"strconv"
+	"strings"
+)
+
+// expandPorts 展开端口区间与端口列表写法：
+// "0.0.0.0:8000-8002" → 0.0.0.0:8000、0.0.0.0:8001、0.0.0.0:8002；"0.0.0.0:80,443" → 0.0.0.0:80、0.0.0.0:443，两者可混写。
+// 不是这种写法（单个端口、逗号分隔的多个 host:port、unix: 路径等）或区间无效时返回 false，
+// 原样保留，交给 Validate 报告格式错误
+func expandPorts(addr string) ([]string, bool) {
+	i := strings.LastIndex(addr, ":")
+	if i < 0 {
+		return nil, false
+	}
+	host, spec := addr[:i], addr[i+1:]
+	if strings.Contains(host, ",") || !strings.ContainsAny(spec, ",-") {
+		return nil, false
+	}
+	var out []string
+	for _, part := range strings.Split(spec, ",") {
+		lo, hi, ok := parseRange(strings.TrimSpace(part))
+		if !ok {
+			return nil, false
+		}
+		for p := lo; p <= hi; p++ {
+			out = append(out, host+":"+strconv.Itoa(p))
+		}
+	}
+	return out, true
+}
+
+// splitExternal 拆分 "IP:Port->外部端口"，外部端口可写 "9090" 或区间 "9000-9010"。
+// 没有 "->" 时 exts 为 nil；外部端口无效时返回 false
+func splitExternal(addr string) (inner string, exts []int, ok bool) {
+	inner, spec, found := strings.Cut(addr, "->")
+	if !found {
+		return addr, nil, true
+	}
+	lo, hi, ok := parseRange(strings.TrimSpace(spec))
+	if !ok {
+		return "", nil, false
+	}
+	for p := lo; p <= hi; p++ {
+		exts = append(exts, p)
+	}
+	return strings.TrimSpace(inner), exts, true
+}
+
+// parseRange 解析 "N" 或 "N-M"，要求 1 <= N <= M <= 65535
+func parseRange(s string) (lo, hi int, ok bool) {
+	a, b, isRange := strings.Cut(s, "-")
+	lo, err := strconv.Atoi(a)
+	if err != nil {
+		return 0, 0, false
+	}
+	hi = lo
+	if isRange {
+		if hi, err = strconv.Atoi(b); err != nil {
+			return 0, 0, false
+		}
+	}
+	if lo < 1 || hi > 65535 || lo > hi {
+		return 0, 0, false
+	}
+	return lo, hi, true
+}
@@ -0,0 +1,109 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPortListExpansion(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want PortList
+	}{
+		{"single port", `["0.0.0.0:8000"]`, PortList{{Addr: "0.0.0.0:8000"}}},
+		{"range", `["0.0.0.0:8000-8002"]`, PortList{
+			{Addr: "0.0.0.0:8000"}, {Addr: "0.0.0.0:8001"}, {Addr: "0.0.0.0:8002"},
+		}},
+		{"list", `["0.0.0.0:80,443"]`, PortList{{Addr: "0.0.0.0:80"}, {Addr: "0.0.0.0:443"}}},
+		{"list and range mixed", `["0.0.0.0:80,8000-8001"]`, PortList{
+			{Addr: "0.0.0.0:80"}, {Addr: "0.0.0.0:8000"}, {Addr: "0.0.0.0:8001"},
+		}},
+		{"external port", `["0.0.0.0:8000->9090"]`, PortList{{Addr: "0.0.0.0:8000", ExternalPort: 9090}}},
+		{"range with external start", `["0.0.0.0:8000-8002->9000"]`, PortList{
+			{Addr: "0.0.0.0:8000", ExternalPort: 9000},
+			{Addr: "0.0.0.0:8001", ExternalPort: 9001},
+			{Addr: "0.0.0.0:8002", ExternalPort: 9002},
+		}},
+		{"range with external range", `["0.0.0.0:8000-8001->9000-9001"]`, PortList{
+			{Addr: "0.0.0.0:8000", ExternalPort: 9000}, {Addr: "0.0.0.0:8001", ExternalPort: 9001},
+		}},
+		{"object keeps interval", `[{"addr": "0.0.0.0:8000-8001", "interval": 5, "external_port": 9000}]`, PortList{
+			{Addr: "0.0.0.0:8000", Interval: 5, ExternalPort: 9000},
+			{Addr: "0.0.0.0:8001", Interval: 5, ExternalPort: 9001},
+		}},
+		// 无效写法原样保留，由 Validate 报告
+		{"mismatched range length", `["0.0.0.0:8000-8002->9000-9001"]`, PortList{{Addr: "0.0.0.0:8000-8002->9000-9001"}}},
+		{"reversed range", `["0.0.0.0:8002-8000"]`, PortList{{Addr: "0.0.0.0:8002-8000"}}},
+		{"port out of range", `["0.0.0.0:65535-65536"]`, PortList{{Addr: "0.0.0.0:65535-65536"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got PortList
+			if err := json.Unmarshal([]byte(tt.json), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTargetListExpansion(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want []string
+	}{
+		{"single target", `["10.0.0.2:80"]`, []string{"10.0.0.2:80"}},
+		{"range", `["10.0.0.2:8000-8002"]`, []string{"10.0.0.2:8000", "10.0.0.2:8001", "10.0.0.2:8002"}},
+		{"list", `["10.0.0.2:80,443"]`, []string{"10.0.0.2:80", "10.0.0.2:443"}},
+		// 逗号分隔的多个 host:port 是同一转发项的多个后端，不展开
+		{"multiple backends", `["10.0.0.2:80,10.0.0.3:80"]`, []string{"10.0.0.2:80,10.0.0.3:80"}},
+		{"backend array", `[["10.0.0.2:80", "10.0.0.3:80"]]`, []string{"10.0.0.2:80,10.0.0.3:80"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var list TargetList
+			if err := json.Unmarshal([]byte(tt.json), &list); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, len(list))
+			for i, target := range list {
+				got[i] = target.Target
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadRejectsMismatchedExternalRange(t *testing.T) {
+	_, err := loadJSON(t, `{"open_port": {"udp": ["0.0.0.0:8000-8002->9000-9001"]}}`)
+	if err == nil {
+		t.Fatal("Load accepted a 3-port range mapped to a 2-port external range")
+	}
+	if !strings.Contains(err.Error(), "open_port.udp[0]") || !strings.Contains(err.Error(), "8000-8002->9000-9001") {
+		t.Errorf("error %q does not name the offending entry", err)
+	}
+}
+
+func TestLoadPairsExpandedRanges(t *testing.T) {
+	cfg, err := loadJSON(t, `{
+		"open_port": {"tcp": ["0.0.0.0:8000-8002"]},
+		"forward_port": {"tcp": ["10.0.0.2:9000-9002"]}
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.OpenPort.TCP) != 3 || len(cfg.ForwardPort.TCP) != 3 {
+		t.Fatalf("got %d open ports and %d targets, want 3 each", len(cfg.OpenPort.TCP), len(cfg.ForwardPort.TCP))
+	}
+	if cfg.OpenPort.TCP[2].Addr != "0.0.0.0:8002" || cfg.ForwardPort.TCP[2].Target != "10.0.0.2:9002" {
+		t.Errorf("last pair = %s -> %s, want 0.0.0.0:8002 -> 10.0.0.2:9002", cfg.OpenPort.TCP[2].Addr, cfg.ForwardPort.TCP[2].Target)
+	}
+}
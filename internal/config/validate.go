@@ -0,0 +1,337 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Validate 检查配置是否完整、地址与端口格式是否正确，一次性返回全部问题（errors.Join）
+func (c *Config) Validate() error {
+	var errs []error
+	bad := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.Interval <= 0 {
+		bad("interval 必须大于 0，当前为 %d", c.Interval)
+	}
+	if c.StunMaxInterval < 0 {
+		bad("stun_max_interval 不能为负数")
+	}
+	if c.UPnPLease < 0 {
+		bad("upnp_lease 不能为负数")
+	}
+	if c.UPnPTimeout < 0 {
+		bad("upnp_timeout 不能为负数")
+	}
+	if len(c.OpenPort.TCP)+len(c.OpenPort.UDP) == 0 {
+		bad("open_port 至少需要一个 TCP 或 UDP 端口")
+	}
+	if c.ShutdownTimeout < 0 {
+		bad("shutdown_timeout 不能为负数")
+	}
+	if t := c.Forward.UDPTimeout; t != nil && *t < 0 {
+		bad("forward.udp_timeout 不能为负数")
+	}
+
+	// 开放端口必须是 "IP:Port"，且对应协议要有 STUN 服务器
+	for _, l := range []struct {
+		field string
+		ports PortList
+	}{{"open_port.tcp", c.OpenPort.TCP}, {"open_port.udp", c.OpenPort.UDP}} {
+		for i, a := range l.ports {
+			if err := checkIPPort(a.Addr); err != nil {
+				bad("%s[%d] %q: %w", l.field, i, a.Addr, err)
+			}
+			if a.Interval < 0 {
+				bad("%s[%d].interval 不能为负数", l.field, i)
+			}
+			if a.ExternalPort < 0 || a.ExternalPort > 65535 {
+				bad("%s[%d].external_port 超出范围: %d", l.field, i, a.ExternalPort)
+			}
+		}
+	}
+	for i, s := range c.StunServer.TCP {
+		if err := checkServer(s); err != nil {
+			bad("stun_server.tcp[%d] %q: %w", i, s, err)
+		}
+	}
+	for i, s := range c.StunServer.UDP {
+		if err := checkServer(s); err != nil {
+			bad("stun_server.udp[%d] %q: %w", i, s, err)
+		}
+	}
+	if !oneOf(c.StunServer.Family, "", "ipv4", "ipv6") {
+		bad("stun_server.family 只能是 ipv4 或 ipv6，当前为 %q", c.StunServer.Family)
+	}
+
+	// 转发目标与开放端口一一对应
+	if n := len(c.ForwardPort.TCP); n > 0 && n != len(c.OpenPort.TCP) {
+		bad("forward_port.tcp 有 %d 项，与 open_port.tcp 的 %d 项数量不一致", n, len(c.OpenPort.TCP))
+	}
+	if n := len(c.ForwardPort.UDP); n > 0 && n != len(c.OpenPort.UDP) {
+		bad("forward_port.udp 有 %d 项，与 open_port.udp 的 %d 项数量不一致", n, len(c.OpenPort.UDP))
+	}
+	for i, t := range c.ForwardPort.TCP {
+		errs = append(errs, checkTarget(fmt.Sprintf("forward_port.tcp[%d]", i), t, true)...)
+	}
+	for i, t := range c.ForwardPort.UDP {
+		errs = append(errs, checkTarget(fmt.Sprintf("forward_port.udp[%d]", i), t, false)...)
+	}
+
+	errs = append(errs, c.Forward.validate()...)
+
+	if !oneOf(c.KeepAliveMode, "", "icmp") {
+		bad("keep_alive_mode 只能是 icmp 或留空，当前为 %q", c.KeepAliveMode)
+	}
+	if !oneOf(c.KeepAliveScheme, "", "http", "https") {
+		bad("keep_alive_scheme 只能是 http 或 https，当前为 %q", c.KeepAliveScheme)
+	}
+	if c.KeepAlivePort < 0 || c.KeepAlivePort > 65535 {
+		bad("keep_alive_port 超出范围: %d", c.KeepAlivePort)
+	}
+	if c.Jitter != nil && (*c.Jitter < 0 || *c.Jitter >= 1) {
+		bad("jitter 必须在 [0, 1) 之间，当前为 %v", *c.Jitter)
+	}
+	if !oneOf(c.StatusReport.Format, "", "grouped", "flat", "keyed") {
+		bad("status_report.format 只能是 grouped、flat 或 keyed，当前为 %q", c.StatusReport.Format)
+	}
+	if a := c.StatusReport.HTTPAddr; a != "" {
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			bad("status_report.http_addr %q: %w", a, err)
+		}
+	}
+	if c.BindIP != "" && net.ParseIP(c.BindIP) == nil {
+		bad("bind_ip %q 不是有效的 IP", c.BindIP)
+	}
+	if c.BindIP != "" && c.BindInterface != "" {
+		bad("bind_ip 与 bind_interface 不能同时设置")
+	}
+	for i, a := range c.BindProbe {
+		if err := checkHostPort(a); err != nil {
+			bad("bind_probe[%d] %q: %w", i, a, err)
+		}
+	}
+	if p := c.Proxy; p != "" {
+		if err := checkProxy(p); err != nil {
+			bad("proxy %q: %w", p, err)
+		}
+	}
+	if a := c.MetricsAddr; a != "" {
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			bad("metrics_addr %q: %w", a, err)
+		}
+	}
+	if !oneOf(strings.ToLower(c.Logging.Level), "", "debug", "info", "warn", "error") {
+		bad("logging.level 只能是 debug、info、warn 或 error，当前为 %q", c.Logging.Level)
+	}
+	if !oneOf(c.Logging.Format, "", "console", "json") {
+		bad("logging.format 只能是 console 或 json，当前为 %q", c.Logging.Format)
+	}
+	if c.StatsInterval < 0 {
+		bad("stats_interval 不能为负数")
+	}
+	if c.Logging.MaxSizeMB < 0 || c.Logging.MaxBackups < 0 || c.Logging.MaxAgeDays < 0 {
+		bad("logging.max_size_mb/max_backups/max_age_days 不能为负数")
+	}
+	return errors.Join(errs...)
+}
+
+// validate 检查全局转发选项
+func (f ForwardOptions) validate() []error {
+	var errs []error
+	if !oneOf(f.Balance, "", "round_robin", "random") {
+		errs = append(errs, fmt.Errorf("forward.balance 只能是 round_robin 或 random，当前为 %q", f.Balance))
+	}
+	if !oneOf(f.UDPSourcePort, "", "client", "listen") {
+		errs = append(errs, fmt.Errorf("forward.udp_source_port 只能是 client、listen 或留空，当前为 %q", f.UDPSourcePort))
+	}
+	if !oneOf(f.ProxyProtocol, "", "v1", "v2") {
+		errs = append(errs, fmt.Errorf("forward.proxy_protocol 只能是 v1 或 v2，当前为 %q", f.ProxyProtocol))
+	}
+	for _, r := range []struct{ name, value string }{
+		{"rate_limit", f.RateLimit}, {"rate_limit_up", f.RateLimitUp},
+		{"rate_limit_down", f.RateLimitDown}, {"conn_rate_limit", f.ConnRateLimit},
+	} {
+		if _, err := ParseByteSize(r.value); err != nil {
+			errs = append(errs, fmt.Errorf("forward.%s: %w", r.name, err))
+		}
+	}
+	if f.DumpBytes < 0 {
+		errs = append(errs, errors.New("forward.dump_bytes 不能为负数"))
+	}
+	if f.UDPSndBuf < 0 || f.UDPRcvBuf < 0 {
+		errs = append(errs, errors.New("forward.udp_sndbuf/udp_rcvbuf 不能为负数"))
+	}
+	if f.FallbackDelayMs < -1 {
+		errs = append(errs, fmt.Errorf("forward.fallback_delay_ms 只能是 -1（关闭）或非负数，当前为 %d", f.FallbackDelayMs))
+	}
+	if f.DNSCacheTTL < 0 {
+		errs = append(errs, errors.New("forward.dns_cache_ttl 不能为负数"))
+	}
+	if !oneOf(f.TargetFamily, "", "ipv4", "ipv6") {
+		errs = append(errs, fmt.Errorf("forward.target_family 只能是 ipv4、ipv6 或留空，当前为 %q", f.TargetFamily))
+	}
+	if f.DialTimeout < 0 || f.DialRetries < 0 || f.DialRetryDelay < 0 {
+		errs = append(errs, errors.New("forward.target_dial_timeout/dial_retries/dial_retry_delay 不能为负数"))
+	}
+	errs = append(errs, checkCIDRs("forward.allow_cidrs", f.AllowCIDRs)...)
+	errs = append(errs, checkCIDRs("forward.deny_cidrs", f.DenyCIDRs)...)
+	return errs
+}
+
+// checkTarget 检查单个转发项；UDP 只支持单个目标
+func checkTarget(field string, t ForwardTarget, tcp bool) []error {
+	var errs []error
+	var targets []string
+	for _, s := range strings.Split(t.Target, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			targets = append(targets, s)
+		}
+	}
+	if len(targets) == 0 {
+		errs = append(errs, fmt.Errorf("%s: 目标地址不能为空", field))
+	}
+	if !tcp && len(targets) > 1 {
+		errs = append(errs, fmt.Errorf("%s: UDP 只支持单个目标，当前为 %q", field, t.Target))
+	}
+	for _, s := range targets {
+		if path, ok := strings.CutPrefix(s, "unix:"); ok {
+			// Unix 域套接字目标，如 "unix:/run/app.sock"
+			if !tcp {
+				errs = append(errs, fmt.Errorf("%s %q: UDP 不支持 unix: 目标", field, s))
+			} else if path == "" {
+				errs = append(errs, fmt.Errorf("%s %q: 缺少套接字路径", field, s))
+			}
+			continue
+		}
+		if err := checkHostPort(s); err != nil {
+			errs = append(errs, fmt.Errorf("%s %q: %w", field, s, err))
+		}
+	}
+	if !oneOf(t.ProxyProtocol, "", "v1", "v2") {
+		errs = append(errs, fmt.Errorf("%s.proxy_protocol 只能是 v1 或 v2，当前为 %q", field, t.ProxyProtocol))
+	}
+	errs = append(errs, checkCIDRs(field+".allow_cidrs", t.AllowCIDRs)...)
+	errs = append(errs, checkCIDRs(field+".deny_cidrs", t.DenyCIDRs)...)
+	if t.TLS.Enabled() && !tcp {
+		errs = append(errs, fmt.Errorf("%s.tls: 只支持 TCP 转发", field))
+	}
+	for i, p := range t.TLS.Pairs() {
+		if p.Cert == "" || p.Key == "" {
+			errs = append(errs, fmt.Errorf("%s.tls: 第 %d 组证书的 cert 与 key 必须同时设置", field, i+1))
+		}
+	}
+	if acme := t.TLS.ACME; len(acme.Domain) > 0 {
+		if len(t.TLS.Pairs()) > 0 {
+			errs = append(errs, fmt.Errorf("%s.tls: acme 不能与 cert/certs 同时设置", field))
+		}
+		if a := acme.HTTPAddr; a != "" {
+			if _, err := splitPort(a); err != nil {
+				errs = append(errs, fmt.Errorf("%s.tls.acme.http_addr %q: %w", field, a, err))
+			}
+		}
+	}
+	return errs
+}
+
+// checkIPPort 要求 "IP:Port" 形式，IP 必须是字面地址
+func checkIPPort(a string) error {
+	host, err := splitPort(a)
+	if err != nil {
+		return err
+	}
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("无效的 IP %q", host)
+	}
+	return nil
+}
+
+// checkHostPort 要求 "host:port" 形式，host 可以是域名
+func checkHostPort(a string) error {
+	host, err := splitPort(a)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return errors.New("缺少主机")
+	}
+	return nil
+}
+
+// checkServer 接受 "host" 或 "host:port"
+func checkServer(s string) error {
+	if s == "" {
+		return errors.New("地址不能为空")
+	}
+	if IsServerURL(s) {
+		u, err := url.Parse(s)
+		if err != nil {
+			return err
+		}
+		if u.Host == "" {
+			return errors.New("URL 缺少主机")
+		}
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		// 没有端口：主机名、IPv4，或带/不带方括号的 IPv6
+		if strings.Contains(s, ":") && net.ParseIP(strings.Trim(s, "[]")) == nil {
+			return err
+		}
+		return nil
+	}
+	_, err := splitPort(s)
+	return err
+}
+
+// splitPort 拆分 host:port 并检查端口范围
+func splitPort(a string) (string, error) {
+	host, port, err := net.SplitHostPort(a)
+	if err != nil {
+		return "", err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return "", fmt.Errorf("端口 %q 无效，应为 1-65535", port)
+	}
+	return host, nil
+}
+
+// checkProxy 要求 "socks5://[user:pass@]host:port"（也接受 socks5h），域名均由代理解析
+func checkProxy(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if !oneOf(u.Scheme, "socks5", "socks5h") {
+		return fmt.Errorf("只支持 socks5 或 socks5h，当前为 %q", u.Scheme)
+	}
+	return checkHostPort(u.Host)
+}
+
+// checkCIDRs 检查 CIDR 或单个 IP 列表
+func checkCIDRs(field string, list []string) []error {
+	var errs []error
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if _, _, err := net.ParseCIDR(s); err == nil || net.ParseIP(s) != nil {
+			continue
+		}
+		errs = append(errs, fmt.Errorf("%s: 无效的 CIDR 或 IP %q", field, s))
+	}
+	return errs
+}
+
+func oneOf(s string, options ...string) bool {
+	for _, o := range options {
+		if s == o {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package forward
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ACL 是基于 CIDR 的来源地址访问控制。
+// 命中 Deny 的地址一律拒绝；Allow 非空时只放行命中 Allow 的地址。nil ACL 放行全部。
+type ACL struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+// ParseACL 解析 allow/deny CIDR 列表；单个 IP 视为 /32 或 /128。两者都为空时返回 nil。
+func ParseACL(allow, deny []string) (*ACL, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	a := &ACL{}
+	var err error
+	if a.Allow, err = parseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if a.Deny, err = parseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid CIDR %q", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", s, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Allowed 报告来源 ip 是否允许访问
+func (a *ACL) Allowed(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	for _, n := range a.Deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.Allow) == 0 {
+		return true
+	}
+	for _, n := range a.Allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP 提取 net.Addr 中的 IP
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
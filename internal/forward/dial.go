@@ -0,0 +1,100 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// DefaultFallbackDelay 是双栈目标先连首选地址族、再并行连另一地址族前的等待时间（与 net.Dialer 默认值相同）
+const DefaultFallbackDelay = 300 * time.Millisecond
+
+// dialHappyEyeballs 按 RFC 8305 的思路连接 addrs（首选地址族在前）：先连首选族，
+// 等待 delay 仍未连上（或已失败）时并行连另一族，返回最先连上的连接，另一路随即取消。
+// 同一族内的地址依次尝试；delay < 0 时不并行，按顺序逐个尝试全部地址
+func dialHappyEyeballs(ctx context.Context, d *net.Dialer, addrs []string, delay time.Duration) (net.Conn, error) {
+	primaries, fallbacks := splitFamilies(addrs)
+	if len(fallbacks) == 0 || delay < 0 {
+		return dialSerial(ctx, d, append(primaries, fallbacks...))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	results := make(chan result, 2)
+	race := func(addrs []string, primary bool) {
+		c, err := dialSerial(ctx, d, addrs)
+		results <- result{c, err, primary}
+	}
+	go race(primaries, true)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	var errs []error
+	pending, fallbackStarted := 1, false
+	for pending > 0 {
+		select {
+		case <-timer.C:
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if pending > 0 {
+					// 另一路可能稍后连上，收尾时关闭
+					go func() {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}()
+				}
+				return r.conn, nil
+			}
+			errs = append(errs, r.err)
+		}
+		if !fallbackStarted {
+			// 首选族失败或超过 delay：启动另一族
+			fallbackStarted = true
+			pending++
+			go race(fallbacks, false)
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// dialSerial 依次连接 addrs，返回第一个成功的连接
+func dialSerial(ctx context.Context, d *net.Dialer, addrs []string) (net.Conn, error) {
+	var errs []error
+	for _, addr := range addrs {
+		c, err := d.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			return c, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// splitFamilies 把 addrs 分成与第一个地址同族的首选组和另一族的备选组，组内保持原顺序
+func splitFamilies(addrs []string) (primaries, fallbacks []string) {
+	isV4 := func(addr string) bool {
+		host, _, _ := net.SplitHostPort(addr)
+		ip := net.ParseIP(host)
+		return ip == nil || ip.To4() != nil
+	}
+	first := isV4(addrs[0])
+	for _, addr := range addrs {
+		if isV4(addr) == first {
+			primaries = append(primaries, addr)
+		} else {
+			fallbacks = append(fallbacks, addr)
+		}
+	}
+	return primaries, fallbacks
+}
@@ -0,0 +1,45 @@
+package forward
+
+import (
+	"encoding/hex"
+
+	"go.uber.org/zap"
+)
+
+// dumpHex 在 debug 级别以十六进制记录 p 的前 limit 字节（len 为 p 的完整长度）；debug 未开启时不做编码
+func dumpHex(logger *zap.Logger, msg string, p []byte, limit int, fields ...zap.Field) {
+	ce := logger.Check(zap.DebugLevel, msg)
+	if ce == nil {
+		return
+	}
+	size := len(p)
+	if size > limit {
+		p = p[:limit]
+	}
+	ce.Write(append(fields, zap.Int("len", size), zap.String("hex", hex.EncodeToString(p)))...)
+}
+
+// streamDump 记录 TCP 连接某个方向最先流过的字节，记满 left 字节后不再记录；nil 表示关闭
+type streamDump struct {
+	logger *zap.Logger
+	dir    string // "client->target" 或 "target->client"
+	client string
+	left   int
+}
+
+func newStreamDump(logger *zap.Logger, limit int, dir, client string) *streamDump {
+	if limit <= 0 {
+		return nil
+	}
+	return &streamDump{logger: logger, dir: dir, client: client, left: limit}
+}
+
+// record 记录一次读到的数据，只在 copyIdle 的单个 goroutine 中调用
+func (d *streamDump) record(p []byte) {
+	if d == nil || d.left <= 0 {
+		return
+	}
+	n := min(len(p), d.left)
+	d.left -= n
+	dumpHex(d.logger, "TCP dump", p, n, zap.String("dir", d.dir), zap.String("client", d.client))
+}
@@ -0,0 +1,106 @@
+package forward
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DefaultHealthThreshold 是目标被标记为不可用前允许的连续探测失败次数
+const DefaultHealthThreshold = 3
+
+// healthProbeTimeout 是单次健康探测的超时
+const healthProbeTimeout = 3 * time.Second
+
+// HealthCheck 配置目标健康检查；Interval <= 0 时不做检查，所有目标视为可用。
+type HealthCheck struct {
+	Interval  time.Duration
+	Threshold int    // 连续失败多少次后标记为不可用，<= 0 时使用 DefaultHealthThreshold
+	HTTPPath  string // 非空时在 TCP 连接上发送 GET 请求，要求返回 2xx/3xx
+}
+
+// targetHealth 记录单个目标的探测状态
+type targetHealth struct {
+	failures atomic.Int32
+	down     atomic.Bool
+}
+
+// healthy 报告第 i 个目标当前是否可用
+func (f *TCPForwarder) healthy(i int) bool {
+	return !f.health[i].down.Load()
+}
+
+// healthLoop 周期性探测所有目标，直到 ctx 取消或转发器停止
+func (f *TCPForwarder) healthLoop(ctx context.Context) {
+	defer f.wg.Done()
+	threshold := f.HealthCheck.Threshold
+	if threshold <= 0 {
+		threshold = DefaultHealthThreshold
+	}
+	for {
+		for i, target := range f.targets {
+			h := &f.health[i]
+			if err := f.probe(ctx, target); err != nil {
+				if int(h.failures.Add(1)) >= threshold && !h.down.Swap(true) {
+					f.logger.Warn("TCP target marked unhealthy", zap.String("target", target), zap.Error(err))
+				}
+				continue
+			}
+			h.failures.Store(0)
+			if h.down.Swap(false) {
+				f.logger.Info("TCP target healthy again", zap.String("target", target))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-f.done:
+			return
+		case <-time.After(f.HealthCheck.Interval):
+		}
+	}
+}
+
+// probe 对目标做一次 TCP 连接探测，配置了 HTTPPath 时再检查 HTTP 状态码
+func (f *TCPForwarder) probe(ctx context.Context, target string) error {
+	ctx, cancel := context.WithTimeout(ctx, healthProbeTimeout)
+	defer cancel()
+	var d net.Dialer
+	network, addr := targetNetwork(target)
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if f.HealthCheck.HTTPPath == "" {
+		return nil
+	}
+
+	if dl, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(dl)
+	}
+	host := target
+	if network == "unix" {
+		host = "localhost"
+	}
+	req := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nUser-Agent: natter-health\r\nConnection: close\r\n\r\n", f.HealthCheck.HTTPPath, host)
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("health check returned %s", resp.Status)
+	}
+	return nil
+}
@@ -4,22 +4,55 @@ package forward
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"syscall"
 
 	"golang.org/x/sys/unix"
 )
 
-func listenWithReuse(ctx context.Context, addr string) (net.Listener, error) {
-	lc := net.ListenConfig{
-		Control: func(network, address string, c syscall.RawConn) error {
-			var err error
-			c.Control(func(fd uintptr) {
-				_ = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
-				_ = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
-			})
-			return err
-		},
+// reusePortSupported 表示本平台可以让多个 socket 绑定同一端口（SO_REUSEPORT）
+const reusePortSupported = true
+
+// unixSocketSupported 表示转发目标可以是 Unix 域套接字
+const unixSocketSupported = true
+
+// reuseControl 在 bind 之前开启 SO_REUSEADDR 与 SO_REUSEPORT
+func reuseControl(network, address string, c syscall.RawConn) error {
+	var err error
+	c.Control(func(fd uintptr) {
+		_ = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+		_ = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	return err
+}
+
+// setBufferSizes 设置 SO_SNDBUF/SO_RCVBUF，<= 0 的一项不设置
+func setBufferSizes(fd uintptr, sndbuf, rcvbuf int) error {
+	if sndbuf > 0 {
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF, sndbuf); err != nil {
+			return fmt.Errorf("set SO_SNDBUF: %w", err)
+		}
+	}
+	if rcvbuf > 0 {
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, rcvbuf); err != nil {
+			return fmt.Errorf("set SO_RCVBUF: %w", err)
+		}
 	}
+	return nil
+}
+
+func listenWithReuse(ctx context.Context, addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: reuseControl}
 	return lc.Listen(ctx, "tcp4", addr)
 }
+
+// listenUDPWithReuse 监听 UDP 并允许目标连接复用同一端口；sndbuf、rcvbuf > 0 时设置 socket 缓冲区大小
+func listenUDPWithReuse(ctx context.Context, addr string, sndbuf, rcvbuf int) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: bufferControl(reuseControl, sndbuf, rcvbuf)}
+	pc, err := lc.ListenPacket(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
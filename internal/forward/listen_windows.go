@@ -5,6 +5,7 @@ package forward
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"syscall"
 
@@ -13,18 +14,50 @@ import (
 
 const soExclusiveAddrUse = 0x0004 // WinSock 常量
 
-func listenWithReuse(ctx context.Context, addr string) (net.Listener, error) {
-	lc := net.ListenConfig{
-		Control: func(network, address string, c syscall.RawConn) error {
-			var err error
-			c.Control(func(fd uintptr) {
-				// 关闭排他占用，允许另一个 socket(主动连接)绑定同端口
-				_ = windows.SetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, soExclusiveAddrUse, 0)
-				// 开启 REUSEADDR（Windows 没有通用的 REUSEPORT 语义）
-				_ = windows.SetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, windows.SO_REUSEADDR, 1)
-			})
-			return err
-		},
+// reusePortSupported 表示本平台可以让多个 socket 绑定同一端口；Windows 的 SO_REUSEADDR 无法保证回包投递到哪个 socket
+const reusePortSupported = false
+
+// unixSocketSupported 表示转发目标可以是 Unix 域套接字；Windows 上不支持
+const unixSocketSupported = false
+
+// reuseControl 在 bind 之前关闭排他占用并开启 SO_REUSEADDR
+func reuseControl(network, address string, c syscall.RawConn) error {
+	var err error
+	c.Control(func(fd uintptr) {
+		// 关闭排他占用，允许另一个 socket(主动连接)绑定同端口
+		_ = windows.SetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, soExclusiveAddrUse, 0)
+		// 开启 REUSEADDR（Windows 没有通用的 REUSEPORT 语义）
+		_ = windows.SetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, windows.SO_REUSEADDR, 1)
+	})
+	return err
+}
+
+// setBufferSizes 设置 SO_SNDBUF/SO_RCVBUF，<= 0 的一项不设置
+func setBufferSizes(fd uintptr, sndbuf, rcvbuf int) error {
+	if sndbuf > 0 {
+		if err := windows.SetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, windows.SO_SNDBUF, sndbuf); err != nil {
+			return fmt.Errorf("set SO_SNDBUF: %w", err)
+		}
+	}
+	if rcvbuf > 0 {
+		if err := windows.SetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, windows.SO_RCVBUF, rcvbuf); err != nil {
+			return fmt.Errorf("set SO_RCVBUF: %w", err)
+		}
 	}
+	return nil
+}
+
+func listenWithReuse(ctx context.Context, addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: reuseControl}
 	return lc.Listen(ctx, "tcp4", addr)
 }
+
+// listenUDPWithReuse 监听 UDP 并允许目标连接复用同一端口；sndbuf、rcvbuf > 0 时设置 socket 缓冲区大小
+func listenUDPWithReuse(ctx context.Context, addr string, sndbuf, rcvbuf int) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: bufferControl(reuseControl, sndbuf, rcvbuf)}
+	pc, err := lc.ListenPacket(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
@@ -0,0 +1,92 @@
+package forward
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// PROXY protocol 版本，用于向目标传递真实客户端地址
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+// proxyV2Signature 是 PROXY protocol v2 的 12 字节固定前缀
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// writeProxyHeader 向 w 写入 PROXY protocol 头。
+// src 为客户端地址，dst 为客户端连接的本地地址；地址族不一致时 IPv4 转换为映射的 IPv6。
+func writeProxyHeader(w io.Writer, version string, src, dst net.Addr) error {
+	var hdr []byte
+	switch version {
+	case ProxyProtocolV1:
+		hdr = proxyV1Header(src, dst)
+	case ProxyProtocolV2:
+		hdr = proxyV2Header(src, dst)
+	default:
+		return fmt.Errorf("unknown PROXY protocol version %q", version)
+	}
+	_, err := w.Write(hdr)
+	return err
+}
+
+// proxyAddrs 提取 TCP 地址并统一地址族；返回的 ip 长度为 4 或 16，非 TCP 地址时 ok 为 false
+func proxyAddrs(src, dst net.Addr) (sip, dip net.IP, sport, dport int, ok bool) {
+	s, ok1 := src.(*net.TCPAddr)
+	d, ok2 := dst.(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return nil, nil, 0, 0, false
+	}
+	sip, dip = s.IP.To4(), d.IP.To4()
+	if sip == nil || dip == nil {
+		sip, dip = s.IP.To16(), d.IP.To16()
+	}
+	if sip == nil || dip == nil {
+		return nil, nil, 0, 0, false
+	}
+	return sip, dip, s.Port, d.Port, true
+}
+
+// proxyV1Header 构造文本格式头，如 "PROXY TCP4 1.2.3.4 10.0.0.1 5678 80\r\n"
+func proxyV1Header(src, dst net.Addr) []byte {
+	sip, dip, sport, dport, ok := proxyAddrs(src, dst)
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	if len(sip) == net.IPv4len {
+		return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", sip, dip, sport, dport))
+	}
+	return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", v6String(sip), v6String(dip), sport, dport))
+}
+
+// v6String 以 IPv6 文本格式输出地址，IPv4 映射地址写成 "::ffff:a.b.c.d"
+func v6String(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return "::ffff:" + v4.String()
+	}
+	return ip.String()
+}
+
+// proxyV2Header 构造二进制格式头（PROXY 命令，TCP over IPv4/IPv6）
+func proxyV2Header(src, dst net.Addr) []byte {
+	sip, dip, sport, dport, ok := proxyAddrs(src, dst)
+	hdr := append([]byte(nil), proxyV2Signature...)
+	if !ok {
+		// LOCAL 命令，无地址信息
+		return append(hdr, 0x20, 0x00, 0x00, 0x00)
+	}
+	fam := byte(0x11) // AF_INET + STREAM
+	if len(sip) == net.IPv6len {
+		fam = 0x21 // AF_INET6 + STREAM
+	}
+	addrLen := 2*len(sip) + 4
+	hdr = append(hdr, 0x21, fam)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(addrLen))
+	hdr = append(hdr, sip...)
+	hdr = append(hdr, dip...)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(sport))
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(dport))
+	return hdr
+}
@@ -0,0 +1,47 @@
+package forward
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket 是按字节计的令牌桶，容量为一秒的速率。
+// 允许令牌透支：一次取走的字节数超过余量时，调用方按欠额睡眠，
+// 因此任意大小的写入都不会永久阻塞。
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // 每秒字节数
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket 创建速率为 bytesPerSec 的令牌桶；bytesPerSec <= 0 时返回 nil（不限速）
+func newTokenBucket(bytesPerSec int64) *tokenBucket {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: float64(bytesPerSec), tokens: float64(bytesPerSec), last: time.Now()}
+}
+
+// wait 取走 n 个令牌，余量不足时睡眠到令牌补足为止；nil 桶直接返回
+func (b *tokenBucket) wait(n int) {
+	if b == nil || n <= 0 {
+		return
+	}
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	var d time.Duration
+	if b.tokens < 0 {
+		d = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,114 @@
+package forward
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// 转发目标的地址族偏好
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// Resolver 解析转发目标的主机名：按 TTL 缓存解析结果，并按 Family 优先选择 IPv4 或 IPv6 地址。
+// 拨号失败时调用 Forget，下一次拨号重新解析，目标换了地址也能很快跟上
+type Resolver struct {
+	TTL    time.Duration // 缓存时长，<= 0 表示每次都重新解析
+	Family string        // FamilyIPv4 / FamilyIPv6 优先使用该地址族（没有时退回另一族），留空按解析结果的顺序
+
+	mu    sync.Mutex
+	cache map[string]resolved // "host:port" -> 解析结果
+}
+
+type resolved struct {
+	addrs   []string // 按偏好排好序的 "IP:port"
+	expires time.Time
+}
+
+// NewResolver 创建目标解析器；ttl <= 0 且 family 为空时返回 nil，拨号时由系统解析（与之前的行为相同）
+func NewResolver(ttl time.Duration, family string) *Resolver {
+	if ttl <= 0 && family == "" {
+		return nil
+	}
+	return &Resolver{TTL: ttl, Family: family, cache: make(map[string]resolved)}
+}
+
+// Resolve 把 addr（"host:port"）中的主机名换成首选的 IP；r 为 nil 或主机已是 IP 时原样返回
+func (r *Resolver) Resolve(ctx context.Context, addr string) (string, error) {
+	addrs, err := r.ResolveAll(ctx, addr)
+	if err != nil {
+		return "", err
+	}
+	return addrs[0], nil
+}
+
+// ResolveAll 返回 addr 解析出的全部 "IP:port"，偏好的地址族在前；r 为 nil 或主机已是 IP 时只含 addr 本身
+func (r *Resolver) ResolveAll(ctx context.Context, addr string) ([]string, error) {
+	if r == nil {
+		return []string{addr}, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return []string{addr}, nil
+	}
+	now := time.Now()
+	r.mu.Lock()
+	c, ok := r.cache[addr]
+	r.mu.Unlock()
+	if ok && now.Before(c.expires) {
+		return c.addrs, nil
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no address for %s", host)
+	}
+	// 偏好的地址族排在前面，同族内保持解析顺序
+	slices.SortStableFunc(ips, func(a, b net.IPAddr) int { return r.rank(a.IP) - r.rank(b.IP) })
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip.IP.String(), port)
+	}
+	if r.TTL > 0 {
+		r.mu.Lock()
+		r.cache[addr] = resolved{addrs: addrs, expires: now.Add(r.TTL)}
+		r.mu.Unlock()
+	}
+	return addrs, nil
+}
+
+// Forget 丢弃 addr 的缓存，下次 Resolve 重新解析
+func (r *Resolver) Forget(addr string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	delete(r.cache, addr)
+	r.mu.Unlock()
+}
+
+// rank 返回 ip 的排序权重，偏好的地址族为 0
+func (r *Resolver) rank(ip net.IP) int {
+	v4 := ip.To4() != nil
+	switch r.Family {
+	case FamilyIPv4:
+		if v4 {
+			return 0
+		}
+		return 1
+	case FamilyIPv6:
+		if v4 {
+			return 1
+		}
+		return 0
+	}
+	return 0
+}
@@ -0,0 +1,23 @@
+package forward
+
+import "syscall"
+
+// bufferControl 包装 base（可为 nil）：在 bind 之前先执行 base，再按需设置 SO_SNDBUF/SO_RCVBUF；
+// sndbuf、rcvbuf <= 0 的一项保持系统默认。内核可能把设置值限制在系统上限内（Linux 为 net.core.wmem_max/rmem_max）
+func bufferControl(base func(network, address string, c syscall.RawConn) error, sndbuf, rcvbuf int) func(network, address string, c syscall.RawConn) error {
+	if sndbuf <= 0 && rcvbuf <= 0 {
+		return base
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		if base != nil {
+			if err := base(network, address, c); err != nil {
+				return err
+			}
+		}
+		var serr error
+		if err := c.Control(func(fd uintptr) { serr = setBufferSizes(fd, sndbuf, rcvbuf) }); err != nil {
+			return err
+		}
+		return serr
+	}
+}
@@ -0,0 +1,29 @@
+package forward
+
+import "sync/atomic"
+
+// Stats 是转发器的流量统计快照。
+// BytesIn 为客户端发往目标的字节数，BytesOut 为目标回给客户端的字节数。
+type Stats struct {
+	BytesIn     uint64
+	BytesOut    uint64
+	ActiveConns int64  // 当前 TCP 连接数或 UDP 会话数
+	TotalConns  uint64 // 启动以来接受的连接/会话总数
+}
+
+// counters 是转发器内部的原子计数器
+type counters struct {
+	in    atomic.Uint64
+	out   atomic.Uint64
+	total atomic.Uint64
+}
+
+// snapshot 读取当前计数
+func (c *counters) snapshot(active int64) Stats {
+	return Stats{
+		BytesIn:     c.in.Load(),
+		BytesOut:    c.out.Load(),
+		ActiveConns: active,
+		TotalConns:  c.total.Load(),
+	}
+}
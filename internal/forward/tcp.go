@@ -2,45 +2,143 @@ package forward
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"io"
+	"math/rand"
 	"net"
+	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.uber.org/zap"
 )
 
+// DefaultTCPIdleTimeout 是转发连接的默认空闲超时
+const DefaultTCPIdleTimeout = 10 * time.Minute
+
+// DefaultDialTimeout 是连接（含解析）转发目标的默认超时
+const DefaultDialTimeout = 5 * time.Second
+
+// tlsHandshakeTimeout 限制 TLS 终止时客户端完成握手的时间
+const tlsHandshakeTimeout = 10 * time.Second
+
+// 多目标时的负载均衡策略
+const (
+	BalanceRoundRobin = "round_robin"
+	BalanceRandom     = "random"
+)
+
 // TCPForwarder 将本地 ListenAddr 上的 TCP 连接转发到 TargetAddr。
+// TargetAddr 可以是逗号分隔的多个目标（"host:port" 或 "unix:/path"），每个新连接按 Balance 策略选择一个，
+// 拨号失败时依次尝试其余目标；启用 HealthCheck 后跳过被标记为不可用的目标。
 type TCPForwarder struct {
-	ListenAddr string
-	TargetAddr string
-	logger     *zap.Logger
+	ListenAddr  string
+	TargetAddr  string
+	Balance     string        // BalanceRoundRobin（默认）或 BalanceRandom
+	IdleTimeout time.Duration // 两个方向都没有数据超过该时长即断开，<= 0 表示不限制
+	MaxConns    int           // 同时转发的最大连接数，<= 0 表示不限制
+	HealthCheck HealthCheck
+	// ProxyProtocol 非空时（ProxyProtocolV1/ProxyProtocolV2）在转发前向目标发送 PROXY 头，携带真实客户端地址
+	ProxyProtocol string
+	// 限速（字节/秒），<= 0 表示不限制：RateLimitUp/RateLimitDown 为整个转发器共享，
+	// 分别作用于客户端->目标与目标->客户端；ConnRateLimit 作用于单个连接的每个方向
+	RateLimitUp   int64
+	RateLimitDown int64
+	ConnRateLimit int64
+	ACL           *ACL          // 来源地址访问控制，nil 表示不限制
+	TLS           *tls.Config   // 非 nil 时对客户端连接做 TLS 终止，解密后以明文转发给目标
+	DialTimeout   time.Duration // 单次拨号目标（含域名解析）的超时，<= 0 表示不限制
+	// DialRetries 为所有目标都拨号失败后的重试次数，两次尝试之间等待 DialRetryDelay（之后每次翻倍），
+	// 用于扛过后端短暂重启；0 表示不重试
+	DialRetries    int
+	DialRetryDelay time.Duration
+	// ChallengeAddr 非空时在该地址用 ChallengeHandler 提供 HTTP 服务（用于 ACME HTTP-01 验证），随转发器启停
+	ChallengeAddr    string
+	ChallengeHandler http.Handler
+	// DumpBytes > 0 时在 debug 日志中以十六进制记录每个连接每个方向的前 DumpBytes 字节，用于排查协议问题
+	DumpBytes int
+	// Audit 记录每个被接受的客户端（审计日志），默认丢弃
+	Audit *zap.Logger
+	// Resolver 非 nil 时由它解析目标主机名（缓存与地址族偏好），nil 时每次拨号由系统解析
+	Resolver *Resolver
+	// FallbackDelay 是目标同时有 IPv4 与 IPv6 地址时，先连首选族、再并行连另一族前的等待时间（Happy Eyeballs），
+	// 0 使用 DefaultFallbackDelay，< 0 关闭并行、按顺序逐个尝试
+	FallbackDelay time.Duration
+	logger        *zap.Logger
 
+	targets  []string
+	health   []targetHealth // 与 targets 一一对应
+	done     chan struct{}  // Stop 时关闭，通知后台探测退出
+	next     atomic.Uint64  // 轮询计数
 	listener net.Listener
 	wg       sync.WaitGroup
+	active   atomic.Int64 // 当前正在转发的连接数
+	stats    counters
+	up, down *tokenBucket // 转发器级限速，Start 时按配置创建
+
+	challenge *http.Server
+
+	connsMu sync.Mutex
+	conns   map[net.Conn]net.Conn // 客户端连接 -> 目标连接（拨号完成前为 nil），ForceClose 时全部关闭
 }
 
 // NewTCPForwarder 创建一个 TCP 转发器。
 func NewTCPForwarder(listenAddr, targetAddr string, logger *zap.Logger) *TCPForwarder {
+	targets := SplitTargets(targetAddr)
 	return &TCPForwarder{
-		ListenAddr: listenAddr,
-		TargetAddr: targetAddr,
-		logger:     logger,
+		ListenAddr:  listenAddr,
+		TargetAddr:  targetAddr,
+		IdleTimeout: DefaultTCPIdleTimeout,
+		DialTimeout: DefaultDialTimeout,
+		Audit:       zap.NewNop(),
+		logger:      logger,
+		targets:     targets,
+		health:      make([]targetHealth, len(targets)),
+		done:        make(chan struct{}),
+		conns:       make(map[net.Conn]net.Conn),
 	}
 }
 
 // Start 启动转发器，开始监听并接受连接。
 // ctx 用于优雅关闭。
 func (f *TCPForwarder) Start(ctx context.Context) error {
+	if err := checkUnixTargets(f.targets); err != nil {
+		f.logger.Error("invalid TCP target", zap.String("target", f.TargetAddr), zap.Error(err))
+		return err
+	}
 	ln, err := listenWithReuse(ctx, f.ListenAddr)
 	if err != nil {
 		f.logger.Error("cannot listen on TCP address", zap.String("addr", f.ListenAddr), zap.Error(err))
 		return err
 	}
 	f.listener = ln
+	f.up, f.down = newTokenBucket(f.RateLimitUp), newTokenBucket(f.RateLimitDown)
 	f.logger.Info("TCP forwarder listening", zap.String("listen", f.ListenAddr), zap.String("target", f.TargetAddr))
 
+	if f.ChallengeAddr != "" {
+		cl, err := listenWithReuse(ctx, f.ChallengeAddr)
+		if err != nil {
+			ln.Close()
+			f.logger.Error("cannot listen on ACME challenge address", zap.String("addr", f.ChallengeAddr), zap.Error(err))
+			return err
+		}
+		f.challenge = &http.Server{Handler: f.ChallengeHandler, ReadHeaderTimeout: 10 * time.Second}
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			_ = f.challenge.Serve(cl)
+		}()
+	}
+
 	f.wg.Add(1)
 	go f.acceptLoop(ctx)
+	if f.HealthCheck.Interval > 0 {
+		f.wg.Add(1)
+		go f.healthLoop(ctx)
+	}
 	return nil
 }
 
@@ -60,11 +158,29 @@ func (f *TCPForwarder) acceptLoop(ctx context.Context) {
 			f.logger.Debug("TCP accept error", zap.Error(err))
 			return
 		}
+		if !f.ACL.Allowed(addrIP(clientConn.RemoteAddr())) {
+			f.logger.Debug("TCP client denied by ACL", zap.String("client", clientConn.RemoteAddr().String()))
+			clientConn.Close()
+			continue
+		}
+		if n := f.active.Add(1); f.MaxConns > 0 && n > int64(f.MaxConns) {
+			f.active.Add(-1)
+			f.logger.Warn("TCP connection limit reached, rejecting client",
+				zap.String("listen", f.ListenAddr), zap.String("client", clientConn.RemoteAddr().String()), zap.Int("max_conns", f.MaxConns))
+			clientConn.Close()
+			continue
+		}
+		f.stats.total.Add(1)
 		f.logger.Debug("Accepted TCP client", zap.String("client", clientConn.RemoteAddr().String()))
+		f.Audit.Info("client_accepted", zap.String("protocol", "tcp"), zap.String("client", clientConn.RemoteAddr().String()),
+			zap.String("listen", f.ListenAddr), zap.String("target", f.TargetAddr))
 
+		f.track(clientConn, nil)
 		f.wg.Add(1)
 		go func(src net.Conn) {
 			defer f.wg.Done()
+			defer f.active.Add(-1)
+			defer f.untrack(src)
 			f.handleConnection(src)
 		}(clientConn)
 	}
@@ -73,34 +189,261 @@ func (f *TCPForwarder) acceptLoop(ctx context.Context) {
 // handleConnection 建立到目标的连接并开始双向转发。
 func (f *TCPForwarder) handleConnection(src net.Conn) {
 	defer src.Close()
+	raw := src // ForceClose 按原始连接登记
+	if f.TLS != nil {
+		// 先完成握手，握手失败的客户端不会占用到目标的连接
+		tc := tls.Server(src, f.TLS)
+		ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+		err := tc.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			f.logger.Debug("TLS handshake failed", zap.String("client", src.RemoteAddr().String()), zap.Error(err))
+			return
+		}
+		src = tc
+	}
 	// 链接目标
-	dst, err := net.Dial("tcp", f.TargetAddr)
+	dst, target, err := f.dialTarget()
 	if err != nil {
 		f.logger.Warn("TCP dial to target failed", zap.String("target", f.TargetAddr), zap.Error(err))
 		return
 	}
 	defer dst.Close()
+	f.track(raw, dst)
+
+	if f.ProxyProtocol != "" {
+		if err := writeProxyHeader(dst, f.ProxyProtocol, src.RemoteAddr(), src.LocalAddr()); err != nil {
+			f.logger.Warn("TCP write PROXY header failed", zap.String("target", target), zap.Error(err))
+			return
+		}
+	}
 
 	// 双向拷贝
-	f.logger.Debug("Forwarding TCP data", zap.String("from", src.RemoteAddr().String()), zap.String("to", f.TargetAddr))
+	f.logger.Debug("Forwarding TCP data", zap.String("from", src.RemoteAddr().String()), zap.String("to", target))
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
 	var p sync.WaitGroup
 	p.Add(2)
-	go func() {
-		io.Copy(dst, src)
-		p.Done()
-	}()
-	go func() {
-		io.Copy(src, dst)
-		p.Done()
-	}()
+	client := src.RemoteAddr().String()
+	pipe := func(dst, src net.Conn, counter *atomic.Uint64, dump *streamDump, limits ...*tokenBucket) {
+		defer p.Done()
+		if err := f.copyIdle(dst, src, &lastActive, counter, dump, limits); err != nil {
+			// 出错或空闲超时：拆除整条连接，另一方向的 Read 随之返回
+			src.Close()
+			dst.Close()
+			return
+		}
+		// src 正常关闭写端：只向 dst 转发半关闭，另一方向继续传输
+		closeWrite(dst)
+	}
+	go pipe(dst, src, &f.stats.in, newStreamDump(f.logger, f.DumpBytes, "client->target", client),
+		f.up, newTokenBucket(f.ConnRateLimit))
+	go pipe(src, dst, &f.stats.out, newStreamDump(f.logger, f.DumpBytes, "target->client", client),
+		f.down, newTokenBucket(f.ConnRateLimit))
 	p.Wait()
 }
 
-// Stop 优雅关闭转发器，等待所有连接处理完成。
-func (f *TCPForwarder) Stop() {
+// dialTarget 拨号目标；所有目标都失败时按 DialRetries/DialRetryDelay 退避重试，Stop 时提前放弃。
+func (f *TCPForwarder) dialTarget() (net.Conn, string, error) {
+	delay := f.DialRetryDelay
+	for attempt := 0; ; attempt++ {
+		c, target, err := f.dialOnce()
+		if err == nil || attempt >= f.DialRetries || delay <= 0 {
+			return c, target, err
+		}
+		f.logger.Debug("TCP targets unavailable, retrying", zap.String("target", f.TargetAddr),
+			zap.Int("attempt", attempt+1), zap.Duration("delay", delay), zap.Error(err))
+		select {
+		case <-f.done:
+			return nil, "", err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// dialOnce 按负载均衡策略选择起始目标，失败时依次尝试其余目标。
+// 健康目标优先；全部不可用时仍按顺序尝试，避免探测误判导致端口完全不可用。
+func (f *TCPForwarder) dialOnce() (net.Conn, string, error) {
+	if len(f.targets) == 0 {
+		return nil, "", errors.New("no target address")
+	}
+	var start int
+	if f.Balance == BalanceRandom {
+		start = rand.Intn(len(f.targets))
+	} else {
+		start = int((f.next.Add(1) - 1) % uint64(len(f.targets)))
+	}
+	order := make([]int, 0, len(f.targets))
+	var down []int
+	for i := range f.targets {
+		idx := (start + i) % len(f.targets)
+		if f.healthy(idx) {
+			order = append(order, idx)
+		} else {
+			down = append(down, idx)
+		}
+	}
+	if len(order) == 0 {
+		order = down
+	}
+
+	var errs []error
+	for _, idx := range order {
+		target := f.targets[idx]
+		network, addr := targetNetwork(target)
+		c, err := f.dialAddr(network, addr)
+		if err == nil {
+			return c, target, nil
+		}
+		f.logger.Debug("TCP target unavailable, trying next", zap.String("target", target), zap.Error(err))
+		errs = append(errs, err)
+	}
+	return nil, "", errors.Join(errs...)
+}
+
+// dialAddr 解析并拨号单个目标，双栈目标按 Happy Eyeballs 并行连接；拨号失败时丢弃解析缓存，下次重新解析
+func (f *TCPForwarder) dialAddr(network, addr string) (net.Conn, error) {
+	d := net.Dialer{Timeout: f.DialTimeout, FallbackDelay: f.FallbackDelay}
+	if network != "tcp" || f.Resolver == nil {
+		// net.Dialer 自己解析，双栈时同样并行连接
+		return d.Dial(network, addr)
+	}
+	ctx := context.Background()
+	if f.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.DialTimeout)
+		defer cancel()
+	}
+	addrs, err := f.Resolver.ResolveAll(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	delay := f.FallbackDelay
+	if delay == 0 {
+		delay = DefaultFallbackDelay
+	}
+	c, err := dialHappyEyeballs(ctx, &d, addrs, delay)
+	if err != nil {
+		f.Resolver.Forget(addr)
+	}
+	return c, err
+}
+
+// SplitTargets 将逗号分隔的目标列表拆分为地址切片，忽略空项
+func SplitTargets(s string) []string {
+	var out []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// closeWrite 关闭连接的写方向；不支持半关闭的连接直接关闭
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+		return
+	}
+	c.Close()
+}
+
+// copyIdle 从 src 拷贝到 dst，直到出错、EOF 或空闲超时；EOF 时返回 nil。
+// 读取使用截止时间；超时后若另一方向在此期间有数据，则继续等待。
+// lastActive 由两个方向共享，记录最近一次收到数据的时间（UnixNano）；
+// 成功写出的字节数累加到 counter；读到的数据交给 dump 记录（nil 时跳过）；写出前依次从 limits 中的令牌桶取令牌。
+func (f *TCPForwarder) copyIdle(dst, src net.Conn, lastActive *atomic.Int64, counter *atomic.Uint64, dump *streamDump, limits []*tokenBucket) error {
+	buf := make([]byte, 32*1024)
+	for {
+		if f.IdleTimeout > 0 {
+			_ = src.SetReadDeadline(time.Now().Add(f.IdleTimeout))
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			lastActive.Store(time.Now().UnixNano())
+			dump.record(buf[:n])
+			for _, b := range limits {
+				b.wait(n)
+			}
+			w, werr := dst.Write(buf[:n])
+			counter.Add(uint64(w))
+			if werr != nil {
+				return werr
+			}
+		}
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				idle := time.Since(time.Unix(0, lastActive.Load()))
+				if idle < f.IdleTimeout {
+					continue
+				}
+				f.logger.Debug("TCP forward idle timeout", zap.String("from", src.RemoteAddr().String()), zap.Duration("idle", idle))
+			}
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// Stats 返回转发器的流量统计
+func (f *TCPForwarder) Stats() Stats {
+	return f.stats.snapshot(f.active.Load())
+}
+
+// track 记录正在转发的连接，供 ForceClose 使用
+func (f *TCPForwarder) track(src, dst net.Conn) {
+	f.connsMu.Lock()
+	f.conns[src] = dst
+	f.connsMu.Unlock()
+}
+
+func (f *TCPForwarder) untrack(src net.Conn) {
+	f.connsMu.Lock()
+	delete(f.conns, src)
+	f.connsMu.Unlock()
+}
+
+// ForceClose 关闭监听器和所有正在转发的连接，让阻塞在 Stop 中的等待尽快返回；
+// 返回被强制关闭的客户端连接数
+func (f *TCPForwarder) ForceClose() int {
 	if f.listener != nil {
 		f.listener.Close()
 	}
+	f.connsMu.Lock()
+	defer f.connsMu.Unlock()
+	for src, dst := range f.conns {
+		src.Close()
+		if dst != nil {
+			dst.Close()
+		}
+	}
+	return len(f.conns)
+}
+
+// StopAccepting 关闭监听端口，不再接受新连接，立即返回；已建立的连接继续转发，
+// 之后仍需调用 Stop（或 ForceClose 后 Stop）等待它们结束。可重复调用
+func (f *TCPForwarder) StopAccepting() {
+	select {
+	case <-f.done:
+	default:
+		close(f.done)
+	}
+	if f.listener != nil {
+		f.listener.Close()
+	}
+	if f.challenge != nil {
+		f.challenge.Close()
+	}
+}
+
+// Stop 优雅关闭转发器，等待所有连接处理完成。
+func (f *TCPForwarder) Stop() {
+	f.StopAccepting()
 	f.wg.Wait()
 	f.logger.Info("TCP forwarder stopped", zap.String("listen", f.ListenAddr))
 }
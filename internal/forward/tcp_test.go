@@ -0,0 +1,103 @@
+package forward
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// nameBackend 监听一个回环端口，向每个连接写入 name 后关闭，返回其地址
+func nameBackend(t *testing.T, name string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte(name))
+			c.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// closedAddr 返回一个当前没有监听者的回环地址
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// startTCP 启动转发到 targets 的转发器，返回其监听地址
+func startTCP(t *testing.T, targets, balance string) string {
+	t.Helper()
+	f := NewTCPForwarder("127.0.0.1:0", targets, zap.NewNop())
+	f.Balance = balance
+	if err := f.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(f.Stop)
+	return f.listener.Addr().String()
+}
+
+// fetch 经转发器建立一个连接，返回后端写入的名字
+func fetch(t *testing.T, addr string) string {
+	t.Helper()
+	c, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	b, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestTCPBalanceRoundRobin(t *testing.T) {
+	addr := startTCP(t, nameBackend(t, "a")+","+nameBackend(t, "b"), BalanceRoundRobin)
+	var got string
+	for i := 0; i < 4; i++ {
+		got += fetch(t, addr)
+	}
+	if got != "abab" {
+		t.Fatalf("round robin served %q, want %q", got, "abab")
+	}
+}
+
+func TestTCPBalanceRandomUsesBothTargets(t *testing.T) {
+	addr := startTCP(t, nameBackend(t, "a")+","+nameBackend(t, "b"), BalanceRandom)
+	seen := map[string]int{}
+	for i := 0; i < 40; i++ {
+		seen[fetch(t, addr)]++
+	}
+	if len(seen) != 2 || seen["a"] == 0 || seen["b"] == 0 {
+		t.Fatalf("random balance served %v, want both a and b", seen)
+	}
+}
+
+func TestTCPBalanceSkipsUnreachableTarget(t *testing.T) {
+	addr := startTCP(t, closedAddr(t)+","+nameBackend(t, "b"), BalanceRoundRobin)
+	for i := 0; i < 4; i++ {
+		if got := fetch(t, addr); got != "b" {
+			t.Fatalf("connection %d served %q, want %q from the reachable target", i, got, "b")
+		}
+	}
+}
@@ -2,149 +2,397 @@ package forward
 
 import (
 	"context"
+	"errors"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"natter/internal/clock"
+
 	"go.uber.org/zap"
 )
 
+// DefaultUDPBufferSize 是默认的数据报缓冲区大小，足以容纳最大的 UDP 负载
+const DefaultUDPBufferSize = 64 * 1024
+
+// 发往目标的源端口策略，见 UDPForwarder.SourcePort
+const (
+	SourcePortClient = "client" // 使用客户端的源端口
+	SourcePortListen = "listen" // 复用转发器的监听端口，只保留一个客户端会话
+)
+
 // UDPForwarder 将本地 ListenAddr 上的 UDP 包转发到 TargetAddr。
 // 为每个客户端地址维护一个到服务器的 UDP 连接，并反向转发响应。
 type UDPForwarder struct {
-	ListenAddr string
-	TargetAddr string
-	Timeout    time.Duration
-	logger     *zap.Logger
+	ListenAddr  string
+	TargetAddr  string
+	Timeout     time.Duration // 会话两个方向都无数据超过该时长即关闭，<= 0 表示不因空闲关闭
+	DialTimeout time.Duration // 为新会话解析并连接目标的超时，<= 0 表示不限制
+	BufferSize  int           // 单个数据报的读缓冲区大小，超出部分会被截断
+	ACL         *ACL          // 来源地址访问控制，nil 表示不限制
+	IdleTTL     time.Duration // 会话两个方向都无数据超过该时长即被清理，<= 0 表示不做周期清理
+	MaxClients  int           // 同时保持的客户端会话上限，超出时淘汰最久未活动的会话，<= 0 表示不限制
+	logger      *zap.Logger
+
+	// SourcePort 决定连接目标时绑定的本地端口：为空时由系统分配随机端口；
+	// SourcePortClient 绑定与客户端相同的端口，该端口已被另一会话或本机其他程序占用时退回随机端口；
+	// SourcePortListen 绑定监听端口，所有流量共用一个 5 元组，因此新客户端会顶替旧会话。
+	// 后两者依赖 SO_REUSEPORT，Windows 上不支持 SourcePortListen
+	SourcePort string
+
+	// DumpBytes > 0 时在 debug 日志中以十六进制记录每个数据报（两个方向）的前 DumpBytes 字节
+	DumpBytes int
+	// Audit 记录每个新建的客户端会话（审计日志），默认丢弃
+	Audit *zap.Logger
+
+	// 监听 socket 与每个会话连接目标的 socket 的 SO_SNDBUF/SO_RCVBUF 字节数，<= 0 保持系统默认；
+	// 高码率 UDP 流突发时默认缓冲区容易丢包
+	SendBuffer int
+	RecvBuffer int
+
+	// Resolver 非 nil 时由它解析目标主机名（缓存与地址族偏好），nil 时每个新会话由系统解析
+	Resolver *Resolver
+
+	// Clock 驱动空闲会话清理（IdleTTL），测试中可替换为 clock.Fake
+	Clock clock.Clock
+
+	// Intercept 非 nil 时，监听 socket 收到的每个数据报先交给它，返回 true 表示已被消费、不再转发；
+	// 用于在监听 socket 上发起 STUN 查询时取回响应
+	Intercept func(b []byte) bool
 
 	conn      *net.UDPConn
-	clients   map[string]*net.UDPConn
+	clients   map[string]*udpSession
 	clientsMu sync.Mutex
+	done      chan struct{} // Stop 时关闭，通知清理协程退出
 	wg        sync.WaitGroup
+	stats     counters
+	bufPool   sync.Pool // *[]byte，长度为 BufferSize，每次读写数据报时借用，用完即归还
 }
 
 // NewUDPForwarder 创建一个 UDP 转发器。
-// listenAddr, targetAddr: 格式 "host:port"；timeout：可选读写超时时间；logger：用于日志输出。
-func NewUDPForwarder(listenAddr, targetAddr string, timeout time.Duration, logger *zap.Logger) *UDPForwarder {
+// listenAddr, targetAddr: 格式 "host:port"；timeout：会话空闲超时，<= 0 表示不因空闲关闭；
+// bufferSize：数据报缓冲区大小，<= 0 时使用 DefaultUDPBufferSize；logger：用于日志输出。
+func NewUDPForwarder(listenAddr, targetAddr string, timeout time.Duration, bufferSize int, logger *zap.Logger) *UDPForwarder {
+	if bufferSize <= 0 {
+		bufferSize = DefaultUDPBufferSize
+	}
 	return &UDPForwarder{
-		ListenAddr: listenAddr,
-		TargetAddr: targetAddr,
-		Timeout:    timeout,
-		logger:     logger,
-		clients:    make(map[string]*net.UDPConn),
+		ListenAddr:  listenAddr,
+		TargetAddr:  targetAddr,
+		Timeout:     timeout,
+		DialTimeout: DefaultDialTimeout,
+		BufferSize:  bufferSize,
+		Audit:       zap.NewNop(),
+		Clock:       clock.New(),
+		logger:      logger,
+		clients:     make(map[string]*udpSession),
+		done:        make(chan struct{}),
 	}
 }
 
+// udpSession 是单个客户端到目标的会话
+type udpSession struct {
+	conn       *net.UDPConn
+	lastActive atomic.Int64 // 最近一次任一方向有数据的时间（UnixNano）
+}
+
+func (s *udpSession) touch() { s.lastActive.Store(time.Now().UnixNano()) }
+
+func (s *udpSession) idle(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, s.lastActive.Load()))
+}
+
 // Start 启动 UDP 转发器，监听本地端口并开始处理。
 func (f *UDPForwarder) Start(ctx context.Context) error {
-	laddr, err := net.ResolveUDPAddr("udp", f.ListenAddr)
-	if err != nil {
-		f.logger.Error("resolve listen address failed", zap.String("addr", f.ListenAddr), zap.Error(err))
-		return err
+	if f.SourcePort == SourcePortListen && !reusePortSupported {
+		return errors.New("UDP source port \"listen\" needs SO_REUSEPORT, which this platform lacks")
 	}
-	f.conn, err = net.ListenUDP("udp", laddr)
+	// 开启端口复用：STUN 查询要从同一端口发出，SourcePort 非空时目标连接也要共用该端口
+	var err error
+	f.conn, err = listenUDPWithReuse(ctx, f.ListenAddr, f.SendBuffer, f.RecvBuffer)
 	if err != nil {
 		f.logger.Error("listen UDP failed", zap.String("addr", f.ListenAddr), zap.Error(err))
 		return err
 	}
+	size := f.BufferSize
+	f.bufPool.New = func() any {
+		b := make([]byte, size)
+		return &b
+	}
 	f.logger.Info("UDP forwarder listening", zap.String("listen", f.ListenAddr), zap.String("target", f.TargetAddr))
 
 	f.wg.Add(1)
 	go f.acceptLoop(ctx)
+	if f.IdleTTL > 0 {
+		f.wg.Add(1)
+		go f.sweepLoop(ctx)
+	}
 	return nil
 }
 
 // acceptLoop 接收客户端数据并转发到目标服务器。
 func (f *UDPForwarder) acceptLoop(ctx context.Context) {
 	defer f.wg.Done()
-	buf := make([]byte, 2048)
-
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		default:
 		}
+		if !f.forwardClient() {
+			return
+		}
+	}
+}
 
-		n, clientAddr, err := f.conn.ReadFromUDP(buf)
+// forwardClient 读取一个客户端数据报并写给对应会话的目标，缓冲区只在这次读写期间从池中借用；
+// 监听 socket 被 Stop 关闭时返回 false
+func (f *UDPForwarder) forwardClient() bool {
+	bp := f.bufPool.Get().(*[]byte)
+	defer f.bufPool.Put(bp)
+	buf := *bp
+
+	n, clientAddr, err := f.conn.ReadFromUDP(buf)
+	if err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			// Stop 关闭了监听 socket
+			return false
+		}
+		f.logger.Debug("UDP read error", zap.Error(err))
+		return true
+	}
+
+	if f.Intercept != nil && f.Intercept(buf[:n]) {
+		return true
+	}
+
+	if !f.ACL.Allowed(clientAddr.IP) {
+		f.logger.Debug("UDP packet denied by ACL", zap.String("client", clientAddr.String()))
+		return true
+	}
+
+	key := clientAddr.String()
+
+	// 获取或创建客户端->服务器的连接
+	f.clientsMu.Lock()
+	sess, ok := f.clients[key]
+	if !ok {
+		if (f.MaxClients > 0 && len(f.clients) >= f.MaxClients) ||
+			(f.SourcePort == SourcePortListen && len(f.clients) > 0) {
+			f.evictOldestLocked()
+		}
+		srvConn, err := f.dialTarget(clientAddr)
 		if err != nil {
-			f.logger.Debug("UDP read error", zap.Error(err))
-			continue
+			f.logger.Warn("dial target UDP failed", zap.String("target", f.TargetAddr), zap.Error(err))
+			f.clientsMu.Unlock()
+			return true
 		}
+		sess = &udpSession{conn: srvConn}
+		sess.touch()
 
-		key := clientAddr.String()
-
-		// 获取或创建客户端->服务器的连接
-		f.clientsMu.Lock()
-		srvConn, ok := f.clients[key]
-		if !ok {
-			// 建立到 TargetAddr 的 UDP 连接
-			raddr, err := net.ResolveUDPAddr("udp", f.TargetAddr)
-			if err != nil {
-				f.logger.Warn("resolve target address failed", zap.String("target", f.TargetAddr), zap.Error(err))
-				f.clientsMu.Unlock()
-				continue
-			}
+		// 启动反向转发协程
+		f.wg.Add(1)
+		go f.handleServerResponse(clientAddr, sess)
 
-			srvConn, err = net.DialUDP("udp", nil, raddr)
-			if err != nil {
-				f.logger.Warn("dial target UDP failed", zap.String("target", f.TargetAddr), zap.Error(err))
-				f.clientsMu.Unlock()
-				continue
-			}
+		f.clients[key] = sess
+		f.stats.total.Add(1)
+		f.Audit.Info("client_accepted", zap.String("protocol", "udp"), zap.String("client", key),
+			zap.String("listen", f.ListenAddr), zap.String("target", f.TargetAddr))
+	}
+	f.clientsMu.Unlock()
+
+	// 写数据到目标服务器
+	if f.DumpBytes > 0 {
+		dumpHex(f.logger, "UDP dump", buf[:n], f.DumpBytes, zap.String("dir", "client->target"), zap.String("client", key))
+	}
+	sess.touch()
+	if w, err := sess.conn.Write(buf[:n]); err != nil {
+		f.logger.Debug("write to server failed", zap.Error(err))
+	} else {
+		f.stats.in.Add(uint64(w))
+	}
+	return true
+}
 
-			// 启动反向转发协程
-			f.wg.Add(1)
-			go f.handleServerResponse(clientAddr, srvConn)
+// dialTarget 为 client 建立到 TargetAddr 的 UDP 连接，按 SourcePort 绑定本地端口，
+// 解析域名受 DialTimeout 限制；调用方需持有 clientsMu
+func (f *UDPForwarder) dialTarget(client *net.UDPAddr) (*net.UDPConn, error) {
+	d := net.Dialer{Timeout: f.DialTimeout}
+	switch f.SourcePort {
+	case SourcePortClient:
+		if f.localPortInUseLocked(client.Port) {
+			// 同一目标上两个会话不能共用 5 元组
+			f.logger.Debug("UDP source port taken by another session, using a random port", zap.Int("port", client.Port))
+			break
+		}
+		// 与监听 socket 同一 IP，监听通配地址时也绑定通配地址
+		d.LocalAddr = &net.UDPAddr{IP: f.conn.LocalAddr().(*net.UDPAddr).IP, Port: client.Port}
+		d.Control = reuseControl
+	case SourcePortListen:
+		d.LocalAddr = f.conn.LocalAddr()
+		d.Control = reuseControl
+	}
+	d.Control = bufferControl(d.Control, f.SendBuffer, f.RecvBuffer)
+	ctx := context.Background()
+	if f.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.DialTimeout)
+		defer cancel()
+	}
+	target, err := f.Resolver.Resolve(ctx, f.TargetAddr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := d.DialContext(ctx, "udp", target)
+	if err != nil && f.SourcePort == SourcePortClient && d.LocalAddr != nil {
+		// 端口被本机其他程序占用（如客户端就在本机）
+		f.logger.Debug("UDP source port unavailable, using a random port", zap.Int("port", client.Port), zap.Error(err))
+		d.LocalAddr, d.Control = nil, bufferControl(nil, f.SendBuffer, f.RecvBuffer)
+		c, err = d.DialContext(ctx, "udp", target)
+	}
+	if err != nil {
+		f.Resolver.Forget(f.TargetAddr)
+		return nil, err
+	}
+	return c.(*net.UDPConn), nil
+}
 
-			f.clients[key] = srvConn
+// localPortInUseLocked 报告是否已有会话从本地端口 port 连接目标；调用方需持有 clientsMu
+func (f *UDPForwarder) localPortInUseLocked(port int) bool {
+	for _, s := range f.clients {
+		if s.conn.LocalAddr().(*net.UDPAddr).Port == port {
+			return true
 		}
-		f.clientsMu.Unlock()
+	}
+	return false
+}
 
-		// 写数据到目标服务器
-		if _, err := srvConn.Write(buf[:n]); err != nil {
-			f.logger.Debug("write to server failed", zap.Error(err))
+// evictOldestLocked 淘汰最久未活动的会话；调用方需持有 clientsMu
+func (f *UDPForwarder) evictOldestLocked() {
+	var oldestKey string
+	var oldest *udpSession
+	for k, s := range f.clients {
+		if oldest == nil || s.lastActive.Load() < oldest.lastActive.Load() {
+			oldestKey, oldest = k, s
+		}
+	}
+	if oldest == nil {
+		return
+	}
+	f.logger.Debug("UDP client limit reached, evicting least recently used", zap.String("client", oldestKey))
+	delete(f.clients, oldestKey)
+	oldest.conn.Close()
+}
+
+// sweepLoop 周期性清理空闲超过 IdleTTL 的会话
+func (f *UDPForwarder) sweepLoop(ctx context.Context) {
+	defer f.wg.Done()
+	every := f.IdleTTL / 2
+	if every < time.Second {
+		every = time.Second
+	}
+	ticker := f.Clock.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-f.done:
+			return
+		case now := <-ticker.C():
+			f.clientsMu.Lock()
+			for k, s := range f.clients {
+				if s.idle(now) > f.IdleTTL {
+					f.logger.Debug("UDP client idle, evicting", zap.String("client", k))
+					delete(f.clients, k)
+					s.conn.Close()
+				}
+			}
+			f.clientsMu.Unlock()
 		}
 	}
 }
 
 // handleServerResponse 读取服务器响应并转发回客户端。
-func (f *UDPForwarder) handleServerResponse(clientAddr *net.UDPAddr, srvConn *net.UDPConn) {
+// 缓冲区只在收到数据报到写回客户端期间从池中借用，空闲会话不占用缓冲区（见 readPooled）
+func (f *UDPForwarder) handleServerResponse(clientAddr *net.UDPAddr, sess *udpSession) {
 	defer f.wg.Done()
-	buf := make([]byte, 2048)
 
+	srvConn := sess.conn
 	for {
-		srvConn.SetReadDeadline(time.Now().Add(f.Timeout))
-		n, err := srvConn.Read(buf)
+		if f.Timeout > 0 {
+			// 截止时间从最近一次任一方向的活动算起，客户端持续发包时会话不会因目标暂时无回包而关闭
+			last := time.Unix(0, sess.lastActive.Load())
+			srvConn.SetReadDeadline(last.Add(f.Timeout))
+		}
+		bp, n, err := f.readPooled(srvConn)
 		if err != nil {
-			// 超时或连接关闭后清理
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() && sess.idle(time.Now()) < f.Timeout {
+				// 等待期间客户端有新数据，顺延截止时间
+				continue
+			}
+			// 空闲超时或连接关闭后清理
 			f.logger.Debug("server UDP read closed", zap.Error(err))
 			break
 		}
 
 		// 将数据写回客户端
-		if _, err := f.conn.WriteToUDP(buf[:n], clientAddr); err != nil {
+		buf := (*bp)[:n]
+		if f.DumpBytes > 0 {
+			dumpHex(f.logger, "UDP dump", buf, f.DumpBytes, zap.String("dir", "target->client"), zap.String("client", clientAddr.String()))
+		}
+		sess.touch()
+		if w, err := f.conn.WriteToUDP(buf, clientAddr); err != nil {
 			f.logger.Debug("write back to client failed", zap.Error(err))
+		} else {
+			f.stats.out.Add(uint64(w))
 		}
+		f.bufPool.Put(bp)
 	}
 
-	// 清理
+	// 清理；会话可能已被淘汰，且同一客户端可能已建立新会话，只删除自己
 	key := clientAddr.String()
 	f.clientsMu.Lock()
 	srvConn.Close()
-	delete(f.clients, key)
+	if f.clients[key] == sess {
+		delete(f.clients, key)
+	}
+	f.clientsMu.Unlock()
+}
+
+// PacketConn 返回转发器的监听 socket，未启动时返回 nil。
+// 保活可复用它从同一端口发包；目标主机若有回包，会像普通客户端数据一样被转发。
+func (f *UDPForwarder) PacketConn() net.PacketConn {
+	if f.conn == nil {
+		return nil
+	}
+	return f.conn
+}
+
+// Stats 返回转发器的流量统计，ActiveConns 为当前客户端会话数
+func (f *UDPForwarder) Stats() Stats {
+	f.clientsMu.Lock()
+	active := int64(len(f.clients))
 	f.clientsMu.Unlock()
+	return f.stats.snapshot(active)
 }
 
 // Stop 优雅关闭 UDP 转发器，等待所有 goroutine 退出。
 func (f *UDPForwarder) Stop() {
+	select {
+	case <-f.done:
+	default:
+		close(f.done)
+	}
 	if f.conn != nil {
 		f.conn.Close()
 	}
 	// 关闭所有客户端连接
 	f.clientsMu.Lock()
-	for _, c := range f.clients {
-		c.Close()
+	for _, s := range f.clients {
+		s.conn.Close()
 	}
 	f.clientsMu.Unlock()
 
@@ -0,0 +1,50 @@
+//go:build linux || darwin
+
+package forward
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// readPooled 从已连接的 c 读取一个数据报，返回从 bufPool 借用的缓冲区与长度，调用方用完后须归还；
+// 出错时不返回缓冲区。等待数据期间不持有缓冲区：socket 可读后才借用并读取，
+// 因此大量空闲会话不会各占一块 BufferSize 大小的内存。遵守 c 的读截止时间
+func (f *UDPForwarder) readPooled(c *net.UDPConn) (*[]byte, int, error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return nil, 0, err
+	}
+	var (
+		bp   *[]byte
+		n    int
+		rerr error
+	)
+	err = rc.Read(func(fd uintptr) bool {
+		bp = f.bufPool.Get().(*[]byte)
+		for {
+			n, rerr = unix.Read(int(fd), *bp)
+			if rerr != unix.EINTR {
+				break
+			}
+		}
+		if rerr == unix.EAGAIN {
+			// 尚无数据：归还缓冲区，由 netpoller 等待可读后再调用
+			f.bufPool.Put(bp)
+			bp = nil
+			return false
+		}
+		return true
+	})
+	if err == nil {
+		err = rerr
+	}
+	if err != nil {
+		if bp != nil {
+			f.bufPool.Put(bp)
+		}
+		return nil, 0, err
+	}
+	return bp, n, nil
+}
@@ -0,0 +1,17 @@
+//go:build windows
+
+package forward
+
+import "net"
+
+// readPooled 从已连接的 c 读取一个数据报，返回从 bufPool 借用的缓冲区与长度，调用方用完后须归还；
+// 出错时不返回缓冲区。Windows 上无法在不提供缓冲区的情况下等待可读，等待期间缓冲区被占用
+func (f *UDPForwarder) readPooled(c *net.UDPConn) (*[]byte, int, error) {
+	bp := f.bufPool.Get().(*[]byte)
+	n, err := c.Read(*bp)
+	if err != nil {
+		f.bufPool.Put(bp)
+		return nil, 0, err
+	}
+	return bp, n, nil
+}
@@ -0,0 +1,158 @@
+package forward
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"natter/internal/clock"
+
+	"go.uber.org/zap"
+)
+
+// waitFor 轮询 cond 直到为真，超时则使测试失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestUDPSweepEvictsIdleSessionsOnClockTick(t *testing.T) {
+	fake := clock.NewFake(time.Unix(1_700_000_000, 0))
+	f := NewUDPForwarder("127.0.0.1:0", "127.0.0.1:9", 0, 0, zap.NewNop())
+	f.IdleTTL = 30 * time.Second
+	f.Clock = fake
+	if err := f.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+
+	session := func(last time.Time) *udpSession {
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &udpSession{conn: c}
+		s.lastActive.Store(last.UnixNano())
+		return s
+	}
+	start := fake.Now()
+	f.clientsMu.Lock()
+	f.clients["stale"] = session(start.Add(-time.Minute))
+	f.clients["fresh"] = session(start.Add(10 * time.Second))
+	f.clientsMu.Unlock()
+
+	// 清理协程注册 ticker 之后再推进时间，否则这次推进不会触发它
+	waitFor(t, "sweep ticker", func() bool { return fake.Waiters() > 0 })
+	fake.Add(f.IdleTTL / 2)
+	waitFor(t, "stale session eviction", func() bool {
+		f.clientsMu.Lock()
+		defer f.clientsMu.Unlock()
+		_, ok := f.clients["stale"]
+		return !ok
+	})
+	f.clientsMu.Lock()
+	_, fresh := f.clients["fresh"]
+	f.clientsMu.Unlock()
+	if !fresh {
+		t.Fatal("session active within IdleTTL was evicted")
+	}
+}
+
+func TestUDPSessionClosesAfterIdleTimeout(t *testing.T) {
+	f := NewUDPForwarder("127.0.0.1:0", echoTarget(t), 100*time.Millisecond, 0, zap.NewNop())
+	if err := f.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+	c, err := net.Dial("udp4", f.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	roundTrip(t, c, []byte("ping"), make([]byte, 16))
+	if active := f.Stats().ActiveConns; active != 1 {
+		t.Fatalf("active sessions = %d, want 1", active)
+	}
+	// 读目标回包时等待可读不持有缓冲区，但仍须遵守读截止时间
+	waitFor(t, "idle session to close", func() bool { return f.Stats().ActiveConns == 0 })
+}
+
+// echoTarget 启动一个回显收到的每个数据报的 UDP 目标，返回其地址
+func echoTarget(b testing.TB) string {
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { c.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := c.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			c.WriteTo(buf[:n], addr)
+		}
+	}()
+	return c.LocalAddr().String()
+}
+
+// startUDP 启动转发到 target 的 UDP 转发器，返回其监听地址
+func startUDP(b testing.TB, target string) string {
+	f := NewUDPForwarder("127.0.0.1:0", target, time.Minute, 0, zap.NewNop())
+	if err := f.Start(context.Background()); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(f.Stop)
+	return f.conn.LocalAddr().String()
+}
+
+// roundTrip 经 c 发出 payload 并等待回显
+func roundTrip(b testing.TB, c net.Conn, payload, buf []byte) {
+	if _, err := c.Write(payload); err != nil {
+		b.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Read(buf); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// BenchmarkUDPForward 测量单个客户端会话每个往返的开销
+func BenchmarkUDPForward(b *testing.B) {
+	addr := startUDP(b, echoTarget(b))
+	c, err := net.Dial("udp4", addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+	payload, buf := make([]byte, 512), make([]byte, 2048)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		roundTrip(b, c, payload, buf)
+	}
+}
+
+// BenchmarkUDPSessionChurn 每次迭代使用新的客户端端口，测量大量短会话时的开销
+func BenchmarkUDPSessionChurn(b *testing.B) {
+	addr := startUDP(b, echoTarget(b))
+	payload, buf := make([]byte, 512), make([]byte, 2048)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c, err := net.Dial("udp4", addr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		roundTrip(b, c, payload, buf)
+		c.Close()
+	}
+}
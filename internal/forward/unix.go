@@ -0,0 +1,30 @@
+package forward
+
+import (
+	"fmt"
+	"strings"
+)
+
+// UnixPrefix 标记 Unix 域套接字目标，如 "unix:/run/app.sock"，只用于 TCP 转发
+const UnixPrefix = "unix:"
+
+// targetNetwork 返回拨号 target 使用的网络与地址
+func targetNetwork(target string) (network, addr string) {
+	if path, ok := strings.CutPrefix(target, UnixPrefix); ok {
+		return "unix", path
+	}
+	return "tcp", target
+}
+
+// checkUnixTargets 在不支持 Unix 域套接字的平台上拒绝 unix: 目标
+func checkUnixTargets(targets []string) error {
+	if unixSocketSupported {
+		return nil
+	}
+	for _, t := range targets {
+		if strings.HasPrefix(t, UnixPrefix) {
+			return fmt.Errorf("unix socket target %q is not supported on this platform", t)
+		}
+	}
+	return nil
+}
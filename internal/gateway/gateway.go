@@ -0,0 +1,33 @@
+// Package gateway 查找本机 IPv4 默认网关，供 NAT-PMP / PCP 等需要直接与路由器通信的协议使用。
+package gateway
+
+import (
+	"errors"
+	"net"
+)
+
+// ErrNotFound 表示没有找到默认路由
+var ErrNotFound = errors.New("default gateway not found")
+
+// Default 返回 IPv4 默认网关地址。
+// Linux 读取 /proc/net/route；其他平台无法直接读取路由表时，
+// 退化为“本机地址 local 所在 /24 网段的 .1”这一家用网络中最常见的约定。
+// local 应是调用方已确定的出口或绑定 IP。
+func Default(local net.IP) (net.IP, error) {
+	if ip, err := defaultRoute(); err == nil {
+		return ip, nil
+	}
+	return guessFromLocal(local)
+}
+
+// guessFromLocal 把私有 IPv4 地址 local 的最后一段替换为 1
+func guessFromLocal(local net.IP) (net.IP, error) {
+	ip := local.To4()
+	if ip == nil || !ip.IsPrivate() {
+		return nil, ErrNotFound
+	}
+	gw := make(net.IP, net.IPv4len)
+	copy(gw, ip)
+	gw[3] = 1
+	return gw, nil
+}
@@ -0,0 +1,33 @@
+package gateway
+
+import (
+	"net"
+	"testing"
+)
+
+func TestGuessFromLocal(t *testing.T) {
+	tests := []struct {
+		local string
+		want  string // 空表示 ErrNotFound
+	}{
+		{"192.168.31.20", "192.168.31.1"},
+		{"10.1.2.3", "10.1.2.1"},
+		{"172.16.5.9", "172.16.5.1"},
+		{"203.0.113.7", ""}, // 公网地址前面没有家用路由器
+		{"127.0.0.1", ""},
+		{"fd00::2", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got, err := guessFromLocal(net.ParseIP(tt.local))
+		if tt.want == "" {
+			if err != ErrNotFound {
+				t.Errorf("guessFromLocal(%q) = %v, %v; want ErrNotFound", tt.local, got, err)
+			}
+			continue
+		}
+		if err != nil || !got.Equal(net.ParseIP(tt.want)) {
+			t.Errorf("guessFromLocal(%q) = %v, %v; want %s", tt.local, got, err, tt.want)
+		}
+	}
+}
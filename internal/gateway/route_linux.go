@@ -0,0 +1,42 @@
+//go:build linux
+
+package gateway
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"os"
+	"strings"
+)
+
+// defaultRoute 解析 /proc/net/route，返回目标为 0.0.0.0 的路由网关
+func defaultRoute() (net.IP, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Scan() // 表头
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		// Iface Destination Gateway Flags ...
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		// 内核以主机字节序（小端）输出
+		gw := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(gw, binary.LittleEndian.Uint32(raw))
+		if !gw.IsUnspecified() {
+			return gw, nil
+		}
+	}
+	return nil, ErrNotFound
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package gateway
+
+import "net"
+
+// defaultRoute 在非 Linux 平台上不读取路由表，由调用方退化为猜测
+func defaultRoute() (net.IP, error) {
+	return nil, ErrNotFound
+}
@@ -3,6 +3,7 @@
 package keepalive
 
 import (
+	"context"
 	"net"
 	"syscall"
 	"time"
@@ -25,3 +26,16 @@ func newDialerWithReuse(laddr *net.TCPAddr) net.Dialer {
 		},
 	}
 }
+
+// ListenUDP 监听 UDP 保活端口并开启端口复用，STUN 查询随后可以绑定同一端口
+func ListenUDP(ctx context.Context, addr string) (net.PacketConn, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var err error
+		c.Control(func(fd uintptr) {
+			_ = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+			_ = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		})
+		return err
+	}}
+	return lc.ListenPacket(ctx, "udp", addr)
+}
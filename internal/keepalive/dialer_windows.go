@@ -3,6 +3,7 @@
 package keepalive
 
 import (
+	"context"
 	"net"
 	"syscall"
 	"time"
@@ -26,3 +27,16 @@ func newDialerWithReuse(laddr *net.TCPAddr) net.Dialer {
 		},
 	}
 }
+
+// ListenUDP 监听 UDP 保活端口并关闭排他占用，STUN 查询随后可以绑定同一端口
+func ListenUDP(ctx context.Context, addr string) (net.PacketConn, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var err error
+		c.Control(func(fd uintptr) {
+			_ = windows.SetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, soExclusiveAddrUse, 0)
+			_ = windows.SetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, windows.SO_REUSEADDR, 1)
+		})
+		return err
+	}}
+	return lc.ListenPacket(ctx, "udp", addr)
+}
@@ -0,0 +1,35 @@
+package keepalive
+
+// failoverAfter 是切换到下一个保活目标前允许的连续失败次数
+const failoverAfter = 3
+
+// hostRing 在多个保活目标间轮换：当前目标连续失败 failoverAfter 次后切换到下一个
+type hostRing struct {
+	hosts []string
+	idx   int
+	fails int
+}
+
+func newHostRing(hosts []string) *hostRing {
+	return &hostRing{hosts: hosts}
+}
+
+func (r *hostRing) current() string {
+	return r.hosts[r.idx]
+}
+
+// fail 记录一次失败，返回是否已切换到下一个目标
+func (r *hostRing) fail() bool {
+	r.fails++
+	if r.fails < failoverAfter || len(r.hosts) < 2 {
+		return false
+	}
+	r.fails = 0
+	r.idx = (r.idx + 1) % len(r.hosts)
+	return true
+}
+
+// ok 记录一次成功，清零失败计数
+func (r *hostRing) ok() {
+	r.fails = 0
+}
@@ -0,0 +1,154 @@
+package keepalive
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// icmpReplyTimeout 是等待 Echo Reply 的时长，超时记为一次失败
+const icmpReplyTimeout = 2 * time.Second
+
+// errNoReply 表示在 icmpReplyTimeout 内没有收到对应的 Echo Reply
+var errNoReply = errors.New("no echo reply")
+
+// ICMPKeepAlive 定期向 host 发送 ICMP Echo 请求，适用于“任意出站流量即可续期映射”的 NAT。
+// 需要原始套接字权限（Linux 下 root 或 CAP_NET_RAW，Windows 下管理员）；
+// 没有权限时记录警告后直接返回，不影响其他功能。
+// 每个请求在 icmpReplyTimeout 内收到对应的 Echo Reply 才算成功；
+// hosts 有多个时，当前目标连续失败（含无回应）后切换到下一个。
+func ICMPKeepAlive(ctx context.Context, bindIP net.IP, hosts []string, interval time.Duration, logger *zap.Logger, opts ...Option) {
+	o := newOptions(opts)
+	interval = minInterval(interval)
+	if len(hosts) == 0 {
+		logger.Warn("ICMP keepalive has no host, skipping")
+		return
+	}
+	ring := newHostRing(hosts)
+	fail := func(remote string, err error) {
+		o.failed(remote, err)
+		if ring.fail() {
+			logger.Info("ICMP keepalive switching host", zap.String("host", ring.current()))
+		}
+	}
+
+	laddr := "0.0.0.0"
+	if bindIP != nil && bindIP.To4() != nil {
+		laddr = bindIP.String()
+	}
+	conn, err := net.ListenPacket("ip4:icmp", laddr)
+	if err != nil {
+		logger.Warn("ICMP keepalive unavailable (raw socket not permitted?), skipping", zap.Error(err))
+		return
+	}
+	defer conn.Close()
+
+	// 读取收到的 ICMP 报文，把本进程 Echo Reply 的序号交给发送循环，其余丢弃
+	id := uint16(os.Getpid())
+	replies := make(chan uint16, 8)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if seq, ok := echoReply(buf[:n], id); ok {
+				select {
+				case replies <- seq:
+				default:
+				}
+			}
+		}
+	}()
+
+	var seq uint16
+	for {
+		host := ring.current()
+		raddr, err := net.ResolveIPAddr("ip4", host)
+		if err != nil {
+			logger.Debug("ICMP keepalive resolve failed", zap.Error(err))
+			fail(host, err)
+		} else {
+			seq++
+			if _, err := conn.WriteTo(echoRequest(id, seq), raddr); err != nil {
+				logger.Debug("ICMP keepalive failed", zap.Error(err))
+				fail(raddr.String(), err)
+			} else if err := awaitReply(ctx, o, replies, seq); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				logger.Debug("ICMP keepalive got no reply", zap.String("to", raddr.String()), zap.Uint16("seq", seq))
+				fail(raddr.String(), err)
+			} else {
+				logger.Debug("ICMP keepalive ok", zap.String("to", raddr.String()), zap.Uint16("seq", seq))
+				o.succeeded(raddr.String())
+				ring.ok()
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			logger.Debug("ICMPKeepAlive exiting")
+			return
+		case <-o.wait(interval):
+		}
+	}
+}
+
+// awaitReply 等待序号为 seq 的 Echo Reply，较早请求迟到的回应被忽略
+func awaitReply(ctx context.Context, o options, replies <-chan uint16, seq uint16) error {
+	timeout := o.clock.After(icmpReplyTimeout)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout:
+			return errNoReply
+		case got := <-replies:
+			if got == seq {
+				return nil
+			}
+		}
+	}
+}
+
+// echoReply 解析 ICMPv4 Echo Reply（type 0），标识符为 id 时返回其序号
+func echoReply(b []byte, id uint16) (uint16, bool) {
+	if len(b) < 8 || b[0] != 0 || b[1] != 0 || binary.BigEndian.Uint16(b[4:]) != id {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(b[6:]), true
+}
+
+// echoRequest 构造 ICMPv4 Echo Request（type 8, code 0）
+func echoRequest(id, seq uint16) []byte {
+	payload := []byte("natter-keep-alive")
+	pkt := make([]byte, 8+len(payload))
+	pkt[0] = 8
+	binary.BigEndian.PutUint16(pkt[4:], id)
+	binary.BigEndian.PutUint16(pkt[6:], seq)
+	copy(pkt[8:], payload)
+	binary.BigEndian.PutUint16(pkt[2:], checksum(pkt))
+	return pkt
+}
+
+// checksum 计算 RFC 1071 互联网校验和
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,66 @@
+package keepalive
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"natter/internal/clock"
+)
+
+func TestEchoReply(t *testing.T) {
+	reply := echoRequest(0x1234, 7)
+	reply[0] = 0 // Echo Reply 与请求只差类型
+	if seq, ok := echoReply(reply, 0x1234); !ok || seq != 7 {
+		t.Fatalf("echoReply = %d, %v; want 7, true", seq, ok)
+	}
+	if _, ok := echoReply(reply, 0x4321); ok {
+		t.Error("accepted a reply for another identifier")
+	}
+	if _, ok := echoReply(echoRequest(0x1234, 7), 0x1234); ok {
+		t.Error("accepted an echo request as a reply")
+	}
+	unreachable := make([]byte, 8)
+	unreachable[0] = 3
+	binary.BigEndian.PutUint16(unreachable[4:], 0x1234)
+	if _, ok := echoReply(unreachable, 0x1234); ok {
+		t.Error("accepted a destination unreachable message")
+	}
+}
+
+func TestAwaitReplyTimesOutWithoutReply(t *testing.T) {
+	fake := clock.NewFake(time.Unix(1_700_000_000, 0))
+	o := newOptions([]Option{WithClock(fake)})
+	replies := make(chan uint16, 1)
+	replies <- 3 // 上一个请求迟到的回应不算数
+
+	done := make(chan error, 1)
+	go func() { done <- awaitReply(context.Background(), o, replies, 4) }()
+	deadline := time.Now().Add(2 * time.Second)
+	for fake.Waiters() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("awaitReply did not start waiting")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	fake.Add(icmpReplyTimeout)
+	select {
+	case err := <-done:
+		if err != errNoReply {
+			t.Fatalf("awaitReply = %v, want errNoReply", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("awaitReply did not time out")
+	}
+}
+
+func TestAwaitReplyMatchesSequence(t *testing.T) {
+	o := newOptions([]Option{WithClock(clock.NewFake(time.Unix(1_700_000_000, 0)))})
+	replies := make(chan uint16, 2)
+	replies <- 3
+	replies <- 4
+	if err := awaitReply(context.Background(), o, replies, 4); err != nil {
+		t.Fatalf("awaitReply = %v, want nil", err)
+	}
+}
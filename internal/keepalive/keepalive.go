@@ -2,13 +2,12 @@ package keepalive
 
 import (
 	"context"
-	"crypto/rand"
-	"encoding/binary"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"math"
-	mr "math/rand"
 	"net"
+	"strconv"
 	"time"
 
 	"go.uber.org/zap"
@@ -24,13 +23,30 @@ func minInterval(d time.Duration) time.Duration {
 
 // TCPKeepAlive 与 Python v2.1 版一致的改进：
 // 1. 持久连接保持 5 元组；失败后指数退避重连
-// 2. 支持 host 为域名，先在 DialContext 时解析
+// 2. 支持 host 为域名，先在 DialContext 时解析；hosts 有多个时，当前目标连续失败后切换到下一个
 // 3. 绑定本地 laddr
-func TCPKeepAlive(ctx context.Context, laddr *net.TCPAddr, host string, interval time.Duration, logger *zap.Logger) {
+// 4. WithScheme("https") 时先完成 TLS 握手，在加密连接上发送同样的 HEAD
+// 目标端口默认 80（https 为 443），可通过 WithPort 修改
+func TCPKeepAlive(ctx context.Context, laddr *net.TCPAddr, hosts []string, interval time.Duration, logger *zap.Logger, opts ...Option) {
+	o := newOptions(opts)
 	interval = minInterval(interval)
-	hostPort := net.JoinHostPort(host, "80")
+	if len(hosts) == 0 {
+		logger.Warn("TCP keepalive has no host, skipping")
+		return
+	}
+	ring := newHostRing(hosts)
+	host := ring.current()
+	hostPort := net.JoinHostPort(host, strconv.Itoa(o.tcpPort()))
+	fail := func(err error) {
+		o.failed(hostPort, err)
+		if ring.fail() {
+			host = ring.current()
+			hostPort = net.JoinHostPort(host, strconv.Itoa(o.tcpPort()))
+			logger.Info("TCP keepalive switching host", zap.String("host", host))
+		}
+	}
 
-	var conn *net.TCPConn
+	var conn net.Conn
 	defer func() {
 		if conn != nil {
 			conn.Close()
@@ -41,27 +57,27 @@ func TCPKeepAlive(ctx context.Context, laddr *net.TCPAddr, host string, interval
 
 	for {
 		if conn == nil {
-			dialer := newDialerWithReuse(laddr)
-			c, err := dialer.DialContext(ctx, "tcp4", hostPort)
+			c, err := o.dialTCP(ctx, laddr, host, hostPort)
 			if err != nil {
 				logger.Debug("TCP keepalive dial failed", zap.String("host", host), zap.Error(err))
+				fail(err)
 				select {
 				case <-ctx.Done():
 					return
-				case <-time.After(backoff):
+				case <-o.wait(backoff):
 				}
 				backoff = time.Duration(math.Min(float64(backoff*2), float64(60*time.Second)))
 				continue
 			}
-			conn = c.(*net.TCPConn)
-			_ = conn.SetNoDelay(true)
+			conn = c
 			logger.Debug("TCP keepalive connection established", zap.String("local", conn.LocalAddr().String()))
 			backoff = interval
 		}
 
-		req := fmt.Sprintf("HEAD /natter-keep-alive HTTP/1.1\r\nHost: %s\r\nConnection: keep-alive\r\n\r\n", host)
+		req := o.request(host)
 		if _, err := io.WriteString(conn, req); err != nil {
 			logger.Debug("TCP keepalive write failed", zap.Error(err))
+			fail(err)
 			conn.Close()
 			conn = nil
 			continue
@@ -75,6 +91,7 @@ func TCPKeepAlive(ctx context.Context, laddr *net.TCPAddr, host string, interval
 					break
 				}
 				logger.Debug("TCP keepalive read failed", zap.Error(err))
+				fail(err)
 				conn.Close()
 				conn = nil
 				break
@@ -82,31 +99,80 @@ func TCPKeepAlive(ctx context.Context, laddr *net.TCPAddr, host string, interval
 		}
 		if conn != nil {
 			logger.Debug("TCP keepalive ok", zap.String("remote", hostPort))
+			o.succeeded(hostPort)
+			ring.ok()
 		}
 
 		select {
 		case <-ctx.Done():
 			return
-		case <-time.After(interval):
+		case <-o.wait(interval):
 		}
 	}
 }
 
-// UDPKeepAlive 发送 DNS 查询帧
+// dialTCP 建立保活连接（设置 WithDialer 时经代理）；https 模式下在同一条 TCP 连接上完成 TLS 握手，保持 5 元组不变
+func (o options) dialTCP(ctx context.Context, laddr *net.TCPAddr, host, hostPort string) (net.Conn, error) {
+	dialer := newDialerWithReuse(laddr)
+	var c net.Conn
+	var err error
+	if o.dialer != nil {
+		dctx, cancel := context.WithTimeout(ctx, dialer.Timeout)
+		c, err = o.dialer.DialContext(dctx, "tcp4", hostPort)
+		cancel()
+	} else {
+		c, err = dialer.DialContext(ctx, "tcp4", hostPort)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tcp, ok := c.(*net.TCPConn); ok {
+		_ = tcp.SetNoDelay(true)
+	}
+	if !o.tls {
+		return c, nil
+	}
+
+	tc := tls.Client(c, &tls.Config{ServerName: host})
+	hsCtx, cancel := context.WithTimeout(ctx, dialer.Timeout)
+	defer cancel()
+	if err := tc.HandshakeContext(hsCtx); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("tls handshake: %w", err)
+	}
+	return tc, nil
+}
+
 // UDPKeepAlive 发送 DNS 查询帧；支持 host 为域名
-func UDPKeepAlive(ctx context.Context, conn net.PacketConn, host string, port int, interval time.Duration, logger *zap.Logger) {
+// 负载可通过 WithPayload 替换为 STUN 请求、空数据报或自定义字节
+// conn 可能属于 UDP 转发器，回应由它读取，因此这里只发送、不等待回应：
+// 发送成功以 Report.Unconfirmed 上报，hosts 有多个时只在解析或发送连续出错后切换到下一个，
+// 目标宕机但数据报仍能发出时不会切换
+func UDPKeepAlive(ctx context.Context, conn net.PacketConn, hosts []string, port int, interval time.Duration, logger *zap.Logger, opts ...Option) {
+	o := newOptions(opts)
 	interval = minInterval(interval)
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+	if len(hosts) == 0 {
+		logger.Warn("UDP keepalive has no host, skipping")
+		return
+	}
+	ring := newHostRing(hosts)
+	fail := func(remote string, err error) {
+		o.failed(remote, err)
+		if ring.fail() {
+			logger.Info("UDP keepalive switching host", zap.String("host", ring.current()))
+		}
+	}
 
 	// 解析 host → IP（每次都解析，兼容动态解析）
 	resolve := func() *net.UDPAddr {
+		host := ring.current()
 		if ip := net.ParseIP(host); ip != nil {
 			return &net.UDPAddr{IP: ip, Port: port}
 		}
 		addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, fmt.Sprint(port)))
 		if err != nil {
 			logger.Debug("UDP keepalive resolve failed", zap.Error(err))
+			fail(host, err)
 			return nil
 		}
 		return addr
@@ -118,31 +184,25 @@ func UDPKeepAlive(ctx context.Context, conn net.PacketConn, host string, port in
 			select {
 			case <-ctx.Done():
 				return
-			case <-ticker.C:
+			case <-o.wait(interval):
 				continue
 			}
 		}
 
-		txid := make([]byte, 2)
-		if _, err := rand.Read(txid); err != nil {
-			binary.BigEndian.PutUint16(txid, uint16(mr.Intn(0xffff)))
-		}
-		header := append(txid, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00)
-		qname := []byte{0x09, 'k', 'e', 'e', 'p', 'a', 'l', 'i', 'v', 'e', 0x06, 'n', 'a', 't', 't', 'e', 'r', 0x00}
-		question := []byte{0x00, 0x01, 0x00, 0x01}
-		pkt := append(header, append(qname, question...)...)
-
-		if _, err := conn.WriteTo(pkt, raddr); err != nil {
+		if _, err := conn.WriteTo(o.payload(), raddr); err != nil {
 			logger.Debug("UDP keepalive failed", zap.Error(err))
+			fail(raddr.String(), err)
 		} else {
 			logger.Debug("UDP keepalive sent", zap.String("to", raddr.String()))
+			o.sent(raddr.String())
+			ring.ok()
 		}
 
 		select {
 		case <-ctx.Done():
 			logger.Debug("UDPKeepAlive exiting")
 			return
-		case <-ticker.C:
+		case <-o.wait(interval):
 		}
 	}
 }
@@ -0,0 +1,57 @@
+package keepalive
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"natter/internal/clock"
+
+	"go.uber.org/zap"
+)
+
+func TestUDPKeepAliveWaitsForClock(t *testing.T) {
+	target, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fake := clock.NewFake(time.Unix(1_700_000_000, 0))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	port := target.LocalAddr().(*net.UDPAddr).Port
+	go UDPKeepAlive(ctx, conn, []string{"127.0.0.1"}, port, 30*time.Second, zap.NewNop(), WithClock(fake))
+
+	buf := make([]byte, 1500)
+	receive := func(within time.Duration) bool {
+		target.SetReadDeadline(time.Now().Add(within))
+		_, _, err := target.ReadFrom(buf)
+		return err == nil
+	}
+	if !receive(2 * time.Second) {
+		t.Fatal("no keepalive sent on start")
+	}
+
+	// 下一次发送只由时钟推进触发，不依赖真实时间
+	deadline := time.Now().Add(2 * time.Second)
+	for fake.Waiters() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("keepalive loop is not waiting on the clock")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if receive(200 * time.Millisecond) {
+		t.Fatal("keepalive sent again before the interval elapsed")
+	}
+	fake.Add(30 * time.Second)
+	if !receive(2 * time.Second) {
+		t.Fatal("no keepalive sent after the clock reached the interval")
+	}
+}
@@ -0,0 +1,184 @@
+package keepalive
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"natter/internal/clock"
+)
+
+// Option 调整保活循环的行为，未指定时使用默认值。
+type Option func(*options)
+
+type options struct {
+	clock     clock.Clock
+	onFailure func()
+	port      int
+	tls       bool
+	method    string
+	path      string
+	headers   map[string]string
+	payload   Payload
+	report    func(Report)
+	jitter    float64
+	dialer    Dialer
+}
+
+// Dialer 建立 TCP 保活连接，golang.org/x/net/proxy 的 SOCKS5 拨号器满足该接口
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Report 是一次保活尝试的结果
+type Report struct {
+	Remote string    // 保活目标
+	OK     bool      // 本次是否成功
+	Err    error     // 失败原因，成功时为 nil
+	Time   time.Time // 尝试时间（取自 Option 指定的时钟）
+	// Unconfirmed 表示 OK 只代表数据已发出、没有等待对端回应（UDP 保活），
+	// 目标不可达时通常也不会报错，不能据此认为目标健康
+	Unconfirmed bool
+}
+
+// WithClock 指定保活循环使用的时钟，默认为真实时钟。
+func WithClock(c clock.Clock) Option {
+	return func(o *options) { o.clock = c }
+}
+
+// WithFailureHook 注册保活失败（连接、发送或读取出错）时的回调。
+// 回调在保活 goroutine 中同步执行，应尽快返回。
+func WithFailureHook(fn func()) Option {
+	return func(o *options) { o.onFailure = fn }
+}
+
+// WithPort 指定 TCP 保活的目标端口，默认 http 为 80、https 为 443。
+func WithPort(port int) Option {
+	return func(o *options) {
+		if port > 0 {
+			o.port = port
+		}
+	}
+}
+
+// WithScheme 选择 TCP 保活方式："http"（默认，明文 HEAD）或 "https"（TLS 握手后在加密连接上发送 HEAD）。
+func WithScheme(scheme string) Option {
+	return func(o *options) { o.tls = scheme == "https" }
+}
+
+// WithRequest 自定义 TCP 保活发送的 HTTP 请求。
+// method 默认 HEAD，path 默认 /natter-keep-alive；headers 为附加请求头，
+// 其中的 Host、Connection 会覆盖默认值。
+func WithRequest(method, path string, headers map[string]string) Option {
+	return func(o *options) {
+		if method != "" {
+			o.method = method
+		}
+		if path != "" {
+			o.path = path
+		}
+		o.headers = headers
+	}
+}
+
+// request 生成发送给 host 的 HTTP/1.1 请求报文
+func (o options) request(host string) string {
+	hdr := map[string]string{"Host": host, "Connection": "keep-alive"}
+	for k, v := range o.headers {
+		hdr[http.CanonicalHeaderKey(k)] = v
+	}
+	keys := make([]string, 0, len(hdr))
+	for k := range hdr {
+		if k != "Host" && k != "Connection" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\n", o.method, o.path)
+	for _, k := range append([]string{"Host", "Connection"}, keys...) {
+		fmt.Fprintf(&b, "%s: %s\r\n", k, hdr[k])
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// WithDialer 让 TCP 保活经 d（如 SOCKS5 代理）连出，不再绑定本地端口。
+// 此时保活维持的是代理出口的映射，对本机端口的 NAT 映射没有作用。
+func WithDialer(d Dialer) Option {
+	return func(o *options) { o.dialer = d }
+}
+
+// WithPayload 指定 UDP 保活每次发送的数据，默认 DNSPayload。
+func WithPayload(p Payload) Option {
+	return func(o *options) {
+		if p != nil {
+			o.payload = p
+		}
+	}
+}
+
+// tcpPort 返回 TCP 保活的实际目标端口
+func (o options) tcpPort() int {
+	switch {
+	case o.port > 0:
+		return o.port
+	case o.tls:
+		return 443
+	default:
+		return 80
+	}
+}
+
+// WithReporter 注册保活结果回调，每次尝试（无论成功失败）调用一次。
+// 回调在保活 goroutine 中同步执行，应尽快返回。
+func WithReporter(fn func(Report)) Option {
+	return func(o *options) { o.report = fn }
+}
+
+// WithJitter 为每次等待叠加 ±frac 比例的随机偏移，避免多个实例同步触发。
+func WithJitter(frac float64) Option {
+	return func(o *options) { o.jitter = frac }
+}
+
+// wait 返回等待 d（叠加抖动）后触发的通道
+func (o options) wait(d time.Duration) <-chan time.Time {
+	return o.clock.After(clock.Jitter(d, o.jitter))
+}
+
+// failed 记录一次失败：触发失败回调并上报
+func (o options) failed(remote string, err error) {
+	if o.onFailure != nil {
+		o.onFailure()
+	}
+	if o.report != nil {
+		o.report(Report{Remote: remote, Err: err, Time: o.clock.Now()})
+	}
+}
+
+// succeeded 上报一次成功
+func (o options) succeeded(remote string) {
+	if o.report != nil {
+		o.report(Report{Remote: remote, OK: true, Time: o.clock.Now()})
+	}
+}
+
+// sent 上报一次已发出但未确认对端收到的保活
+func (o options) sent(remote string) {
+	if o.report != nil {
+		o.report(Report{Remote: remote, OK: true, Unconfirmed: true, Time: o.clock.Now()})
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{clock: clock.New(), method: http.MethodHead, path: "/natter-keep-alive", payload: DNSPayload}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
@@ -0,0 +1,73 @@
+package keepalive
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	mr "math/rand"
+	"os"
+	"strings"
+
+	"github.com/pion/stun"
+)
+
+// Payload 生成每次 UDP 保活发送的数据
+type Payload func() []byte
+
+// DNSPayload 生成查询 keepalive.natter A 记录的 DNS 请求，事务 ID 随机
+func DNSPayload() []byte {
+	txid := make([]byte, 2)
+	if _, err := rand.Read(txid); err != nil {
+		binary.BigEndian.PutUint16(txid, uint16(mr.Intn(0xffff)))
+	}
+	header := append(txid, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00)
+	qname := []byte{0x09, 'k', 'e', 'e', 'p', 'a', 'l', 'i', 'v', 'e', 0x06, 'n', 'a', 't', 't', 'e', 'r', 0x00}
+	question := []byte{0x00, 0x01, 0x00, 0x01}
+	return append(header, append(qname, question...)...)
+}
+
+// STUNPayload 生成 STUN Binding 请求，事务 ID 随机
+func STUNPayload() []byte {
+	return stun.MustBuild(stun.BindingRequest, stun.TransactionID).Raw
+}
+
+// EmptyPayload 生成空数据报
+func EmptyPayload() []byte { return nil }
+
+// RawPayload 每次发送固定的 b
+func RawPayload(b []byte) Payload {
+	return func() []byte { return b }
+}
+
+// ParsePayload 解析配置中的负载描述：
+//
+//	"" 或 "dns"  内置 DNS 查询（默认）
+//	"stun"       STUN Binding 请求
+//	"empty"      空数据报
+//	"hex:<hex>"  原始字节，十六进制表示
+//	"file:<path>" 从文件读取原始字节
+func ParsePayload(spec string) (Payload, error) {
+	switch {
+	case spec == "" || spec == "dns":
+		return DNSPayload, nil
+	case spec == "stun":
+		return STUNPayload, nil
+	case spec == "empty":
+		return EmptyPayload, nil
+	case strings.HasPrefix(spec, "hex:"):
+		b, err := hex.DecodeString(strings.ReplaceAll(strings.TrimPrefix(spec, "hex:"), " ", ""))
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex payload: %w", err)
+		}
+		return RawPayload(b), nil
+	case strings.HasPrefix(spec, "file:"):
+		b, err := os.ReadFile(strings.TrimPrefix(spec, "file:"))
+		if err != nil {
+			return nil, fmt.Errorf("read payload file: %w", err)
+		}
+		return RawPayload(b), nil
+	default:
+		return nil, fmt.Errorf("unknown keepalive payload %q", spec)
+	}
+}
@@ -1,36 +1,93 @@
 package log
 
 import (
+	"fmt"
 	"os"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
+// Option 调整 New 创建的 Logger
+type Option func(*options)
+
+type options struct {
+	format                            string
+	maxSizeMB, maxBackups, maxAgeDays int
+	noStdout                          bool
+}
+
+// WithFormat 设置输出格式："console"（默认，彩色级别）或 "json"（便于 Loki/ELK 等日志系统解析）
+func WithFormat(format string) Option {
+	return func(o *options) { o.format = format }
+}
+
+// WithRotation 启用日志文件轮转：文件超过 maxSizeMB 时切分，最多保留 maxBackups 个旧文件、
+// 保留 maxAgeDays 天；三者均为 0 时不轮转，按原方式追加写入
+func WithRotation(maxSizeMB, maxBackups, maxAgeDays int) Option {
+	return func(o *options) {
+		o.maxSizeMB, o.maxBackups, o.maxAgeDays = maxSizeMB, maxBackups, maxAgeDays
+	}
+}
+
+// WithoutStdout 在设置了日志文件时不再输出到 stdout；
+// 后台运行时 stdout 已重定向到同一个日志文件，避免每条日志写两遍
+func WithoutStdout() Option {
+	return func(o *options) { o.noStdout = true }
+}
+
 // New 创建并返回一个 zap.Logger，根据传入的 levelStr 和可选的 logFilePath。
 // levelStr 支持 "debug", "info", "warn", "error" 等级别。
 // logFilePath 为空时仅输出到 stdout，否则同时输出到 stdout 和指定文件。
-func New(levelStr, logFilePath string) (*zap.Logger, error) {
+func New(levelStr, logFilePath string, opts ...Option) (*zap.Logger, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	// 解析日志级别
 	var lvl zapcore.Level
 	if err := lvl.UnmarshalText([]byte(levelStr)); err != nil {
 		return nil, err
 	}
 
-	// Encoder 配置：console 输出，ISO8601 时间格式
+	// Encoder 配置：ISO8601 时间格式；console 输出彩色级别，json 不带颜色
 	encoderCfg := zap.NewProductionEncoderConfig()
 	encoderCfg.EncodeTime = zapcore.ISO8601TimeEncoder
-	encoderCfg.EncodeLevel = zapcore.CapitalColorLevelEncoder
-	encoder := zapcore.NewConsoleEncoder(encoderCfg)
+	var encoder zapcore.Encoder
+	switch o.format {
+	case "", "console":
+		encoderCfg.EncodeLevel = zapcore.CapitalColorLevelEncoder
+		encoder = zapcore.NewConsoleEncoder(encoderCfg)
+	case "json":
+		encoderCfg.EncodeLevel = zapcore.LowercaseLevelEncoder
+		encoder = zapcore.NewJSONEncoder(encoderCfg)
+	default:
+		return nil, fmt.Errorf("unknown log format %q", o.format)
+	}
 
 	// 构建 WriteSyncer 列表
-	syncers := []zapcore.WriteSyncer{zapcore.AddSync(os.Stdout)}
-	if logFilePath != "" {
+	var syncers []zapcore.WriteSyncer
+	if !o.noStdout || logFilePath == "" {
+		syncers = append(syncers, zapcore.AddSync(os.Stdout))
+	}
+	if logFilePath != "" && (o.maxSizeMB > 0 || o.maxBackups > 0 || o.maxAgeDays > 0) {
+		// 交给 lumberjack 轮转；未设置 maxSizeMB 时使用其默认的 100MB
+		syncers = append(syncers, zapcore.AddSync(&lumberjack.Logger{
+			Filename:   logFilePath,
+			MaxSize:    o.maxSizeMB,
+			MaxBackups: o.maxBackups,
+			MaxAge:     o.maxAgeDays,
+		}))
+	} else if logFilePath != "" {
 		// 打开或创建文件
 		f, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 		if err != nil {
 			// 如果打开文件失败，退回至 stdout
-			zapcore.NewCore(encoder, zapcore.AddSync(os.Stdout), lvl)
+			if o.noStdout {
+				syncers = append(syncers, zapcore.AddSync(os.Stdout))
+			}
 		} else {
 			syncers = append(syncers, zapcore.AddSync(f))
 		}
@@ -46,3 +103,19 @@ func New(levelStr, logFilePath string) (*zap.Logger, error) {
 	logger := zap.New(core, zap.AddCaller(), zap.AddCallerSkip(1))
 	return logger, nil
 }
+
+// NewAudit 创建审计日志：以 JSON Lines 追加写入 path，只写文件、不输出到 stdout，
+// 不受主日志级别影响（始终记录 info 及以上），也不轮转，由外部工具负责归档
+func NewAudit(path string) (*zap.Logger, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open audit file: %w", err)
+	}
+	encoderCfg := zap.NewProductionEncoderConfig()
+	encoderCfg.EncodeTime = zapcore.ISO8601TimeEncoder
+	encoderCfg.MessageKey = "event"
+	encoderCfg.LevelKey = zapcore.OmitKey
+	encoderCfg.CallerKey = zapcore.OmitKey
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(encoderCfg), zapcore.AddSync(f), zapcore.InfoLevel)
+	return zap.New(core), nil
+}
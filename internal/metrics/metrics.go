@@ -0,0 +1,122 @@
+// Package metrics 以 Prometheus 格式导出映射、STUN、保活与转发统计。
+// 大部分指标在抓取时从各模块的统计接口读取，只有保活重连次数需要调用方主动累加。
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+
+	"natter/internal/status"
+	"natter/internal/stun"
+)
+
+// Sources 提供抓取时读取的数据，字段为 nil 时对应指标不输出
+type Sources struct {
+	Mappings   func() map[string]int             // protocol -> 映射条数
+	STUN       func() map[string]stun.ServerStat // server -> 统计
+	Forwarders func() []status.ForwardStat
+}
+
+var (
+	mappingsDesc = prometheus.NewDesc("natter_mappings",
+		"Number of known NAT mappings.", []string{"protocol"}, nil)
+	stunDesc = prometheus.NewDesc("natter_stun_requests_total",
+		"STUN requests by server and result.", []string{"server", "result"}, nil)
+	stunRTTDesc = prometheus.NewDesc("natter_stun_rtt_seconds",
+		"Moving average STUN round-trip time.", []string{"server"}, nil)
+	fwdActiveDesc = prometheus.NewDesc("natter_forward_active_connections",
+		"Active forwarded connections (UDP: client sessions).", []string{"protocol", "listen"}, nil)
+	fwdBytesDesc = prometheus.NewDesc("natter_forward_bytes_total",
+		"Bytes forwarded; direction is in (client to target) or out (target to client).", []string{"protocol", "listen", "direction"}, nil)
+	fwdConnsDesc = prometheus.NewDesc("natter_forward_connections_total",
+		"Connections (UDP: client sessions) accepted by the forwarder.", []string{"protocol", "listen"}, nil)
+)
+
+// Exporter 汇总所有指标
+type Exporter struct {
+	src        Sources
+	reconnects *prometheus.CounterVec
+	registry   *prometheus.Registry
+}
+
+// New 创建 Exporter，并在独立的 registry 中注册全部指标
+func New(src Sources) *Exporter {
+	e := &Exporter{
+		src: src,
+		reconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "natter_keepalive_reconnects_total",
+			Help: "Keep-alive failures; each one makes the loop reconnect or retry.",
+		}, []string{"protocol"}),
+		registry: prometheus.NewRegistry(),
+	}
+	e.registry.MustRegister(e, e.reconnects)
+	return e
+}
+
+// KeepAliveFailed 记录一次保活失败
+func (e *Exporter) KeepAliveFailed(protocol string) {
+	e.reconnects.WithLabelValues(protocol).Inc()
+}
+
+// Describe 实现 prometheus.Collector
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- mappingsDesc
+	ch <- stunDesc
+	ch <- stunRTTDesc
+	ch <- fwdActiveDesc
+	ch <- fwdBytesDesc
+	ch <- fwdConnsDesc
+}
+
+// Collect 实现 prometheus.Collector，在抓取时读取各数据源
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	if e.src.Mappings != nil {
+		for proto, n := range e.src.Mappings() {
+			ch <- prometheus.MustNewConstMetric(mappingsDesc, prometheus.GaugeValue, float64(n), proto)
+		}
+	}
+	if e.src.STUN != nil {
+		for server, st := range e.src.STUN() {
+			ch <- prometheus.MustNewConstMetric(stunDesc, prometheus.CounterValue, float64(st.Success), server, "success")
+			ch <- prometheus.MustNewConstMetric(stunDesc, prometheus.CounterValue, float64(st.Failure), server, "failure")
+			ch <- prometheus.MustNewConstMetric(stunRTTDesc, prometheus.GaugeValue, st.AvgRTT.Seconds(), server)
+		}
+	}
+	if e.src.Forwarders != nil {
+		for _, fs := range e.src.Forwarders() {
+			ch <- prometheus.MustNewConstMetric(fwdActiveDesc, prometheus.GaugeValue, float64(fs.ActiveConns), fs.Protocol, fs.Listen)
+			ch <- prometheus.MustNewConstMetric(fwdBytesDesc, prometheus.CounterValue, float64(fs.BytesIn), fs.Protocol, fs.Listen, "in")
+			ch <- prometheus.MustNewConstMetric(fwdBytesDesc, prometheus.CounterValue, float64(fs.BytesOut), fs.Protocol, fs.Listen, "out")
+			ch <- prometheus.MustNewConstMetric(fwdConnsDesc, prometheus.CounterValue, float64(fs.TotalConns), fs.Protocol, fs.Listen)
+		}
+	}
+}
+
+// Serve 在 addr 上提供 /metrics，直到 ctx 结束
+func (e *Exporter) Serve(ctx context.Context, addr string, logger *zap.Logger) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(e.registry, promhttp.HandlerOpts{}))
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		srv.Shutdown(shutCtx)
+	}()
+	logger.Info("Metrics server listening", zap.String("addr", ln.Addr().String()))
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+// Package natpmp 实现 NAT-PMP（RFC 6886）客户端，向默认网关申请端口映射。
+// 部分路由器（如 Apple AirPort、部分 OpenWrt 配置）只支持 NAT-PMP 而不支持 UPnP IGD。
+//
+// NAT-PMP 只能为发起请求的主机本身创建映射，AddTCP/AddUDP 的 internalIP 参数
+// 仅用于与 upnp.Client 保持一致的接口，不会发送给网关。
+package natpmp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"natter/internal/gateway"
+)
+
+// Port 是 NAT-PMP 服务端口
+const Port = 5351
+
+// permanentLifetime 在调用方请求“永久”（durationSec = 0）时使用；
+// NAT-PMP 中 lifetime 0 表示删除映射，因此改为最大值，由网关自行截短。
+const permanentLifetime = 1<<31 - 1
+
+// 请求重传：初始 250ms，每次翻倍（RFC 6886 3.1），这里最多 4 次以免启动时阻塞过久
+const (
+	initialTimeout = 250 * time.Millisecond
+	maxAttempts    = 4
+)
+
+const (
+	opExternalAddr = 0
+	opMapUDP       = 1
+	opMapTCP       = 2
+)
+
+// Client 与网关上的 NAT-PMP 服务通信。零值无效，必须通过 Discover 创建。
+type Client struct {
+	gateway net.IP
+	logger  *zap.Logger
+}
+
+// ResultError 是网关返回的非零结果码
+type ResultError uint16
+
+func (e ResultError) Error() string {
+	switch e {
+	case 1:
+		return "natpmp: unsupported version"
+	case 2:
+		return "natpmp: not authorized/refused"
+	case 3:
+		return "natpmp: network failure"
+	case 4:
+		return "natpmp: out of resources"
+	case 5:
+		return "natpmp: unsupported opcode"
+	default:
+		return "natpmp: result code " + strconv.Itoa(int(e))
+	}
+}
+
+// Discover 找到默认网关并查询其外部地址，以确认网关支持 NAT-PMP；ctx 结束时放弃等待。
+// local 是本机出口 IP，无法读取路由表时据此推测网关（见 gateway.Default）。
+func Discover(ctx context.Context, local net.IP, logger *zap.Logger) (*Client, error) {
+	gw, err := gateway.Default(local)
+	if err != nil {
+		return nil, fmt.Errorf("natpmp discover: %w", err)
+	}
+	c := &Client{gateway: gw, logger: logger}
+	ext, err := c.ExternalIP(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("natpmp discover (gateway %s): %w", gw, err)
+	}
+	logger.Info("NAT-PMP gateway found", zap.Stringer("gateway", gw), zap.Stringer("external_ip", ext))
+	return c, nil
+}
+
+// ExternalIP 返回网关报告的外部 IPv4 地址
+func (c *Client) ExternalIP(ctx context.Context) (net.IP, error) {
+	res, err := c.call(ctx, []byte{0, opExternalAddr}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IP(append([]byte(nil), res[8:12]...)), nil
+}
+
+// AddTCP 为本机 internalPort 申请 TCP 映射，建议外部端口为 externalPort，返回网关实际分配的外部端口。
+// durationSec = 0 代表尽可能长的租期。
+func (c *Client) AddTCP(ctx context.Context, externalPort, internalPort int, internalIP string, durationSec uint32) (int, error) {
+	return c.add(ctx, opMapTCP, externalPort, internalPort, durationSec)
+}
+
+// AddUDP 为本机 internalPort 申请 UDP 映射。
+func (c *Client) AddUDP(ctx context.Context, externalPort, internalPort int, internalIP string, durationSec uint32) (int, error) {
+	return c.add(ctx, opMapUDP, externalPort, internalPort, durationSec)
+}
+
+// DeleteTCP 删除本机 internalPort 的 TCP 映射；NAT-PMP 按内部端口识别映射，externalPort 仅用于日志。
+func (c *Client) DeleteTCP(ctx context.Context, externalPort, internalPort int) error {
+	return c.delete(ctx, opMapTCP, externalPort, internalPort)
+}
+
+// DeleteUDP 删除本机 internalPort 的 UDP 映射。
+func (c *Client) DeleteUDP(ctx context.Context, externalPort, internalPort int) error {
+	return c.delete(ctx, opMapUDP, externalPort, internalPort)
+}
+
+func (c *Client) add(ctx context.Context, op byte, ext, in int, dur uint32) (int, error) {
+	if dur == 0 {
+		dur = permanentLifetime
+	}
+	req := make([]byte, 12)
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:], uint16(in))
+	binary.BigEndian.PutUint16(req[6:], uint16(ext))
+	binary.BigEndian.PutUint32(req[8:], dur)
+
+	res, err := c.call(ctx, req, 16)
+	if err != nil {
+		return 0, fmt.Errorf("natpmp map (%s %d): %w", protoName(op), ext, err)
+	}
+	mapped := int(binary.BigEndian.Uint16(res[10:]))
+	lifetime := binary.BigEndian.Uint32(res[12:])
+	if mapped != ext {
+		c.logger.Debug("NAT-PMP assigned a different external port", zap.String("proto", protoName(op)), zap.Int("requested", ext), zap.Int("assigned", mapped))
+	}
+	c.logger.Debug("NAT-PMP port-mapping added", zap.String("proto", protoName(op)), zap.Int("outer", mapped), zap.Int("inner", in), zap.Uint32("lifetime", lifetime))
+	return mapped, nil
+}
+
+// delete 发送建议外部端口与租期均为 0 的映射请求，即 RFC 6886 中的删除操作
+func (c *Client) delete(ctx context.Context, op byte, ext, in int) error {
+	req := make([]byte, 12)
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:], uint16(in))
+
+	if _, err := c.call(ctx, req, 16); err != nil {
+		return fmt.Errorf("natpmp unmap (%s %d): %w", protoName(op), ext, err)
+	}
+	c.logger.Debug("NAT-PMP port-mapping deleted", zap.String("proto", protoName(op)), zap.Int("outer", ext), zap.Int("inner", in))
+	return nil
+}
+
+// call 发送请求并等待操作码匹配的响应，按 RFC 6886 的退避策略重传
+func (c *Client) call(ctx context.Context, req []byte, resLen int) ([]byte, error) {
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: c.gateway, Port: Port})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	buf := make([]byte, 16)
+	timeout := initialTimeout
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(timeout))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				var ne net.Error
+				if errors.As(err, &ne) && ne.Timeout() {
+					break
+				}
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				return nil, err
+			}
+			if n < 4 || buf[0] != 0 || buf[1] != req[1]|0x80 {
+				continue
+			}
+			if code := binary.BigEndian.Uint16(buf[2:]); code != 0 {
+				return nil, ResultError(code)
+			}
+			if n < resLen {
+				return nil, fmt.Errorf("natpmp: short response (%d bytes)", n)
+			}
+			return buf[:n], nil
+		}
+		timeout *= 2
+	}
+	return nil, fmt.Errorf("natpmp: no response from %s", c.gateway)
+}
+
+func protoName(op byte) string {
+	if op == opMapTCP {
+		return "TCP"
+	}
+	return "UDP"
+}
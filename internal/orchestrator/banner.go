@@ -0,0 +1,83 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"natter/internal/status"
+
+	"go.uber.org/zap"
+)
+
+// readyTimeout bounds how long the ready summary waits for every open port to be mapped.
+const readyTimeout = time.Minute
+
+// readyWatch collects the first mapping of every open port for logReady.
+type readyWatch struct {
+	inners      []string      // "proto inner" keys in open_port order, formatted like the worker reports them
+	all         chan struct{} // closed once every key in inners has a mapping
+	unsubscribe func()
+
+	mu     sync.Mutex
+	outers map[string]string // inner key -> outer address
+}
+
+// watchReady subscribes to mapping updates for inners. Called from Start before the workers
+// start, so no first mapping can be missed: a mapping that does not change is not reported again.
+func (n *Natter) watchReady(inners []string) *readyWatch {
+	w := &readyWatch{inners: inners, all: make(chan struct{}), outers: make(map[string]string, len(inners))}
+	want := make(map[string]bool, len(inners))
+	for _, key := range inners {
+		want[key] = true
+	}
+	w.unsubscribe = n.statusMgr.Subscribe(func(ev status.UpdateEvent) {
+		key := ev.Protocol + " " + ev.InnerAddr
+		if ev.Removed || !want[key] {
+			return
+		}
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		before := len(w.outers)
+		w.outers[key] = ev.OuterAddr
+		if before < len(want) && len(w.outers) == len(want) {
+			close(w.all)
+		}
+	})
+	return w
+}
+
+// logReady logs one summary of all mappings once every open port has been mapped, or
+// with the ports still pending after readyTimeout, then drops the subscription.
+func (n *Natter) logReady(ctx context.Context, w *readyWatch) {
+	defer w.unsubscribe()
+	select {
+	case <-ctx.Done():
+		return
+	case <-w.all:
+	case <-n.clock.After(readyTimeout):
+	}
+
+	w.mu.Lock()
+	var mapped, pending []string
+	for _, key := range w.inners {
+		if outer, ok := w.outers[key]; ok {
+			mapped = append(mapped, fmt.Sprintf("%s -> %s", key, outer))
+		} else {
+			pending = append(pending, key)
+		}
+	}
+	w.mu.Unlock()
+
+	fields := []zap.Field{zap.Strings("mappings", mapped), zap.Stringer("bind_ip", n.bindIP)}
+	if ip := n.routerIP.Load(); ip != nil {
+		fields = append(fields, zap.Stringer("router_external_ip", *ip))
+	}
+	if len(pending) > 0 {
+		n.logger.Warn("Natter running, some ports have no mapping yet",
+			append(fields, zap.Strings("pending", pending), zap.Duration("waited", readyTimeout))...)
+		return
+	}
+	n.logger.Info("Natter ready", fields...)
+}
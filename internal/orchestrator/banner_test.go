@@ -0,0 +1,40 @@
+package orchestrator
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"natter/internal/status"
+)
+
+func TestWatchReadyCountsOnlyOpenPorts(t *testing.T) {
+	n := newTestNatter(t, testConfig(t))
+	w := n.watchReady([]string{"tcp 10.0.0.2:5000", "udp 10.0.0.2:5000"})
+	defer w.unsubscribe()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go n.statusMgr.Run(ctx)
+
+	// Mappings of other addresses must not complete the summary
+	n.statusMgr.Updates <- status.UpdateEvent{Protocol: "tcp", InnerAddr: "10.0.0.2:5000", OuterAddr: "203.0.113.7:5000"}
+	n.statusMgr.Updates <- status.UpdateEvent{Protocol: "udp", InnerAddr: "10.0.0.9:6000", OuterAddr: "203.0.113.7:6000"}
+	n.statusMgr.Updates <- status.UpdateEvent{Protocol: "tcp", InnerAddr: "10.0.0.9:7000", OuterAddr: "203.0.113.7:7000"}
+	select {
+	case <-w.all:
+		t.Fatal("summary completed before every open port was mapped")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	n.statusMgr.Updates <- status.UpdateEvent{Protocol: "udp", InnerAddr: "10.0.0.2:5000", OuterAddr: "203.0.113.7:5001"}
+	select {
+	case <-w.all:
+	case <-time.After(2 * time.Second):
+		t.Fatal("summary did not complete once every open port was mapped")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.outers) != 2 || w.outers["udp 10.0.0.2:5000"] != "203.0.113.7:5001" {
+		t.Fatalf("collected %v, want only the two open ports", w.outers)
+	}
+}
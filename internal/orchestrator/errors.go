@@ -0,0 +1,55 @@
+package orchestrator
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrNoPortsBound is matched (with errors.Is) by a fatal StartError: forwarders
+// were configured but none of them could listen.
+var ErrNoPortsBound = errors.New("none of the forwarded ports could be bound")
+
+// PortError is a forwarder that failed to listen on its port.
+type PortError struct {
+	Proto string // "tcp" or "udp"
+	Addr  string // listen address
+	Err   error
+}
+
+func (e *PortError) Error() string { return fmt.Sprintf("%s %s: %v", e.Proto, e.Addr, e.Err) }
+
+func (e *PortError) Unwrap() error { return e.Err }
+
+// StartError reports the forwarders that failed to start. When Fatal is true
+// no forwarder is listening and Start has left nothing running; otherwise
+// Natter keeps running without the failed ports.
+type StartError struct {
+	Failed []*PortError
+	Total  int // number of forwarders that were started
+	Fatal  bool
+}
+
+func (e *StartError) Error() string {
+	msgs := make([]string, len(e.Failed))
+	for i, f := range e.Failed {
+		msgs[i] = f.Error()
+	}
+	kind := "degraded"
+	if e.Fatal {
+		kind = "fatal"
+	}
+	return fmt.Sprintf("%s: %d of %d forwarders failed to start: %s", kind, len(e.Failed), e.Total, strings.Join(msgs, "; "))
+}
+
+// Unwrap exposes the port errors, and ErrNoPortsBound when the error is fatal.
+func (e *StartError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Failed)+1)
+	if e.Fatal {
+		errs = append(errs, ErrNoPortsBound)
+	}
+	for _, f := range e.Failed {
+		errs = append(errs, f)
+	}
+	return errs
+}
@@ -0,0 +1,113 @@
+package orchestrator
+
+import (
+	"testing"
+
+	"natter/internal/config"
+	"natter/internal/forward"
+)
+
+// targets builds a TargetList of plain targets without per-entry options.
+func targets(addrs ...string) config.TargetList {
+	list := make(config.TargetList, 0, len(addrs))
+	for _, a := range addrs {
+		list = append(list, config.ForwardTarget{Target: a})
+	}
+	return list
+}
+
+func TestForwardSpecs(t *testing.T) {
+	tests := []struct {
+		name    string
+		open    []string
+		targets config.TargetList
+		listen  []string
+	}{
+		{
+			name:    "equal length pairs by index",
+			open:    []string{"0.0.0.0:33887", "0.0.0.0:33888"},
+			targets: targets("10.0.0.2:80", "10.0.0.3:443"),
+			listen:  []string{"0.0.0.0:33887", "0.0.0.0:33888"},
+		},
+		{
+			name:    "fewer open ports listen on the target ports",
+			open:    []string{"0.0.0.0:33887"},
+			targets: targets("10.0.0.2:80", "10.0.0.3:443"),
+			listen:  []string{"0.0.0.0:80", "0.0.0.0:443"},
+		},
+		{
+			name:    "more open ports listen on the target ports",
+			open:    []string{"0.0.0.0:33887", "0.0.0.0:33888", "0.0.0.0:33889"},
+			targets: targets("10.0.0.2:80"),
+			listen:  []string{"0.0.0.0:80"},
+		},
+		{
+			name:    "no open ports listen on the target ports",
+			targets: targets("10.0.0.2:8080"),
+			listen:  []string{"0.0.0.0:8080"},
+		},
+		{
+			name: "no targets",
+			open: []string{"0.0.0.0:33887"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			specs := forwardSpecs(tt.open, tt.targets)
+			if len(specs) != len(tt.listen) {
+				t.Fatalf("got %d specs, want %d", len(specs), len(tt.listen))
+			}
+			for i, s := range specs {
+				if s.listen != tt.listen[i] || s.target.Target != tt.targets[i].Target {
+					t.Errorf("spec %d = %s -> %s, want %s -> %s", i, s.listen, s.target.Target, tt.listen[i], tt.targets[i].Target)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildForwardersPairing(t *testing.T) {
+	cfg := testConfig(t)
+	// TCP: counts match, one forwarder per open port
+	cfg.OpenPort.TCP = config.PortList{{Addr: "0.0.0.0:33887"}, {Addr: "0.0.0.0:33888"}}
+	cfg.ForwardPort.TCP = targets("10.0.0.2:80", "10.0.0.3:443")
+	// UDP: counts differ, the forwarder listens on the target port
+	cfg.OpenPort.UDP = config.PortList{{Addr: "0.0.0.0:33887"}, {Addr: "0.0.0.0:33888"}}
+	cfg.ForwardPort.UDP = targets("10.0.0.2:53")
+	n := newTestNatter(t, cfg)
+
+	tcp, udp, err := n.buildForwarders(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tcp) != 2 {
+		t.Fatalf("got %d TCP forwarders, want 2", len(tcp))
+	}
+	for i, want := range [][2]string{{"0.0.0.0:33887", "10.0.0.2:80"}, {"0.0.0.0:33888", "10.0.0.3:443"}} {
+		if tcp[i].ListenAddr != want[0] || tcp[i].TargetAddr != want[1] {
+			t.Errorf("TCP forwarder %d = %s -> %s, want %s -> %s", i, tcp[i].ListenAddr, tcp[i].TargetAddr, want[0], want[1])
+		}
+	}
+	if len(udp) != 1 || udp[0].ListenAddr != "0.0.0.0:53" || udp[0].TargetAddr != "10.0.0.2:53" {
+		t.Fatalf("UDP forwarders = %+v, want one 0.0.0.0:53 -> 10.0.0.2:53", udp)
+	}
+
+	// UDP with matching counts pairs by index like TCP
+	cfg.ForwardPort.UDP = targets("10.0.0.2:53", "10.0.0.3:5353")
+	if _, udp, err = n.buildForwarders(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(udp) != 2 || udp[0].ListenAddr != "0.0.0.0:33887" || udp[1].ListenAddr != "0.0.0.0:33888" || udp[1].TargetAddr != "10.0.0.3:5353" {
+		t.Fatalf("UDP forwarders = %+v, want 0.0.0.0:33887 -> 10.0.0.2:53 and 0.0.0.0:33888 -> 10.0.0.3:5353", udp)
+	}
+
+	// A forwarder in the reuse map is kept instead of being recreated
+	specs := forwardSpecs(cfg.OpenPort.TCP.Addrs(), cfg.ForwardPort.TCP)
+	tcp2, _, err := n.buildForwarders(map[string]*forward.TCPForwarder{specs[1].key(): tcp[1]}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tcp2[0] == tcp[0] || tcp2[1] != tcp[1] {
+		t.Fatal("buildForwarders did not reuse exactly the forwarder whose spec matched")
+	}
+}
@@ -2,43 +2,182 @@ package orchestrator
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/proxy"
 
+	"natter/internal/clock"
 	"natter/internal/config"
 	"natter/internal/forward"
 	"natter/internal/keepalive"
+	"natter/internal/metrics"
 	"natter/internal/status"
 	"natter/internal/stun"
-	"natter/internal/upnp"
 )
 
 // Natter is the core orchestrator: sets up port mapping, forwarding, keep-alive, and status updates.
+//
+// mu guards everything Reload replaces: cfg, the poll settings, the open ports, the
+// forwarders and the per-port tasks. Long-running goroutines receive copies of what they
+// need when they are started, so a reload restarts them instead of mutating their state.
 type Natter struct {
+	mu         sync.Mutex
 	cfg        *config.Config
 	logger     *zap.Logger
+	audit      *zap.Logger // accepted clients, see WithAuditLogger
 	stunClient *stun.Client
+	stunDemux  *stun.Demux // hands STUN responses read by UDP forwarders back to share_socket queries
 	statusMgr  *status.StatusManager
 	interval   time.Duration
+	maxPoll    time.Duration // upper bound of the STUN poll backoff while the mapping is stable
+	jitter     float64       // random ± ratio applied to every poll and keep-alive wait
+	clock      clock.Clock
 
 	tcpOpens []net.TCPAddr
 	udpOpens []net.UDPAddr
 	tcpFwds  []*forward.TCPForwarder
 	udpFwds  []*forward.UDPForwarder
 	bindIP   net.IP
+
+	portIntervals map[string]time.Duration // per-port interval overrides from open_port, keyed by taskKey
+	externalPorts map[string]int           // router external ports from open_port, keyed by taskKey; absent means same as internal
+
+	serverLists    map[string][]string // last good STUN server list fetched from each stun_server URL
+	serverListKick chan struct{}       // asks refreshServerLists to fetch now, see Reload
+
+	bindProbes []string               // UDP destinations used to find the outbound interface, tried in order
+	outboundIP atomic.Pointer[net.IP] // cached result of the first successful probe
+	udpPayload keepalive.Payload
+	proxy      proxy.ContextDialer // SOCKS5 dialer for TCP STUN and keep-alive, nil when proxy is unset
+	rates      rateLimits
+	metrics    *metrics.Exporter // nil unless metrics_addr is set
+
+	routerIP         atomic.Pointer[net.IP] // WAN address reported by the port-mapping router, nil until known
+	routerIPMismatch sync.Once
+
+	runCtx      context.Context  // the ctx passed to Start, parent of every task
+	portMapping sync.WaitGroup   // the port-mapping goroutine, which removes mappings on exit
+	tasks       map[string]*task // keep-alive and STUN worker goroutines, keyed by taskKey
+}
+
+// defaultWebhookRetries is used when a webhook does not set its own retry count.
+const defaultWebhookRetries = 3
+
+// statusOptions translates status_report into status manager options, one hook option per entry.
+func statusOptions(cfg *config.Config) []status.Option {
+	sr := cfg.StatusReport
+	retries := func(r *int) int {
+		if r != nil {
+			return *r
+		}
+		return defaultWebhookRetries
+	}
+	opts := []status.Option{
+		status.WithHookTimeout(time.Duration(sr.HookTimeout) * time.Second),
+		status.WithStaleAfter(staleAfter(cfg)),
+		status.WithFormat(status.Format(sr.Format)),
+	}
+	for _, h := range sr.Hook {
+		if h.Webhook != "" {
+			timeout := h.Timeout
+			if timeout == 0 {
+				timeout = sr.WebhookTimeout
+			}
+			opts = append(opts, status.WithWebhook(h.Webhook, time.Duration(timeout)*time.Second, retries(h.Retries)))
+		} else {
+			opts = append(opts, status.WithCommandHook(h.Command, time.Duration(h.Timeout)*time.Second))
+		}
+	}
+	opts = append(opts, status.WithWebhook(sr.WebhookURL, time.Duration(sr.WebhookTimeout)*time.Second, retries(sr.WebhookRetries)))
+	return opts
+}
+
+// defaultStaleIntervals is how many poll periods a mapping may go unconfirmed before it is pruned.
+const defaultStaleIntervals = 10
+
+// staleAfter converts status_report.stale_intervals into a duration. The poll period is
+// the longest wait between STUN checks, i.e. stun_max_interval when backoff is enabled.
+func staleAfter(cfg *config.Config) time.Duration {
+	n := cfg.StatusReport.StaleIntervals
+	if n < 0 {
+		return 0
+	}
+	if n == 0 {
+		n = defaultStaleIntervals
+	}
+	period := time.Duration(cfg.Interval) * time.Second
+	if maxPoll := time.Duration(cfg.StunMaxInterval) * time.Second; maxPoll > period {
+		period = maxPoll
+	}
+	if period <= 0 {
+		return 0
+	}
+	return time.Duration(n) * period
+}
+
+// rateLimits holds the parsed forward rate limits in bytes per second.
+type rateLimits struct {
+	up, down, conn int64
+}
+
+// parseRateLimits resolves forward.rate_limit and its per-direction overrides.
+func parseRateLimits(f config.ForwardOptions) (rateLimits, error) {
+	var r rateLimits
+	both, err := config.ParseByteSize(f.RateLimit)
+	if err != nil {
+		return r, fmt.Errorf("forward.rate_limit: %w", err)
+	}
+	r.up, r.down = both, both
+	if f.RateLimitUp != "" {
+		if r.up, err = config.ParseByteSize(f.RateLimitUp); err != nil {
+			return r, fmt.Errorf("forward.rate_limit_up: %w", err)
+		}
+	}
+	if f.RateLimitDown != "" {
+		if r.down, err = config.ParseByteSize(f.RateLimitDown); err != nil {
+			return r, fmt.Errorf("forward.rate_limit_down: %w", err)
+		}
+	}
+	if r.conn, err = config.ParseByteSize(f.ConnRateLimit); err != nil {
+		return r, fmt.Errorf("forward.conn_rate_limit: %w", err)
+	}
+	return r, nil
 }
 
 // New creates a Natter instance with configuration and logger.
-func New(cfg *config.Config, logger *zap.Logger) (*Natter, error) {
-	// Initialize STUN client
-	stunCli := stun.NewClient(cfg.StunServer.TCP, cfg.StunServer.UDP, time.Second, logger)
+func New(cfg *config.Config, logger *zap.Logger, opts ...Option) (*Natter, error) {
+	socks, err := proxyDialer(cfg.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	// Initialize STUN client; server list URLs are fetched in Start
+	stunCli := stun.NewClient(expandServers(cfg.StunServer.TCP, nil), expandServers(cfg.StunServer.UDP, nil), time.Second, logger,
+		stun.WithRace(cfg.StunServer.Race),
+		stun.WithFamily(cfg.StunServer.Family),
+		stun.WithCredentials(cfg.StunServer.Username, cfg.StunServer.Password, cfg.StunServer.Realm),
+		stun.WithProxy(socks),
+	)
+	udpPayload, err := keepalive.ParsePayload(cfg.KeepAliveUDP)
+	if err != nil {
+		return nil, err
+	}
+	rates, err := parseRateLimits(cfg.Forward)
+	if err != nil {
+		return nil, err
+	}
 	// Initialize status manager
-	sm, err := status.NewManager(cfg.StatusReport.StatusFile, cfg.StatusReport.Hook, logger)
+	sm, err := status.NewManager(cfg.StatusReport.StatusFile, "", logger, statusOptions(cfg)...)
 	if err != nil {
 		return nil, err
 	}
@@ -46,177 +185,885 @@ func New(cfg *config.Config, logger *zap.Logger) (*Natter, error) {
 	n := &Natter{
 		cfg:        cfg,
 		logger:     logger,
+		audit:      zap.NewNop(),
 		stunClient: stunCli,
+		stunDemux:  stun.NewDemux(),
 		statusMgr:  sm,
 		interval:   time.Duration(cfg.Interval) * time.Second,
+		maxPoll:    time.Duration(cfg.StunMaxInterval) * time.Second,
+		jitter:     cfg.JitterRatio(),
+		clock:      clock.New(),
+		udpPayload: udpPayload,
+		proxy:      socks,
+		rates:      rates,
+		bindProbes: cfg.BindProbe,
+
+		serverListKick: make(chan struct{}, 1),
+	}
+	if len(n.bindProbes) == 0 {
+		n.bindProbes = defaultBindProbes
+	}
+	if cfg.BindIP != "" || cfg.BindInterface != "" {
+		var ip net.IP
+		if cfg.BindIP != "" {
+			ip, err = localIP(cfg.BindIP)
+		} else {
+			ip, err = interfaceIP(cfg.BindInterface)
+		}
+		if err != nil {
+			return nil, err
+		}
+		// an explicit bind IP replaces the probe everywhere, including inner addresses
+		n.bindIP = ip
+		n.outboundIP.Store(&ip)
+	}
+	for _, opt := range opts {
+		opt(n)
 	}
 
-	// Parse open ports
-	for _, a := range cfg.OpenPort.TCP {
-		h, p := splitAddr(a)
-		n.tcpOpens = append(n.tcpOpens, net.TCPAddr{IP: net.ParseIP(h), Port: p})
+	n.parseOpenPorts()
+	if n.tcpFwds, n.udpFwds, err = n.buildForwarders(nil, nil); err != nil {
+		return nil, err
 	}
-	for _, a := range cfg.OpenPort.UDP {
-		h, p := splitAddr(a)
-		n.udpOpens = append(n.udpOpens, net.UDPAddr{IP: net.ParseIP(h), Port: p})
+
+	return n, nil
+}
+
+// proxyDialer builds the SOCKS5 dialer for the proxy setting, or returns nil when it is empty.
+// Only TCP can go through it: golang.org/x/net/proxy does not implement UDP ASSOCIATE.
+func proxyDialer(raw string) (proxy.ContextDialer, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: %w", err)
+	}
+	d, err := proxy.FromURL(u, &net.Dialer{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("proxy: %w", err)
 	}
+	cd, ok := d.(proxy.ContextDialer)
+	if !ok {
+		return nil, fmt.Errorf("proxy: %s dialer does not support contexts", u.Scheme)
+	}
+	return cd, nil
+}
 
-	// Prepare forwarders
-	if len(cfg.OpenPort.TCP) == len(cfg.ForwardPort.TCP) {
-		// 一一对应模式
-		for i, target := range cfg.ForwardPort.TCP {
-			listenAddr := cfg.OpenPort.TCP[i] // e.g. "0.0.0.0:33887"
-			fwd := forward.NewTCPForwarder(listenAddr, target, logger)
-			n.tcpFwds = append(n.tcpFwds, fwd)
+// newTCPForwarder creates a TCP forwarder with the options from cfg.Forward applied,
+// overridden by any per-target settings.
+func (n *Natter) newTCPForwarder(listenAddr string, target config.ForwardTarget) (*forward.TCPForwarder, error) {
+	acl, err := n.forwardACL(target)
+	if err != nil {
+		return nil, err
+	}
+	fwd := forward.NewTCPForwarder(listenAddr, target.Target, n.logger)
+	fwd.ACL = acl
+	if n.cfg.Forward.IdleTimeout > 0 {
+		fwd.IdleTimeout = time.Duration(n.cfg.Forward.IdleTimeout) * time.Second
+	}
+	fwd.MaxConns = n.cfg.Forward.MaxConns
+	fwd.Balance = n.cfg.Forward.Balance
+	hc := n.cfg.Forward.HealthCheck
+	fwd.HealthCheck = forward.HealthCheck{
+		Interval:  time.Duration(hc.Interval) * time.Second,
+		Threshold: hc.Threshold,
+		HTTPPath:  hc.HTTPPath,
+	}
+	fwd.RateLimitUp, fwd.RateLimitDown, fwd.ConnRateLimit = n.rates.up, n.rates.down, n.rates.conn
+	fwd.ProxyProtocol = n.cfg.Forward.ProxyProtocol
+	if target.ProxyProtocol != "" {
+		fwd.ProxyProtocol = target.ProxyProtocol
+	}
+	if n.cfg.Forward.DialTimeout > 0 {
+		fwd.DialTimeout = time.Duration(n.cfg.Forward.DialTimeout) * time.Second
+	}
+	if acme := target.TLS.ACME; len(acme.Domain) > 0 {
+		m := acmeManager(acme)
+		fwd.TLS = m.TLSConfig()
+		if acme.HTTPAddr != "" {
+			fwd.ChallengeAddr, fwd.ChallengeHandler = acme.HTTPAddr, m.HTTPHandler(nil)
 		}
-	} else {
-		// 旧逻辑：监听目标端口
-		for _, target := range cfg.ForwardPort.TCP {
-			listenAddr := "0.0.0.0:" + portOf(target)
-			fwd := forward.NewTCPForwarder(listenAddr, target, logger)
-			n.tcpFwds = append(n.tcpFwds, fwd)
+	} else if target.TLS.Enabled() {
+		if fwd.TLS, err = loadTLSConfig(target.TLS); err != nil {
+			return nil, err
+		}
+	}
+	fwd.DumpBytes = n.cfg.Forward.DumpBytes
+	fwd.Audit = n.audit
+	fwd.Resolver = n.targetResolver()
+	fwd.FallbackDelay = time.Duration(n.cfg.Forward.FallbackDelayMs) * time.Millisecond
+	fwd.DialRetries = n.cfg.Forward.DialRetries
+	fwd.DialRetryDelay = time.Duration(n.cfg.Forward.DialRetryDelay) * time.Second
+	if fwd.DialRetryDelay <= 0 {
+		fwd.DialRetryDelay = defaultDialRetryDelay
+	}
+	return fwd, nil
+}
+
+// loadTLSConfig loads the certificates for a TLS-terminating forwarder. With several
+// certificates crypto/tls picks the one matching the client's SNI.
+func loadTLSConfig(c config.TLSConfig) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	for _, p := range c.Pairs() {
+		cert, err := tls.LoadX509KeyPair(p.Cert, p.Key)
+		if err != nil {
+			return nil, fmt.Errorf("load TLS certificate %s: %w", p.Cert, err)
 		}
+		cfg.Certificates = append(cfg.Certificates, cert)
 	}
+	return cfg, nil
+}
 
-	return n, nil
+// defaultACMECacheDir holds issued certificates and the account key when acme.cache_dir is unset.
+const defaultACMECacheDir = "acme-cache"
+
+// acmeManager returns an autocert manager that obtains and renews certificates for the
+// configured domains only. Its TLS config also answers TLS-ALPN-01 challenges.
+func acmeManager(c config.ACMEConfig) *autocert.Manager {
+	dir := c.CacheDir
+	if dir == "" {
+		dir = defaultACMECacheDir
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(c.Domain...),
+		Cache:      autocert.DirCache(dir),
+		Email:      c.Email,
+	}
+}
+
+// defaultDialRetryDelay is the first wait between target dial retries when forward.dial_retry_delay is unset.
+const defaultDialRetryDelay = time.Second
+
+// newUDPForwarder creates a UDP forwarder with the options from cfg.Forward applied,
+// overridden by any per-target settings.
+func (n *Natter) newUDPForwarder(listenAddr string, target config.ForwardTarget) (*forward.UDPForwarder, error) {
+	acl, err := n.forwardACL(target)
+	if err != nil {
+		return nil, err
+	}
+	// idle timeout; an explicit 0 keeps sessions until the forwarder stops or udp_idle_ttl evicts them
+	timeout := config.DefaultUDPTimeout * time.Second
+	if t := n.cfg.Forward.UDPTimeout; t != nil {
+		timeout = time.Duration(*t) * time.Second
+	}
+	fwd := forward.NewUDPForwarder(listenAddr, target.Target, timeout, n.cfg.Forward.UDPBufferSize, n.logger)
+	fwd.ACL = acl
+	fwd.IdleTTL = time.Duration(n.cfg.Forward.UDPIdleTTL) * time.Second
+	fwd.Clock = n.clock
+	if n.cfg.Forward.DialTimeout > 0 {
+		fwd.DialTimeout = time.Duration(n.cfg.Forward.DialTimeout) * time.Second
+	}
+	fwd.MaxClients = n.cfg.Forward.UDPMaxClients
+	fwd.SourcePort = n.cfg.Forward.UDPSourcePort
+	fwd.DumpBytes = n.cfg.Forward.DumpBytes
+	fwd.SendBuffer = n.cfg.Forward.UDPSndBuf
+	fwd.RecvBuffer = n.cfg.Forward.UDPRcvBuf
+	fwd.Resolver = n.targetResolver()
+	// Always installed so share_socket can be toggled by a reload; it only parses
+	// datagrams while a shared STUN query is in flight.
+	fwd.Intercept = n.stunDemux.Handle
+	fwd.Audit = n.audit
+	return fwd, nil
+}
+
+// targetResolver returns a per-forwarder resolver for dns_cache_ttl and target_family,
+// or nil when neither is set so targets are resolved on every dial as before.
+func (n *Natter) targetResolver() *forward.Resolver {
+	return forward.NewResolver(time.Duration(n.cfg.Forward.DNSCacheTTL)*time.Second, n.cfg.Forward.TargetFamily)
 }
 
+// forwardACL builds the source address ACL for target, falling back to the global lists.
+func (n *Natter) forwardACL(target config.ForwardTarget) (*forward.ACL, error) {
+	allow, deny := n.cfg.Forward.AllowCIDRs, n.cfg.Forward.DenyCIDRs
+	if target.AllowCIDRs != nil {
+		allow = target.AllowCIDRs
+	}
+	if target.DenyCIDRs != nil {
+		deny = target.DenyCIDRs
+	}
+	acl, err := forward.ParseACL(allow, deny)
+	if err != nil {
+		return nil, fmt.Errorf("forward %s: %w", target.Target, err)
+	}
+	return acl, nil
+}
+
+// portOf returns the port of addr; for a comma-separated target list the first entry is used.
 func portOf(addr string) string {
+	if i := strings.Index(addr, ","); i >= 0 {
+		addr = addr[:i]
+	}
 	idx := strings.LastIndex(addr, ":")
 	return addr[idx+1:]
 }
 
-// Run starts UPnP mapping, status manager, forwarders, keep-alive, and STUN workers until context cancel.
-func (n *Natter) Run(ctx context.Context) {
+// Start binds the forwarders and starts UPnP mapping, the status manager, keep-alive
+// and STUN workers, then returns; everything runs until ctx is done (see Wait).
+// If forwarders fail to listen a *StartError is returned. It is fatal
+// (errors.Is(err, ErrNoPortsBound)) when none of them could be started: nothing is
+// left running and Wait must not be called. Otherwise Natter keeps running
+// without the failed ports.
+func (n *Natter) Start(ctx context.Context) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.runCtx = ctx
 	if n.bindIP == nil || n.bindIP.IsUnspecified() {
-		n.bindIP = n.getOutboundIP() // 建议换成固定 DNS，如 "119.29.29.29:53" 的探路实现
+		n.bindIP = n.getOutboundIP()
 	}
 	n.logger.Info("bind ip decided", zap.String("bind_ip", n.bindIP.String()))
 	n.stunClient.SetBindIP(n.bindIP)
 
-	// UPnP port mapping if enabled
-	if n.cfg.EnableUPnP {
-		cli, err := upnp.Discover(n.logger)
-		if err != nil {
-			n.logger.Warn("UPnP discovery failed", zap.Error(err))
-		} else {
-			for _, addr := range n.tcpOpens {
-				// Determine actual inner IP (replace 0.0.0.0)
-				innerIP := addr.IP.String()
-				if addr.IP.IsUnspecified() {
-					innerIP = n.getOutboundIP().String()
-				}
-				// Add UPnP mapping: external and internal ports are the same
-				if err := cli.AddTCP(addr.Port, addr.Port, innerIP, 0); err != nil {
-					n.logger.Warn("UPnP AddTCP failed", zap.Int("port", addr.Port), zap.Error(err))
-				} else {
-					n.logger.Info("UPnP TCP map added", zap.String("inner", fmt.Sprintf("%s:%d", innerIP, addr.Port)), zap.Int("port", addr.Port))
-				}
-			}
-			for _, addr := range n.udpOpens {
-				// Determine actual inner IP (replace 0.0.0.0)
-				innerIP := addr.IP.String()
-				if addr.IP.IsUnspecified() {
-					innerIP = n.getOutboundIP().String()
-				}
-				// Add UPnP mapping for UDP
-				if err := cli.AddUDP(addr.Port, addr.Port, innerIP, 0); err != nil {
-					n.logger.Warn("UPnP AddUDP failed", zap.Int("port", addr.Port), zap.Error(err))
-				} else {
-					n.logger.Info("UPnP UDP map added", zap.String("inner", fmt.Sprintf("%s:%d", innerIP, addr.Port)), zap.Int("port", addr.Port))
-				}
-			}
+	// Start forwarders first so a setup that cannot bind anything fails before the rest starts
+	var startErr error
+	if failed := n.startForwarders(n.tcpFwds, n.udpFwds); len(failed) > 0 {
+		total := len(n.tcpFwds) + len(n.udpFwds)
+		se := &StartError{Failed: failed, Total: total, Fatal: len(failed) == total}
+		if se.Fatal {
+			n.runCtx = nil // not running; Reload refuses to apply
+			return se
 		}
+		n.logger.Warn("Some forwarders failed to start, continuing without them", zap.Error(se))
+		startErr = se
+	}
+
+	// Fetch the STUN server lists before the first query; failures leave them empty until the next refresh
+	if urls := serverListURLs(n.cfg); len(urls) > 0 {
+		n.serverLists = n.fetchServerLists(ctx, urls, nil)
+		n.applyServerLists()
+	}
+	go n.refreshServerLists(ctx)
+
+	if len(n.cfg.StunServer.UDP) > 0 {
+		go n.logNATBehavior(ctx)
+	}
+
+	// UPnP port mapping if enabled; discovery may retry, so it runs in the background
+	if n.cfg.EnableUPnP {
+		n.portMapping.Add(1)
+		go func() {
+			defer n.portMapping.Done()
+			n.runPortMapping(ctx)
+		}()
 	}
 
 	// Start status manager
 	go n.statusMgr.Run(ctx)
+	if inners := n.openInners(); len(inners) > 0 {
+		// subscribe here, before startTasks, so the first mappings reach the summary
+		go n.logReady(ctx, n.watchReady(inners))
+	}
+	if addr := n.cfg.MetricsAddr; addr != "" {
+		n.metrics = metrics.New(metrics.Sources{
+			Mappings:   n.statusMgr.MappingCounts,
+			STUN:       n.stunClient.Stats,
+			Forwarders: n.forwardStats,
+		})
+		go func() {
+			if err := n.metrics.Serve(ctx, addr, n.logger); err != nil {
+				n.logger.Warn("Metrics server failed", zap.String("addr", addr), zap.Error(err))
+			}
+		}()
+	}
+	if addr := n.cfg.StatusReport.HTTPAddr; addr != "" {
+		go func() {
+			if err := n.statusMgr.Serve(ctx, addr); err != nil {
+				n.logger.Warn("Status HTTP server failed", zap.String("addr", addr), zap.Error(err))
+			}
+		}()
+	}
+	go n.logSTUNStats(ctx, n.interval)
+	if s := n.cfg.StatsInterval; s > 0 {
+		go n.logStats(ctx, time.Duration(s)*time.Second)
+	}
 
-	// Start forwarders
-	for _, fw := range n.tcpFwds {
-		if err := fw.Start(ctx); err != nil {
+	if n.cfg.StatusReport.ForwardStats && len(n.tcpFwds)+len(n.udpFwds) > 0 {
+		go n.reportForwardStats(ctx, n.interval)
+	}
+
+	// Open port tasks: keep-alive + mapping detection
+	n.tasks = map[string]*task{}
+	n.logSTUNDisabled()
+	n.startTasks()
+	return startErr
+}
+
+// Wait blocks until the ctx passed to Start is done, then stops the forwarders and
+// waits for port mappings to be removed.
+func (n *Natter) Wait() {
+	n.mu.Lock()
+	ctx := n.runCtx
+	n.mu.Unlock()
+	<-ctx.Done()
+	n.logger.Info("Natter shutting down")
+	n.mu.Lock()
+	n.stopForwarders(n.tcpFwds, n.udpFwds, time.Duration(n.cfg.ShutdownTimeout)*time.Second)
+	n.mu.Unlock()
+	n.portMapping.Wait() // mappings are deleted once ctx is done
+}
+
+// Run starts Natter and blocks until ctx is done. It returns a fatal *StartError
+// without blocking when no forwarder could be started; partial failures are logged
+// and Run keeps going.
+func (n *Natter) Run(ctx context.Context) error {
+	if err := n.Start(ctx); err != nil {
+		var se *StartError
+		if errors.As(err, &se) && se.Fatal {
+			return err
+		}
+	}
+	n.Wait()
+	return nil
+}
+
+// startForwarders starts the given forwarders; a forwarder that fails to listen is logged,
+// skipped and returned.
+func (n *Natter) startForwarders(tcp []*forward.TCPForwarder, udp []*forward.UDPForwarder) []*PortError {
+	var failed []*PortError
+	for _, fw := range tcp {
+		if err := fw.Start(n.runCtx); err != nil {
 			n.logger.Warn("TCP forwarder start failed", zap.Error(err))
+			failed = append(failed, &PortError{Proto: "tcp", Addr: fw.ListenAddr, Err: err})
 		}
 	}
-	for _, fw := range n.udpFwds {
-		if err := fw.Start(ctx); err != nil {
+	for _, fw := range udp {
+		if err := fw.Start(n.runCtx); err != nil {
 			n.logger.Warn("UDP forwarder start failed", zap.Error(err))
+			failed = append(failed, &PortError{Proto: "udp", Addr: fw.ListenAddr, Err: err})
 		}
 	}
+	return failed
+}
 
-	// Open port tasks: keep-alive + mapping detection
-	for _, a := range n.tcpOpens {
-		addr := a // ✅ 复制一份，避免 &addr 指向同一个循环变量
-		// keepalive 绑定到“真实本地 IP:监听端口”
-		laddr := &net.TCPAddr{IP: n.bindIP, Port: addr.Port}
-		go keepalive.TCPKeepAlive(ctx, laddr, n.cfg.KeepAlive, n.interval, n.logger)
-		go n.runWorker(ctx, "tcp", &addr)
-	}
-	for _, a := range n.udpOpens {
-		// Listen for UDP Keep-Alive
-		addr := a
-		pc, err := net.ListenPacket("udp", addr.String())
-		if err != nil {
-			n.logger.Warn("UDP listen failed", zap.Error(err))
-		} else {
-			go keepalive.UDPKeepAlive(ctx, pc, n.cfg.KeepAlive, addr.Port, n.interval, n.logger)
+// forceCloseWait bounds how long stopForwarders waits for goroutines to exit
+// after their connections were forcibly closed.
+const forceCloseWait = 2 * time.Second
+
+// stopForwarders closes the listeners of the given forwarders and waits for their goroutines
+// to finish. If they have not drained after grace (<= 0 means wait indefinitely), open TCP
+// connections are closed forcibly and it returns shortly after.
+func (n *Natter) stopForwarders(tcp []*forward.TCPForwarder, udp []*forward.UDPForwarder, grace time.Duration) {
+	var wg sync.WaitGroup
+	for _, fw := range tcp {
+		wg.Add(1)
+		go func(fw *forward.TCPForwarder) {
+			defer wg.Done()
+			fw.Stop()
+		}(fw)
+	}
+	for _, fw := range udp {
+		wg.Add(1)
+		go func(fw *forward.UDPForwarder) {
+			defer wg.Done()
+			fw.Stop()
+		}(fw)
+	}
+	if grace <= 0 {
+		wg.Wait()
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-time.After(grace):
+	}
+	closed := 0
+	for _, fw := range tcp {
+		closed += fw.ForceClose()
+	}
+	n.logger.Warn("Grace period expired, forcibly closed connections",
+		zap.Duration("grace", grace), zap.Int("connections", closed))
+	select {
+	case <-done:
+	case <-time.After(forceCloseWait):
+		n.logger.Warn("Forwarders did not stop after forced close, exiting anyway")
+	}
+}
+
+// udpForwarderConn returns the socket of a started UDP forwarder listening on port, or nil.
+func (n *Natter) udpForwarderConn(port int) net.PacketConn {
+	for _, fw := range n.udpFwds {
+		if pc := fw.PacketConn(); pc != nil && pc.LocalAddr().(*net.UDPAddr).Port == port {
+			return pc
 		}
-		// Run STUN worker
-		go n.runWorker(ctx, "udp", &addr)
 	}
+	return nil
+}
 
-	// Block until context done
-	<-ctx.Done()
-	n.logger.Info("Natter shutting down")
+// sharedSocket returns the forwarder socket the UDP STUN worker for port should query
+// through when stun_server.share_socket is set, or nil to bind a socket per query as usual.
+// Called with n.mu held.
+func (n *Natter) sharedSocket(port int) net.PacketConn {
+	if !n.cfg.StunServer.ShareSocket {
+		return nil
+	}
+	pc := n.udpForwarderConn(port)
+	if pc == nil {
+		n.logger.Info("share_socket: no UDP forwarder on this port, STUN binds its own socket", zap.Int("port", port))
+	}
+	return pc
+}
+
+// keepAliveOpts returns the options shared by all keep-alive loops.
+// A keep-alive failure is signalled on kick so the port's worker re-checks its mapping,
+// and every attempt is reported to the status manager under proto/local.
+func (n *Natter) keepAliveOpts(proto, local string, kick chan<- struct{}) []keepalive.Option {
+	return []keepalive.Option{
+		keepalive.WithReporter(n.reportKeepAlive(proto, local)),
+		keepalive.WithClock(n.clock),
+		keepalive.WithJitter(n.jitter),
+		keepalive.WithPort(n.cfg.KeepAlivePort),
+		keepalive.WithScheme(n.cfg.KeepAliveScheme),
+		keepalive.WithRequest(n.cfg.KeepAliveReq.Method, n.cfg.KeepAliveReq.Path, n.cfg.KeepAliveReq.Headers),
+		keepalive.WithPayload(n.udpPayload),
+		keepalive.WithDialer(n.proxy),
+		keepalive.WithFailureHook(func() {
+			select {
+			case kick <- struct{}{}:
+			default:
+			}
+		}),
+	}
+}
+
+// reportKeepAlive forwards keep-alive results to the status manager without blocking the loop.
+func (n *Natter) reportKeepAlive(proto, local string) func(keepalive.Report) {
+	return func(r keepalive.Report) {
+		ev := status.KeepAliveEvent{Protocol: proto, LocalAddr: local, Remote: r.Remote, OK: r.OK, Unconfirmed: r.Unconfirmed, Time: r.Time}
+		if r.Err != nil {
+			ev.Error = r.Err.Error()
+		}
+		if !r.OK && n.metrics != nil {
+			n.metrics.KeepAliveFailed(proto)
+		}
+		select {
+		case n.statusMgr.KeepAlives <- ev:
+		default:
+		}
+	}
 }
 
-// runWorker polls STUN for mapping and pushes updates.
-func (n *Natter) runWorker(ctx context.Context, proto string, addr net.Addr) {
+// runWorker polls STUN for mapping and pushes updates. UDP queries go through shared,
+// the port's forwarder socket, when it is non-nil (see sharedSocket).
+// While the mapping stays unchanged the poll interval backs off up to maxPoll;
+// a change, a STUN failure or a keep-alive failure (signalled on kick) resets it.
+func (n *Natter) runWorker(ctx context.Context, proto string, addr net.Addr, shared net.PacketConn, kick <-chan struct{}, poll pollSettings) {
 	inner := formatInner(addr, n.getOutboundIP())
 	lastOuter := ""
+	poll.interval = minPollInterval(poll.interval)
+	wait := poll.interval
+	var sym symmetricDetector
 	for {
+		res, err := n.queryMapping(ctx, proto, addr, shared)
+		if ctx.Err() != nil {
+			return
+		}
 		var outer string
-		var err error
-		if proto == "tcp" {
-			res, e := n.stunClient.GetTCPMapping(addr.(*net.TCPAddr).Port)
-			err = e
-			if err == nil {
-				outer = fmt.Sprintf("%s:%d", res.ExternalIP, res.ExternalPort)
+		if err == nil {
+			outer = res.ExternalAddr()
+		}
+		switch {
+		case err != nil:
+			n.logger.Debug("STUN mapping failed", zap.String("proto", proto), zap.Error(err))
+			wait = poll.interval
+		default:
+			symmetric, first := sym.observe(res.InternalPort, res.ExternalPort)
+			if first {
+				n.logger.Warn("External port differs from the local port and changes on every check: "+
+					"the NAT looks symmetric, so peers cannot reach the published address and Natter cannot help on this network",
+					zap.String("proto", proto), zap.String("inner", inner), zap.String("outer", outer))
 			}
-		} else {
-			res, e := n.stunClient.GetUDPMapping(addr.(*net.UDPAddr).Port)
-			err = e
-			if err == nil {
-				outer = fmt.Sprintf("%s:%d", res.ExternalIP, res.ExternalPort)
+			// 每次成功检测都上报，状态管理器据此刷新 last_updated；只有变化时才触发 Hook
+			n.statusMgr.Updates <- status.UpdateEvent{Protocol: proto, InnerAddr: inner, OuterAddr: outer, Symmetric: symmetric}
+			n.checkRouterIP(outer)
+			if outer != lastOuter {
+				lastOuter = outer
+				wait = poll.interval
+			} else {
+				wait = poll.next(wait)
 			}
 		}
-		if err != nil {
-			n.logger.Debug("STUN mapping failed", zap.String("proto", proto), zap.Error(err))
-		} else if outer != lastOuter {
-			n.statusMgr.Updates <- status.UpdateEvent{Protocol: proto, InnerAddr: inner, OuterAddr: outer}
-			lastOuter = outer
+		select {
+		case <-ctx.Done():
+			return
+		case <-kick:
+			n.logger.Debug("Keep-alive failure observed, re-checking mapping", zap.String("proto", proto), zap.String("inner", inner))
+			wait = poll.interval
+		case <-n.clock.After(clock.Jitter(wait, poll.jitter)):
+		}
+	}
+}
+
+// stunAttempts is how many times a worker tick queries STUN before the tick counts as failed;
+// stunRetryDelay is the wait before the first retry and doubles after each one.
+const (
+	stunAttempts   = 3
+	stunRetryDelay = 500 * time.Millisecond
+)
+
+// queryMapping asks the STUN servers for the mapping of addr, retrying quickly so that a
+// single lost packet does not delay detection by a whole poll interval.
+func (n *Natter) queryMapping(ctx context.Context, proto string, addr net.Addr, shared net.PacketConn) (*stun.Mapping, error) {
+	delay := stunRetryDelay
+	for attempt := 1; ; attempt++ {
+		var res *stun.Mapping
+		var err error
+		switch {
+		case proto == "tcp":
+			res, err = n.stunClient.GetTCPMapping(ctx, addr.(*net.TCPAddr).Port)
+		case shared != nil:
+			res, err = n.stunClient.GetUDPMappingShared(ctx, shared, n.stunDemux)
+		default:
+			res, err = n.stunClient.GetUDPMapping(ctx, addr.(*net.UDPAddr).Port)
 		}
+		if err == nil || attempt >= stunAttempts {
+			return res, err
+		}
+		n.logger.Debug("STUN mapping failed, retrying", zap.String("proto", proto), zap.Int("attempt", attempt),
+			zap.Duration("delay", delay), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-n.clock.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// symmetricThreshold is how many consecutive checks must show the symmetric-NAT
+// signature before a mapping is reported as symmetric.
+const symmetricThreshold = 3
+
+// symmetricDetector tracks one worker's STUN results. A NAT that translates the
+// port is fine as long as the external port is stable; a symmetric NAT picks a
+// new external port for every destination, so successive checks (which may hit
+// different servers) keep returning different ports.
+type symmetricDetector struct {
+	lastPort int
+	streak   int
+	warned   bool
+}
+
+// observe records one result and reports whether the mapping currently looks
+// symmetric, and whether this is the first time it does.
+func (d *symmetricDetector) observe(local, external int) (symmetric, first bool) {
+	if external != local && d.lastPort != 0 && external != d.lastPort {
+		d.streak++
+	} else {
+		d.streak = 0
+	}
+	d.lastPort = external
+	symmetric = d.streak >= symmetricThreshold
+	if symmetric && !d.warned {
+		d.warned = true
+		return true, true
+	}
+	return symmetric, false
+}
+
+// minPollInterval keeps a zero or negative interval from turning the STUN
+// poll into a busy loop; it mirrors keepalive's 5 second floor.
+func minPollInterval(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 5 * time.Second
+	}
+	return d
+}
+
+// pollSettings are the STUN poll timings handed to a worker when it starts.
+type pollSettings struct {
+	interval, maxPoll time.Duration
+	jitter            float64
+}
+
+// forPort returns the settings for a port whose open_port entry overrides the
+// global interval; d == 0 keeps the global one.
+func (p pollSettings) forPort(d time.Duration) pollSettings {
+	if d > 0 {
+		p.interval = d
+	}
+	return p
+}
+
+// next doubles the poll interval, capped at maxPoll.
+func (p pollSettings) next(cur time.Duration) time.Duration {
+	if p.maxPoll <= p.interval {
+		return p.interval
+	}
+	next := cur * 2
+	if next > p.maxPoll {
+		next = p.maxPoll
+	}
+	return next
+}
+
+// reportForwardStats pushes a snapshot of every forwarder's traffic counters
+// to the status manager once per interval.
+func (n *Natter) reportForwardStats(ctx context.Context, interval time.Duration) {
+	every := interval
+	if every <= 0 {
+		every = 10 * time.Second
+	}
+	ticker := n.clock.NewTicker(every)
+	defer ticker.Stop()
+	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-time.After(n.interval):
+		case <-ticker.C():
+		}
+		select {
+		case n.statusMgr.Forwards <- n.forwardStats():
+		default:
+			// 上一份快照尚未处理，跳过本轮
 		}
 	}
 }
 
-// getOutboundIP returns the machine's preferred outbound IP.
-func (n *Natter) getOutboundIP() net.IP {
-	// 用 IPv4 目的地址探路，强制走 IPv4 路径
-	c, err := net.Dial("udp4", "119.29.29.29:53") // 或 "1.1.1.1:53"
+// Subscribe registers fn to be called with every mapping change and removal and
+// returns a function that unregisters it. It may be called at any time; fn runs on
+// the status manager's goroutine without any lock held and should return quickly.
+func (n *Natter) Subscribe(fn func(status.UpdateEvent)) (unsubscribe func()) {
+	return n.statusMgr.Subscribe(fn)
+}
+
+// forwardStats snapshots the traffic counters of every forwarder.
+func (n *Natter) forwardStats() []status.ForwardStat {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	fs := make([]status.ForwardStat, 0, len(n.tcpFwds)+len(n.udpFwds))
+	for _, fw := range n.tcpFwds {
+		fs = append(fs, forwardStat("tcp", fw.ListenAddr, fw.TargetAddr, fw.Stats()))
+	}
+	for _, fw := range n.udpFwds {
+		fs = append(fs, forwardStat("udp", fw.ListenAddr, fw.TargetAddr, fw.Stats()))
+	}
+	return fs
+}
+
+func forwardStat(proto, listen, target string, st forward.Stats) status.ForwardStat {
+	return status.ForwardStat{
+		Protocol:    proto,
+		Listen:      listen,
+		Target:      target,
+		BytesIn:     st.BytesIn,
+		BytesOut:    st.BytesOut,
+		ActiveConns: st.ActiveConns,
+		TotalConns:  st.TotalConns,
+	}
+}
+
+// logStats logs a heartbeat line every period: active forward connections, bytes
+// forwarded since the previous line, mapping counts and keep-alive states.
+func (n *Natter) logStats(ctx context.Context, period time.Duration) {
+	ticker := n.clock.NewTicker(period)
+	defer ticker.Stop()
+	var lastIn, lastOut uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		var tcpConns, udpSessions int64
+		var in, out uint64
+		for _, fs := range n.forwardStats() {
+			if fs.Protocol == "tcp" {
+				tcpConns += fs.ActiveConns
+			} else {
+				udpSessions += fs.ActiveConns
+			}
+			in += fs.BytesIn
+			out += fs.BytesOut
+		}
+		// forwarders restarted by a reload start counting from zero again
+		deltaIn, deltaOut := in, out
+		if in >= lastIn && out >= lastOut {
+			deltaIn, deltaOut = in-lastIn, out-lastOut
+		}
+		lastIn, lastOut = in, out
+
+		mappings := n.statusMgr.MappingCounts()
+		keepAlives := n.statusMgr.KeepAliveCounts()
+		n.logger.Info("Stats",
+			zap.Int64("tcp_conns", tcpConns),
+			zap.Int64("udp_sessions", udpSessions),
+			zap.Uint64("bytes_in", deltaIn),
+			zap.Uint64("bytes_out", deltaOut),
+			zap.Int("tcp_mappings", mappings["tcp"]),
+			zap.Int("udp_mappings", mappings["udp"]),
+			zap.Int("keepalive_connected", keepAlives["connected"]),
+			zap.Int("keepalive_sent", keepAlives["sent"]),
+			zap.Int("keepalive_failing", keepAlives["failing"]))
+	}
+}
+
+// logSTUNStats periodically logs per-server STUN success counts and RTT.
+func (n *Natter) logSTUNStats(ctx context.Context, interval time.Duration) {
+	every := 10 * interval
+	if every <= 0 {
+		every = time.Minute
+	}
+	ticker := n.clock.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		for server, st := range n.stunClient.Stats() {
+			n.logger.Info("STUN server stats",
+				zap.String("server", server),
+				zap.Int64("success", st.Success),
+				zap.Int64("failure", st.Failure),
+				zap.Duration("avg_rtt", st.AvgRTT))
+		}
+	}
+}
+
+// logNATBehavior runs a quick CHANGE-REQUEST filtering test and then RFC 5780 discovery
+// once, reporting whether hole punching can work.
+func (n *Natter) logNATBehavior(ctx context.Context) {
+	filtering, err := n.stunClient.TestFiltering(ctx, 0)
+	switch {
+	case err != nil:
+		if ctx.Err() != nil {
+			return
+		}
+		n.logger.Info("NAT filtering unknown", zap.Error(err))
+	case filtering == stun.FilteringEndpointIndependent:
+		n.logger.Info("NAT filtering detected: inbound from any address is accepted, hole punching friendly",
+			zap.Stringer("filtering", filtering))
+	default:
+		n.logger.Info("NAT filtering detected: inbound only from contacted addresses, peers must punch simultaneously",
+			zap.Stringer("filtering", filtering))
+	}
+
+	natType, m, err := n.stunClient.DiscoverNATBehavior(ctx)
 	if err != nil {
-		return net.IPv4(127, 0, 0, 1)
+		if ctx.Err() == nil {
+			n.logger.Info("NAT behavior unknown", zap.Error(err))
+		}
+		return
+	}
+	fields := []zap.Field{
+		zap.Stringer("nat_type", natType),
+		zap.String("external", m.ExternalAddr()),
 	}
-	defer c.Close()
-	ip := c.LocalAddr().(*net.UDPAddr).IP.To4()
+	if natType == stun.NATSymmetric {
+		n.logger.Warn("NAT behavior detected: mapping changes per destination, Natter is unlikely to work on this network", fields...)
+		return
+	}
+	n.logger.Info("NAT behavior detected", fields...)
+}
+
+// localIP parses s and checks that it is assigned to one of this host's interfaces.
+func localIP(s string) (net.IP, error) {
+	ip := net.ParseIP(s)
 	if ip == nil {
-		return net.IPv4(127, 0, 0, 1)
+		return nil, fmt.Errorf("invalid bind_ip %q", s)
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("list interface addresses: %w", err)
+	}
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && ipn.IP.Equal(ip) {
+			if v4 := ip.To4(); v4 != nil {
+				return v4, nil
+			}
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("bind_ip %s is not assigned to any local interface", s)
+}
+
+// interfaceIP returns the first IPv4 address of the named interface, preferring
+// addresses that are not link-local.
+func interfaceIP(name string) (net.IP, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("bind_interface %q: %w", name, err)
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("bind_interface %q: %w", name, err)
+	}
+	var linkLocal net.IP
+	for _, a := range addrs {
+		ipn, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		v4 := ipn.IP.To4()
+		if v4 == nil {
+			continue
+		}
+		if v4.IsLinkLocalUnicast() {
+			if linkLocal == nil {
+				linkLocal = v4
+			}
+			continue
+		}
+		return v4, nil
+	}
+	if linkLocal != nil {
+		return linkLocal, nil
+	}
+	return nil, fmt.Errorf("bind_interface %q has no IPv4 address", name)
+}
+
+// defaultBindProbes are tried when bind_probe is not configured. Dialing UDP sends
+// no packets; it only asks the kernel which source address the route would use.
+var defaultBindProbes = []string{"119.29.29.29:53", "223.5.5.5:53", "1.1.1.1:53", "8.8.8.8:53"}
+
+// getOutboundIP returns the machine's preferred outbound IPv4 address, found by
+// "connecting" a UDP socket to each probe in turn. The first success is cached;
+// when every probe fails 127.0.0.1 is returned and the next call probes again.
+func (n *Natter) getOutboundIP() net.IP {
+	if ip := n.outboundIP.Load(); ip != nil {
+		return *ip
+	}
+	for _, probe := range n.bindProbes {
+		// 用 IPv4 目的地址探路，强制走 IPv4 路径
+		c, err := net.Dial("udp4", probe)
+		if err != nil {
+			n.logger.Debug("Outbound IP probe failed", zap.String("probe", probe), zap.Error(err))
+			continue
+		}
+		ip := c.LocalAddr().(*net.UDPAddr).IP.To4()
+		c.Close()
+		if ip == nil || ip.IsUnspecified() {
+			continue
+		}
+		n.outboundIP.Store(&ip)
+		return ip
+	}
+	return net.IPv4(127, 0, 0, 1)
+}
+
+// openInners returns "proto inner" for every open port that has a STUN worker, as runWorker reports it.
+func (n *Natter) openInners() []string {
+	outbound := n.getOutboundIP()
+	inners := make([]string, 0, len(n.tcpOpens)+len(n.udpOpens))
+	if n.stunEnabled("tcp") {
+		for i := range n.tcpOpens {
+			inners = append(inners, "tcp "+formatInner(&n.tcpOpens[i], outbound))
+		}
+	}
+	if n.stunEnabled("udp") {
+		for i := range n.udpOpens {
+			inners = append(inners, "udp "+formatInner(&n.udpOpens[i], outbound))
+		}
 	}
-	return ip
+	return inners
 }
 
 // formatInner formats the inner address, replacing 0.0.0.0 with actual IP.
@@ -0,0 +1,123 @@
+package orchestrator
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"natter/internal/config"
+
+	pionstun "github.com/pion/stun"
+	"go.uber.org/zap"
+)
+
+// testConfig returns a minimal valid configuration bound to loopback with the status
+// file in a temporary directory; callers add open ports, targets and servers.
+func testConfig(t *testing.T) *config.Config {
+	t.Helper()
+	cfg := &config.Config{BindIP: "127.0.0.1"}
+	cfg.StatusReport.StatusFile = filepath.Join(t.TempDir(), "status.json")
+	cfg.ApplyDefaults()
+	return cfg
+}
+
+// newTestNatter creates a Natter for cfg and makes it look started for helpers that
+// need runCtx; forwarders still have to be started explicitly.
+func newTestNatter(t *testing.T, cfg *config.Config, opts ...Option) *Natter {
+	t.Helper()
+	n, err := New(cfg, zap.NewNop(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	n.runCtx = ctx
+	return n
+}
+
+// freeUDPPort returns a loopback UDP port that was free a moment ago.
+func freeUDPPort(t *testing.T) int {
+	t.Helper()
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestUDPForwardEntryStartsListener(t *testing.T) {
+	target, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	open := net.JoinHostPort("127.0.0.1", strconv.Itoa(freeUDPPort(t)))
+	cfg := testConfig(t)
+	cfg.OpenPort.UDP = config.PortList{{Addr: open}}
+	cfg.ForwardPort.UDP = config.TargetList{{Target: target.LocalAddr().String()}}
+	n := newTestNatter(t, cfg)
+	if len(n.udpFwds) != 1 {
+		t.Fatalf("built %d UDP forwarders, want 1", len(n.udpFwds))
+	}
+	if failed := n.startForwarders(n.tcpFwds, n.udpFwds); len(failed) > 0 {
+		t.Fatalf("start forwarders: %v", failed[0])
+	}
+	defer n.stopForwarders(n.tcpFwds, n.udpFwds, time.Second)
+
+	client, err := net.Dial("udp4", open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	target.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 16)
+	nr, _, err := target.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("target received nothing through %s: %v", open, err)
+	}
+	if got := string(buf[:nr]); got != "ping" {
+		t.Fatalf("target received %q, want %q", got, "ping")
+	}
+}
+
+// stunResponder answers STUN Binding requests on a loopback UDP port with the source
+// address of each request and counts them. It returns the server address and the counter.
+func stunResponder(t *testing.T) (string, *atomic.Int32) {
+	t.Helper()
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	var count atomic.Int32
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			nr, from, err := c.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			req := &pionstun.Message{Raw: append([]byte(nil), buf[:nr]...)}
+			if req.Decode() != nil || req.Type != pionstun.BindingRequest {
+				continue
+			}
+			count.Add(1)
+			res, err := pionstun.Build(pionstun.NewTransactionIDSetter(req.TransactionID), pionstun.BindingSuccess,
+				&pionstun.XORMappedAddress{IP: from.IP, Port: from.Port}, pionstun.Fingerprint)
+			if err != nil {
+				continue
+			}
+			c.WriteToUDP(res.Raw, from)
+		}
+	}()
+	return c.LocalAddr().String(), &count
+}
@@ -0,0 +1,39 @@
+package orchestrator
+
+import (
+	"go.uber.org/zap"
+
+	"natter/internal/clock"
+	"natter/internal/status"
+)
+
+// Option customizes a Natter instance created by New.
+type Option func(*Natter)
+
+// WithClock sets the clock used by the STUN workers, the keep-alive loops, the
+// UDP session reaper and the status manager. Defaults to the real clock.
+func WithClock(c clock.Clock) Option {
+	return func(n *Natter) {
+		n.clock = c
+		status.WithClock(c)(n.statusMgr)
+	}
+}
+
+// WithMappingHandler registers fn to be called with every mapping change and
+// removal, the in-process equivalent of a webhook. See Natter.Subscribe.
+func WithMappingHandler(fn func(status.UpdateEvent)) Option {
+	return func(n *Natter) { status.WithListener(fn)(n.statusMgr) }
+}
+
+// WithAuditLogger sends audit records to l: every accepted client, every mapping
+// change or removal and every hook or webhook run. Records are written at info
+// level regardless of the main log level. Defaults to discarding them.
+func WithAuditLogger(l *zap.Logger) Option {
+	return func(n *Natter) {
+		if l == nil {
+			return
+		}
+		n.audit = l
+		status.WithAuditLogger(l)(n.statusMgr)
+	}
+}
@@ -0,0 +1,340 @@
+package orchestrator
+
+import (
+	"context"
+	"maps"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"natter/internal/config"
+	"natter/internal/natpmp"
+	"natter/internal/pcp"
+	"natter/internal/status"
+	"natter/internal/upnp"
+)
+
+// portMapper is the common interface of the router port-mapping clients (UPnP IGD, PCP, NAT-PMP).
+// Every request is abandoned when its ctx is done.
+type portMapper interface {
+	// AddTCP/AddUDP return the external port the router granted, which may differ from the one requested.
+	AddTCP(ctx context.Context, externalPort, internalPort int, internalIP string, durationSec uint32) (int, error)
+	AddUDP(ctx context.Context, externalPort, internalPort int, internalIP string, durationSec uint32) (int, error)
+	DeleteTCP(ctx context.Context, externalPort, internalPort int) error
+	DeleteUDP(ctx context.Context, externalPort, internalPort int) error
+}
+
+// externalIPer is implemented by port mappers that can report the router's WAN address.
+type externalIPer interface {
+	ExternalIP(ctx context.Context) (net.IP, error)
+}
+
+// mappedPort identifies a mapping added on the router, so it can be removed on shutdown.
+type mappedPort struct {
+	proto   string // "tcp" or "udp"
+	ext, in int
+}
+
+// portMapState tracks the router mappings Natter added. It is owned by the runPortMapping goroutine.
+type portMapState struct {
+	pm      portMapper
+	name    string
+	timeout time.Duration         // per-request bound, see portMapTimeout
+	added   map[mappedPort]string // -> inner "IP:Port" the mapping points at
+	granted map[mappedPort]int    // requested mapping (ext = wanted port) -> external port the router granted
+}
+
+// record notes that the router granted m.ext for a request of want, replacing the mapping
+// granted for the same request earlier if the router moved it.
+func (s *portMapState) record(want, m mappedPort, inner string) {
+	if old, ok := s.granted[want]; ok && old != m.ext {
+		delete(s.added, mappedPort{proto: m.proto, ext: old, in: m.in})
+	}
+	s.granted[want] = m.ext
+	s.added[m] = inner
+}
+
+// report lists the mappings currently held on the router for the status file.
+func (s *portMapState) report() []status.RouterMapping {
+	out := make([]status.RouterMapping, 0, len(s.added))
+	for m, inner := range s.added {
+		out = append(out, status.RouterMapping{Protocol: m.proto, Inner: inner, ExternalPort: m.ext, Via: s.name})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Protocol != out[j].Protocol {
+			return out[i].Protocol < out[j].Protocol
+		}
+		return out[i].ExternalPort < out[j].ExternalPort
+	})
+	return out
+}
+
+// Defaults for the port-mapping discovery retries.
+const (
+	defaultDiscoverAttempts = 3
+	defaultDiscoverInterval = 5 * time.Second
+)
+
+// defaultPortMapTimeout bounds a single PCP/NAT-PMP discovery or any mapping request
+// when upnp_timeout is not set; it leaves room for the full PCP/NAT-PMP retransmit schedule.
+const defaultPortMapTimeout = 5 * time.Second
+
+// portMapTimeout returns upnp_timeout, or defaultPortMapTimeout when it is not set.
+func portMapTimeout(cfg *config.Config) time.Duration {
+	if cfg.UPnPTimeout > 0 {
+		return time.Duration(cfg.UPnPTimeout) * time.Second
+	}
+	return defaultPortMapTimeout
+}
+
+// discoverPortMapper tries UPnP, then PCP, then NAT-PMP, returning the first protocol the
+// router answers together with its name. It returns nil when none is available or ctx is done.
+// Each UPnP search lasts upnp_timeout (upnp's own default when unset), each other probe portMapTimeout.
+func (n *Natter) discoverPortMapper(ctx context.Context, cfg *config.Config) (portMapper, string) {
+	uc, err := upnp.Discover(ctx, time.Duration(cfg.UPnPTimeout)*time.Second, n.logger)
+	if err == nil {
+		return uc, "UPnP"
+	}
+	if ctx.Err() != nil {
+		return nil, ""
+	}
+	n.logger.Info("UPnP discovery failed, trying PCP", zap.Error(err))
+
+	timeout := portMapTimeout(cfg)
+	pctx, cancel := context.WithTimeout(ctx, timeout)
+	cc, err := pcp.Discover(pctx, n.bindIP, n.logger)
+	cancel()
+	if err == nil {
+		return cc, "PCP"
+	}
+	if ctx.Err() != nil {
+		return nil, ""
+	}
+	n.logger.Info("PCP discovery failed, trying NAT-PMP", zap.Error(err))
+
+	pctx, cancel = context.WithTimeout(ctx, timeout)
+	pc, err := natpmp.Discover(pctx, n.bindIP, n.logger)
+	cancel()
+	if err == nil {
+		return pc, "NAT-PMP"
+	}
+	n.logger.Info("NAT-PMP discovery failed, no port mapping protocol available", zap.Error(err))
+	return nil, ""
+}
+
+// mapOpenPorts asks the router to forward every open port to this host. The external port is
+// the open port's external_port, or the internal port when none is set. lease is the requested
+// lifetime in seconds, 0 for a permanent mapping. Each request is bounded by st.timeout, and the
+// remaining ports are skipped once ctx is done.
+func (n *Natter) mapOpenPorts(ctx context.Context, st *portMapState, lease uint32) {
+	n.mu.Lock()
+	tcpOpens, udpOpens := slices.Clone(n.tcpOpens), slices.Clone(n.udpOpens)
+	externals := maps.Clone(n.externalPorts)
+	n.mu.Unlock()
+	for _, addr := range tcpOpens {
+		if ctx.Err() != nil {
+			return
+		}
+		n.mapPort(ctx, st, "tcp", addr.IP, addr.Port, externals[taskKey("tcp", &addr)], lease)
+	}
+	for _, addr := range udpOpens {
+		if ctx.Err() != nil {
+			return
+		}
+		n.mapPort(ctx, st, "udp", addr.IP, addr.Port, externals[taskKey("udp", &addr)], lease)
+	}
+}
+
+// mapPort requests one mapping of external port ext (the internal port when 0) to ip:in.
+// A renewal asks for the port the router granted last time, so a reassigned port is kept.
+func (n *Natter) mapPort(ctx context.Context, st *portMapState, proto string, ip net.IP, in, ext int, lease uint32) {
+	if ext == 0 {
+		ext = in
+	}
+	want := mappedPort{proto: proto, ext: ext, in: in}
+	req := ext
+	if g, ok := st.granted[want]; ok {
+		req = g
+	}
+	// Determine actual inner IP (replace 0.0.0.0)
+	innerIP := ip.String()
+	if ip.IsUnspecified() {
+		innerIP = n.getOutboundIP().String()
+	}
+	rctx, cancel := context.WithTimeout(ctx, st.timeout)
+	add := st.pm.AddTCP
+	if proto == "udp" {
+		add = st.pm.AddUDP
+	}
+	granted, err := add(rctx, req, in, innerIP, lease)
+	cancel()
+	if err != nil {
+		n.logger.Warn(st.name+" add mapping failed", zap.String("proto", proto), zap.Int("port", in), zap.Int("external_port", req), zap.Error(err))
+		return
+	}
+	inner := net.JoinHostPort(innerIP, strconv.Itoa(in))
+	st.record(want, mappedPort{proto: proto, ext: granted, in: in}, inner)
+	fields := []zap.Field{zap.String("proto", proto), zap.String("inner", inner), zap.Int("external_port", granted)}
+	if granted != ext {
+		n.logger.Warn(st.name+" granted a different external port than requested", append(fields, zap.Int("requested", ext))...)
+		return
+	}
+	n.logger.Info(st.name+" map added", fields...)
+}
+
+// runPortMapping discovers a port-mapping protocol, maps the open ports and keeps them
+// until ctx is done, then deletes them. With a finite lease the mappings are renewed every
+// half lease, so they never expire while Natter runs and lapse on their own once it stops;
+// routers that drop mappings on reboot or cap the lifetime are covered by the same loop.
+func (n *Natter) runPortMapping(ctx context.Context) {
+	n.mu.Lock()
+	cfg := n.cfg // port-mapping settings are not reloaded
+	n.mu.Unlock()
+	pm, name := n.discoverWithRetry(ctx, cfg)
+	if pm == nil {
+		return
+	}
+	st := &portMapState{pm: pm, name: name, timeout: portMapTimeout(cfg),
+		added: map[mappedPort]string{}, granted: map[mappedPort]int{}}
+	n.logRouterExternalIP(ctx, st)
+	var lease uint32
+	if cfg.UPnPLease > 0 {
+		lease = uint32(cfg.UPnPLease)
+	}
+	n.mapOpenPorts(ctx, st, lease)
+	n.statusMgr.SetRouterMappings(st.report())
+	defer n.removePortMappings(ctx, st)
+	if lease == 0 {
+		<-ctx.Done()
+		return
+	}
+
+	every := time.Duration(lease) * time.Second / 2
+	if every < time.Second {
+		every = time.Second
+	}
+	ticker := n.clock.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		n.logger.Debug("Renewing port mappings", zap.String("protocol", st.name), zap.Uint32("lease", lease))
+		n.mapOpenPorts(ctx, st, lease)
+		n.statusMgr.SetRouterMappings(st.report())
+	}
+}
+
+// discoverWithRetry runs discoverPortMapper up to upnp_discover.attempts times, doubling the
+// wait from upnp_discover.interval, since the router's service may not be up yet right after boot.
+// If every attempt fails and upnp_discover.rediscover_interval is set, it keeps trying at that interval
+// so a router that comes online later is still used. It returns nil when giving up or when ctx is done.
+func (n *Natter) discoverWithRetry(ctx context.Context, cfg *config.Config) (portMapper, string) {
+	d := cfg.UPnPDiscover
+	attempts := d.Attempts
+	if attempts <= 0 {
+		attempts = defaultDiscoverAttempts
+	}
+	interval := time.Duration(d.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultDiscoverInterval
+	}
+	rediscover := time.Duration(d.RediscoverInterval) * time.Second
+
+	for {
+		wait := interval
+		for i := 0; i < attempts; i++ {
+			if pm, name := n.discoverPortMapper(ctx, cfg); pm != nil {
+				return pm, name
+			}
+			if ctx.Err() != nil {
+				return nil, ""
+			}
+			if i == attempts-1 {
+				break
+			}
+			n.logger.Info("Port mapping discovery failed, retrying", zap.Int("attempt", i+1), zap.Duration("wait", wait))
+			select {
+			case <-ctx.Done():
+				return nil, ""
+			case <-n.clock.After(wait):
+			}
+			wait *= 2
+		}
+		if rediscover <= 0 {
+			n.logger.Warn("Port mapping unavailable, giving up", zap.Int("attempts", attempts))
+			return nil, ""
+		}
+		n.logger.Info("Port mapping unavailable, will rediscover later", zap.Duration("wait", rediscover))
+		select {
+		case <-ctx.Done():
+			return nil, ""
+		case <-n.clock.After(rediscover):
+		}
+	}
+}
+
+// removePortMappings deletes every mapping added by runPortMapping. It runs on shutdown,
+// after ctx is done, so the requests use a detached ctx that is still bounded by st.timeout.
+func (n *Natter) removePortMappings(ctx context.Context, st *portMapState) {
+	ctx = context.WithoutCancel(ctx)
+	for m := range st.added {
+		rctx, cancel := context.WithTimeout(ctx, st.timeout)
+		var err error
+		if m.proto == "tcp" {
+			err = st.pm.DeleteTCP(rctx, m.ext, m.in)
+		} else {
+			err = st.pm.DeleteUDP(rctx, m.ext, m.in)
+		}
+		cancel()
+		if err != nil {
+			n.logger.Warn(st.name+" delete mapping failed", zap.String("proto", m.proto), zap.Int("port", m.ext), zap.Error(err))
+			continue
+		}
+		n.logger.Info(st.name+" mapping removed", zap.String("proto", m.proto), zap.Int("port", m.ext))
+		delete(st.added, m)
+	}
+	n.statusMgr.SetRouterMappings(st.report())
+}
+
+// logRouterExternalIP records the WAN address reported by the router. It is compared
+// with the STUN result later on, see checkRouterIP.
+func (n *Natter) logRouterExternalIP(ctx context.Context, st *portMapState) {
+	eip, ok := st.pm.(externalIPer)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, st.timeout)
+	defer cancel()
+	ip, err := eip.ExternalIP(ctx)
+	if err != nil {
+		n.logger.Info(st.name+" external IP unavailable", zap.Error(err))
+		return
+	}
+	n.routerIP.Store(&ip)
+	n.logger.Info(st.name+" reports external IP", zap.Stringer("ip", ip))
+	n.statusMgr.SetRouterExternalIP(ip.String())
+}
+
+// checkRouterIP warns once when STUN sees a different external IP than the router reports:
+// the router is itself behind another NAT (CGNAT), so its port mapping cannot be reached from outside.
+func (n *Natter) checkRouterIP(outer string) {
+	routerIP := n.routerIP.Load()
+	if routerIP == nil {
+		return
+	}
+	host, _, err := net.SplitHostPort(outer)
+	if err != nil || net.ParseIP(host).Equal(*routerIP) {
+		return
+	}
+	n.routerIPMismatch.Do(func() {
+		n.logger.Warn("Router external IP differs from STUN mapping, likely behind CGNAT or a double NAT",
+			zap.Stringer("router_ip", *routerIP), zap.String("stun_outer", outer))
+	})
+}
@@ -0,0 +1,391 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"natter/internal/config"
+	"natter/internal/forward"
+	"natter/internal/keepalive"
+)
+
+// task is the set of goroutines serving one open port (keep-alive and STUN worker),
+// or the single ICMP keep-alive loop. Tasks are stopped and restarted on reload.
+type task struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// stop cancels the task and waits for its goroutines to exit.
+func (t *task) stop() {
+	t.cancel()
+	t.wg.Wait()
+}
+
+// startTask runs fns in goroutines under a child of the Run context and records them under key.
+// Called with n.mu held.
+func (n *Natter) startTask(key string, fns ...func(ctx context.Context)) {
+	ctx, cancel := context.WithCancel(n.runCtx)
+	t := &task{cancel: cancel}
+	for _, fn := range fns {
+		t.wg.Add(1)
+		go func(fn func(context.Context)) {
+			defer t.wg.Done()
+			fn(ctx)
+		}(fn)
+	}
+	n.tasks[key] = t
+}
+
+func taskKey(proto string, addr net.Addr) string { return proto + "|" + addr.String() }
+
+// startTasks starts a task for every open port (and the ICMP loop) that is not running yet.
+// Called with n.mu held, after the forwarders were started.
+func (n *Natter) startTasks() {
+	poll := pollSettings{interval: n.interval, maxPoll: n.maxPoll, jitter: n.jitter}
+	hosts := n.cfg.KeepAlive
+
+	// ICMP mode replaces the per-port keep-alives with a single echo loop
+	icmpMode := n.cfg.KeepAliveMode == "icmp"
+	if _, ok := n.tasks["icmp"]; icmpMode && !ok {
+		opts := []keepalive.Option{
+			keepalive.WithClock(n.clock), keepalive.WithJitter(n.jitter), keepalive.WithReporter(n.reportKeepAlive("icmp", n.bindIP.String())),
+		}
+		bindIP := n.bindIP
+		n.startTask("icmp", func(ctx context.Context) {
+			keepalive.ICMPKeepAlive(ctx, bindIP, hosts, poll.interval, n.logger, opts...)
+		})
+	}
+
+	for _, a := range n.tcpOpens {
+		addr := a // ✅ 复制一份，避免 &addr 指向同一个循环变量
+		key := taskKey("tcp", &addr)
+		if _, ok := n.tasks[key]; ok {
+			continue
+		}
+		poll := poll.forPort(n.portIntervals[key])
+		kick := make(chan struct{}, 1)
+		var fns []func(context.Context)
+		if n.stunEnabled("tcp") {
+			fns = append(fns, func(ctx context.Context) { n.runWorker(ctx, "tcp", &addr, nil, kick, poll) })
+		}
+		if !icmpMode {
+			// keepalive 绑定到“真实本地 IP:监听端口”
+			laddr := &net.TCPAddr{IP: n.bindIP, Port: addr.Port}
+			opts := n.keepAliveOpts("tcp", laddr.String(), kick)
+			fns = append(fns, func(ctx context.Context) {
+				keepalive.TCPKeepAlive(ctx, laddr, hosts, poll.interval, n.logger, opts...)
+			})
+		}
+		n.startTask(key, fns...)
+	}
+	for _, a := range n.udpOpens {
+		addr := a
+		key := taskKey("udp", &addr)
+		if _, ok := n.tasks[key]; ok {
+			continue
+		}
+		poll := poll.forPort(n.portIntervals[key])
+		kick := make(chan struct{}, 1)
+		var fns []func(context.Context)
+		if n.stunEnabled("udp") {
+			shared := n.sharedSocket(addr.Port)
+			fns = append(fns, func(ctx context.Context) { n.runWorker(ctx, "udp", &addr, shared, kick, poll) })
+		}
+		if !icmpMode {
+			fns = append(fns, n.udpKeepAliveTask(&addr, hosts, poll.interval, kick))
+		}
+		n.startTask(key, fns...)
+	}
+}
+
+// udpKeepAliveTask returns the UDP keep-alive loop for addr. A UDP forwarder on this port
+// already owns the socket, so keep-alives are sent through it; otherwise a socket is bound
+// here, before the port's STUN worker starts, and the loop closes it when stopped.
+// Either socket allows port reuse, so the STUN queries can bind the same port afterwards.
+// Called with n.mu held.
+func (n *Natter) udpKeepAliveTask(addr *net.UDPAddr, hosts []string, interval time.Duration, kick chan<- struct{}) func(context.Context) {
+	pc := n.udpForwarderConn(addr.Port)
+	owned := false
+	if pc == nil {
+		var err error
+		if pc, err = keepalive.ListenUDP(n.runCtx, addr.String()); err != nil {
+			n.logger.Warn("UDP listen failed", zap.Error(err))
+			return func(context.Context) {}
+		}
+		owned = true
+	}
+	opts := n.keepAliveOpts("udp", pc.LocalAddr().String(), kick)
+	return func(ctx context.Context) {
+		if owned {
+			defer pc.Close()
+		}
+		keepalive.UDPKeepAlive(ctx, pc, hosts, addr.Port, interval, n.logger, opts...)
+	}
+}
+
+// parseOpenPorts converts cfg.OpenPort into addresses and collects the per-port
+// interval overrides and router external ports. Called with n.mu held (or from New).
+func (n *Natter) parseOpenPorts() {
+	n.tcpOpens, n.udpOpens = nil, nil
+	n.portIntervals = map[string]time.Duration{}
+	n.externalPorts = map[string]int{}
+	for _, a := range n.cfg.OpenPort.TCP {
+		h, p := splitAddr(a.Addr)
+		addr := net.TCPAddr{IP: net.ParseIP(h), Port: p}
+		n.tcpOpens = append(n.tcpOpens, addr)
+		if a.Interval > 0 {
+			n.portIntervals[taskKey("tcp", &addr)] = time.Duration(a.Interval) * time.Second
+		}
+		if a.ExternalPort > 0 {
+			n.externalPorts[taskKey("tcp", &addr)] = a.ExternalPort
+		}
+	}
+	for _, a := range n.cfg.OpenPort.UDP {
+		h, p := splitAddr(a.Addr)
+		addr := net.UDPAddr{IP: net.ParseIP(h), Port: p}
+		n.udpOpens = append(n.udpOpens, addr)
+		if a.Interval > 0 {
+			n.portIntervals[taskKey("udp", &addr)] = time.Duration(a.Interval) * time.Second
+		}
+		if a.ExternalPort > 0 {
+			n.externalPorts[taskKey("udp", &addr)] = a.ExternalPort
+		}
+	}
+}
+
+// forwardSpec pairs a forwarder's listen address with its target.
+type forwardSpec struct {
+	listen string
+	target config.ForwardTarget
+}
+
+// key identifies a forwarder across reloads: same listen address and same target settings.
+func (s forwardSpec) key() string { return fmt.Sprintf("%s|%+v", s.listen, s.target) }
+
+// forwardSpecs pairs open ports with forward targets: one-to-one when the counts match,
+// otherwise (legacy) every target gets a listener on its own port.
+func forwardSpecs(open []string, targets config.TargetList) []forwardSpec {
+	specs := make([]forwardSpec, 0, len(targets))
+	for i, target := range targets {
+		listenAddr := "0.0.0.0:" + portOf(target.Target) // 旧逻辑：监听目标端口
+		if len(open) == len(targets) {
+			listenAddr = open[i] // 一一对应模式，e.g. "0.0.0.0:33887"
+		}
+		specs = append(specs, forwardSpec{listen: listenAddr, target: target})
+	}
+	return specs
+}
+
+// buildForwarders creates the forwarders for n.cfg. Forwarders found in the reuse maps
+// (keyed by forwardSpec.key) are taken as they are instead of being created.
+func (n *Natter) buildForwarders(reuseTCP map[string]*forward.TCPForwarder, reuseUDP map[string]*forward.UDPForwarder) ([]*forward.TCPForwarder, []*forward.UDPForwarder, error) {
+	var tcp []*forward.TCPForwarder
+	var udp []*forward.UDPForwarder
+	for _, spec := range forwardSpecs(n.cfg.OpenPort.TCP.Addrs(), n.cfg.ForwardPort.TCP) {
+		if fwd, ok := reuseTCP[spec.key()]; ok {
+			tcp = append(tcp, fwd)
+			continue
+		}
+		fwd, err := n.newTCPForwarder(spec.listen, spec.target)
+		if err != nil {
+			return nil, nil, err
+		}
+		tcp = append(tcp, fwd)
+	}
+	for _, spec := range forwardSpecs(n.cfg.OpenPort.UDP.Addrs(), n.cfg.ForwardPort.UDP) {
+		if fwd, ok := reuseUDP[spec.key()]; ok {
+			udp = append(udp, fwd)
+			continue
+		}
+		fwd, err := n.newUDPForwarder(spec.listen, spec.target)
+		if err != nil {
+			return nil, nil, err
+		}
+		udp = append(udp, fwd)
+	}
+	return tcp, udp, nil
+}
+
+// keepAliveSettings collects the options every keep-alive loop and STUN worker is started with;
+// when any of them changes, all tasks are restarted. Whether each protocol has STUN servers
+// decides if its workers run at all.
+func keepAliveSettings(cfg *config.Config) any {
+	return []any{cfg.KeepAlive, cfg.KeepAlivePort, cfg.KeepAliveScheme, cfg.KeepAliveReq, cfg.KeepAliveMode,
+		cfg.KeepAliveUDP, cfg.Interval, cfg.StunMaxInterval, cfg.JitterRatio(),
+		len(cfg.StunServer.TCP) > 0, len(cfg.StunServer.UDP) > 0, cfg.StunServer.ShareSocket}
+}
+
+// stunEnabled reports whether proto ("tcp" or "udp") has STUN servers configured; without
+// them no worker is started for its ports, while forwarding and keep-alives still run.
+func (n *Natter) stunEnabled(proto string) bool {
+	if proto == "tcp" {
+		return len(n.cfg.StunServer.TCP) > 0
+	}
+	return len(n.cfg.StunServer.UDP) > 0
+}
+
+// logSTUNDisabled notes once per start or reload which open ports get no mapping detection.
+func (n *Natter) logSTUNDisabled() {
+	if len(n.tcpOpens) > 0 && !n.stunEnabled("tcp") {
+		n.logger.Info("No TCP STUN servers configured, TCP mapping detection is disabled", zap.Int("ports", len(n.tcpOpens)))
+	}
+	if len(n.udpOpens) > 0 && !n.stunEnabled("udp") {
+		n.logger.Info("No UDP STUN servers configured, UDP mapping detection is disabled", zap.Int("ports", len(n.udpOpens)))
+	}
+}
+
+// Reload applies a new configuration to a running Natter. STUN servers are swapped in place;
+// forwarders are diffed by listen address and target, so unchanged forwarders and their
+// connections survive (a change to the global forward options recreates all of them);
+// keep-alive loops and STUN workers are restarted when their settings or ports change.
+// TCP forwarders that go away stop accepting at once; their open connections get
+// shutdown_timeout to finish before they are closed, and Reload waits for that without
+// holding n.mu. Port mapping, status reporting, metrics, proxy, bind_ip, bind_interface,
+// bind_probe and logging settings need a restart.
+func (n *Natter) Reload(cfg *config.Config) error {
+	udpPayload, err := keepalive.ParsePayload(cfg.KeepAliveUDP)
+	if err != nil {
+		return err
+	}
+	rates, err := parseRateLimits(cfg.Forward)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	goneTCP, err := n.reloadLocked(cfg, udpPayload, rates)
+	grace := time.Duration(n.cfg.ShutdownTimeout) * time.Second
+	n.mu.Unlock()
+	if len(goneTCP) > 0 {
+		n.stopForwarders(goneTCP, nil, grace)
+	}
+	return err
+}
+
+// reloadLocked applies cfg with n.mu held. Removed TCP forwarders have stopped accepting
+// and are returned for the caller to drain once the lock is released.
+func (n *Natter) reloadLocked(cfg *config.Config, udpPayload keepalive.Payload, rates rateLimits) ([]*forward.TCPForwarder, error) {
+	if n.runCtx == nil || n.runCtx.Err() != nil {
+		return nil, errors.New("natter is not running")
+	}
+	old := n.cfg
+	oldTCP := forwardSpecs(old.OpenPort.TCP.Addrs(), old.ForwardPort.TCP)
+	oldUDP := forwardSpecs(old.OpenPort.UDP.Addrs(), old.ForwardPort.UDP)
+
+	// Diff the forwarders; everything that is not reused is stopped below.
+	reuseTCP := map[string]*forward.TCPForwarder{}
+	reuseUDP := map[string]*forward.UDPForwarder{}
+	if reflect.DeepEqual(old.Forward, cfg.Forward) {
+		for i, spec := range oldTCP {
+			reuseTCP[spec.key()] = n.tcpFwds[i]
+		}
+		for i, spec := range oldUDP {
+			reuseUDP[spec.key()] = n.udpFwds[i]
+		}
+	}
+	oldRates := n.rates
+	n.cfg, n.rates = cfg, rates // read by buildForwarders
+	tcpFwds, udpFwds, err := n.buildForwarders(reuseTCP, reuseUDP)
+	if err != nil {
+		n.cfg, n.rates = old, oldRates
+		return nil, err
+	}
+	n.interval = time.Duration(cfg.Interval) * time.Second
+	n.maxPoll = time.Duration(cfg.StunMaxInterval) * time.Second
+	n.jitter = cfg.JitterRatio()
+	n.udpPayload = udpPayload
+	n.applyServerLists()
+	if !slices.Equal(serverListURLs(old), serverListURLs(cfg)) {
+		select {
+		case n.serverListKick <- struct{}{}: // fetch newly added URLs now
+		default:
+		}
+	}
+	oldIntervals := n.portIntervals
+	n.parseOpenPorts()
+
+	// Forwarders that go away or are created
+	var goneTCP, newTCP []*forward.TCPForwarder
+	var goneUDP, newUDP []*forward.UDPForwarder
+	for _, fw := range n.tcpFwds {
+		if !slices.Contains(tcpFwds, fw) {
+			goneTCP = append(goneTCP, fw)
+		}
+	}
+	for _, fw := range tcpFwds {
+		if !slices.Contains(n.tcpFwds, fw) {
+			newTCP = append(newTCP, fw)
+		}
+	}
+	// A UDP keep-alive shares its port's socket with the forwarder (or owns it when there is
+	// none), so the tasks of every UDP port whose forwarder changes are restarted as well.
+	udpChanged := map[int]bool{}
+	for _, fw := range n.udpFwds {
+		if !slices.Contains(udpFwds, fw) {
+			goneUDP = append(goneUDP, fw)
+			_, port := splitAddr(fw.ListenAddr)
+			udpChanged[port] = true
+		}
+	}
+	for _, fw := range udpFwds {
+		if !slices.Contains(n.udpFwds, fw) {
+			newUDP = append(newUDP, fw)
+			_, port := splitAddr(fw.ListenAddr)
+			udpChanged[port] = true
+		}
+	}
+
+	// Stop the tasks that are removed or need new settings before touching the sockets they use.
+	restartAll := !reflect.DeepEqual(keepAliveSettings(old), keepAliveSettings(cfg))
+	want := map[string]bool{}
+	if cfg.KeepAliveMode == "icmp" {
+		want["icmp"] = true
+	}
+	for i := range n.tcpOpens {
+		want[taskKey("tcp", &n.tcpOpens[i])] = true
+	}
+	for i := range n.udpOpens {
+		if !udpChanged[n.udpOpens[i].Port] {
+			want[taskKey("udp", &n.udpOpens[i])] = true
+		}
+	}
+	for key := range want {
+		if oldIntervals[key] != n.portIntervals[key] {
+			want[key] = false // per-port interval changed
+		}
+	}
+	for key, t := range n.tasks {
+		if restartAll || !want[key] {
+			t.stop()
+			delete(n.tasks, key)
+		}
+	}
+
+	// Close the old listeners now so the new forwarders own their ports; UDP sessions end
+	// with the socket, TCP connections are drained by Reload after the lock is released.
+	for _, fw := range goneTCP {
+		fw.StopAccepting()
+	}
+	for _, fw := range goneUDP {
+		fw.Stop()
+	}
+	n.startForwarders(newTCP, newUDP)
+	n.tcpFwds, n.udpFwds = tcpFwds, udpFwds
+	if restartAll {
+		n.logSTUNDisabled()
+	}
+	n.startTasks()
+	n.logger.Info("Configuration reloaded",
+		zap.Int("tcp_forwarders_started", len(newTCP)), zap.Int("udp_forwarders_started", len(newUDP)),
+		zap.Bool("tasks_restarted", restartAll))
+	return goneTCP, nil
+}
@@ -0,0 +1,94 @@
+package orchestrator
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"natter/internal/config"
+)
+
+// freeTCPPort returns a loopback TCP port that was free a moment ago.
+func freeTCPPort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestReloadDrainsOldForwardersWithoutHoldingLock(t *testing.T) {
+	backend, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close() // hold every connection open until the test ends
+		}
+	}()
+
+	open := net.JoinHostPort("127.0.0.1", strconv.Itoa(freeTCPPort(t)))
+	cfg := testConfig(t)
+	cfg.KeepAliveMode = "icmp" // no per-port keep-alive traffic from the restarted tasks
+	cfg.ShutdownTimeout = 1
+	cfg.OpenPort.TCP = config.PortList{{Addr: open}}
+	cfg.ForwardPort.TCP = config.TargetList{{Target: backend.Addr().String()}}
+	n := newTestNatter(t, cfg)
+	n.tasks = map[string]*task{}
+	if failed := n.startForwarders(n.tcpFwds, n.udpFwds); len(failed) > 0 {
+		t.Fatalf("start forwarders: %v", failed[0])
+	}
+	defer func() { n.stopForwarders(n.tcpFwds, n.udpFwds, time.Second) }()
+
+	// An idle client connection keeps the old forwarder busy for its 10-minute idle timeout
+	client, err := net.Dial("tcp4", open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Changing a global forward option recreates every forwarder
+	next := *cfg
+	next.Forward.MaxConns = 5
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() { done <- n.Reload(&next) }()
+
+	time.Sleep(200 * time.Millisecond)
+	if !n.mu.TryLock() {
+		t.Fatal("n.mu is held while old forwarders drain")
+	}
+	n.mu.Unlock()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reload did not return after shutdown_timeout")
+	}
+	if d := time.Since(start); d < time.Second {
+		t.Fatalf("Reload returned after %s, before the 1s grace period", d)
+	}
+	// The old connection was force-closed after the grace period
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Fatal("old connection is still open after reload")
+	}
+	// The new forwarder accepts on the same port
+	c, err := net.Dial("tcp4", open)
+	if err != nil {
+		t.Fatalf("new forwarder not listening: %v", err)
+	}
+	c.Close()
+}
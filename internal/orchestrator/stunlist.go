@@ -0,0 +1,120 @@
+package orchestrator
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"natter/internal/config"
+	"natter/internal/stun"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultServerListRefresh is used when stun_server.refresh_interval is 0.
+	defaultServerListRefresh = time.Hour
+	// serverListFetchTimeout bounds a single fetch of a server list URL.
+	serverListFetchTimeout = 10 * time.Second
+)
+
+// serverListURLs returns the server list URLs in stun_server.tcp and stun_server.udp.
+func serverListURLs(cfg *config.Config) []string {
+	var urls []string
+	for _, s := range slices.Concat(cfg.StunServer.TCP, cfg.StunServer.UDP) {
+		if config.IsServerURL(s) && !slices.Contains(urls, s) {
+			urls = append(urls, s)
+		}
+	}
+	return urls
+}
+
+// expandServers replaces every URL in list with the servers last fetched from it
+// (nothing if it has never been fetched) and drops duplicates, keeping the order.
+func expandServers(list []string, fetched map[string][]string) []string {
+	var out []string
+	add := func(s string) {
+		if !slices.Contains(out, s) {
+			out = append(out, s)
+		}
+	}
+	for _, s := range list {
+		if !config.IsServerURL(s) {
+			add(s)
+			continue
+		}
+		for _, f := range fetched[s] {
+			add(f)
+		}
+	}
+	return out
+}
+
+// fetchServerLists fetches urls and returns the new cache. A URL that fails keeps the
+// list from old, so a flaky list server never empties the STUN server set; URLs no
+// longer configured are dropped.
+func (n *Natter) fetchServerLists(ctx context.Context, urls []string, old map[string][]string) map[string][]string {
+	out := make(map[string][]string, len(urls))
+	for _, u := range urls {
+		fctx, cancel := context.WithTimeout(ctx, serverListFetchTimeout)
+		servers, err := stun.FetchServers(fctx, u)
+		cancel()
+		if err != nil {
+			if prev, ok := old[u]; ok {
+				n.logger.Warn("Failed to fetch STUN server list, keeping the last one",
+					zap.String("url", u), zap.Int("servers", len(prev)), zap.Error(err))
+				out[u] = prev
+			} else {
+				n.logger.Warn("Failed to fetch STUN server list", zap.String("url", u), zap.Error(err))
+			}
+			continue
+		}
+		if !slices.Equal(servers, old[u]) {
+			n.logger.Info("STUN server list updated", zap.String("url", u), zap.Strings("servers", servers))
+		}
+		out[u] = servers
+	}
+	return out
+}
+
+// applyServerLists hands the configured STUN servers, with URLs expanded, to the
+// client. The caller must hold n.mu.
+func (n *Natter) applyServerLists() {
+	n.stunClient.SetServers(expandServers(n.cfg.StunServer.TCP, n.serverLists),
+		expandServers(n.cfg.StunServer.UDP, n.serverLists))
+}
+
+// refreshServerLists re-fetches the server list URLs every stun_server.refresh_interval,
+// and right away when Reload signals n.serverListKick, until ctx is done.
+func (n *Natter) refreshServerLists(ctx context.Context) {
+	for {
+		n.mu.Lock()
+		every := time.Duration(n.cfg.StunServer.RefreshInterval) * time.Second
+		n.mu.Unlock()
+		var tick <-chan time.Time
+		switch {
+		case every == 0:
+			tick = n.clock.After(defaultServerListRefresh)
+		case every > 0:
+			tick = n.clock.After(every)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+		case <-n.serverListKick:
+		}
+
+		n.mu.Lock()
+		urls, old := serverListURLs(n.cfg), n.serverLists
+		n.mu.Unlock()
+		lists := n.fetchServerLists(ctx, urls, old)
+		if ctx.Err() != nil {
+			return
+		}
+		n.mu.Lock()
+		n.serverLists = lists
+		n.applyServerLists()
+		n.mu.Unlock()
+	}
+}
@@ -0,0 +1,104 @@
+package orchestrator
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"natter/internal/clock"
+	"natter/internal/config"
+)
+
+func TestRunWorkerZeroIntervalDoesNotBusyLoop(t *testing.T) {
+	server, requests := stunResponder(t)
+	cfg := testConfig(t)
+	cfg.StunServer.UDP = []string{server}
+	fake := clock.NewFake(time.Unix(1_700_000_000, 0))
+	n := newTestNatter(t, cfg, WithClock(fake))
+	n.stunClient.SetBindIP(n.bindIP)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: freeUDPPort(t)}
+	go n.runWorker(ctx, "udp", addr, nil, nil, pollSettings{interval: 0})
+
+	// The first query happens at once; afterwards the worker must wait for the clock
+	deadline := time.Now().Add(2 * time.Second)
+	for requests.Load() == 0 || fake.Waiters() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("worker made no STUN query")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if got := requests.Load(); got != 1 {
+		t.Fatalf("%d STUN queries within 300ms with a zero interval, want 1", got)
+	}
+
+	// The floor is 5 seconds: the next query follows once the clock gets there
+	fake.Add(5 * time.Second)
+	deadline = time.Now().Add(2 * time.Second)
+	for requests.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("worker did not query again after the 5s floor")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestUDPMappingUsesListenPort(t *testing.T) {
+	server, _ := stunResponder(t)
+	target, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	// One port owned by a UDP forwarder, one by a standalone keep-alive socket
+	forwarded, standalone := freeUDPPort(t), freeUDPPort(t)
+	cfg := testConfig(t)
+	cfg.StunServer.UDP = []string{server}
+	cfg.KeepAlive = []string{"127.0.0.2"} // nothing listens there; keep-alives just need a host
+	cfg.OpenPort.UDP = config.PortList{
+		{Addr: net.JoinHostPort("127.0.0.1", strconv.Itoa(forwarded))},
+		{Addr: net.JoinHostPort("127.0.0.1", strconv.Itoa(standalone))},
+	}
+	cfg.ForwardPort.UDP = config.TargetList{{Target: target.LocalAddr().String()}, {Target: "127.0.0.1:0"}}
+	n := newTestNatter(t, cfg)
+	n.stunClient.SetBindIP(n.bindIP)
+	n.udpFwds = n.udpFwds[:1] // the second port keeps only its keep-alive
+	n.tasks = map[string]*task{}
+	if failed := n.startForwarders(n.tcpFwds, n.udpFwds); len(failed) > 0 {
+		t.Fatalf("start forwarders: %v", failed[0])
+	}
+	defer n.stopForwarders(n.tcpFwds, n.udpFwds, time.Second)
+	n.mu.Lock()
+	n.startTasks()
+	n.mu.Unlock()
+	defer func() {
+		for _, task := range n.tasks {
+			task.stop()
+		}
+	}()
+
+	want := map[int]bool{forwarded: true, standalone: true}
+	timeout := time.After(5 * time.Second)
+	for len(want) > 0 {
+		select {
+		case ev := <-n.statusMgr.Updates:
+			_, port, err := net.SplitHostPort(ev.OuterAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, _ := strconv.Atoi(port)
+			if !want[p] {
+				t.Fatalf("mapping %s -> %s does not keep a listen port", ev.InnerAddr, ev.OuterAddr)
+			}
+			delete(want, p)
+		case <-timeout:
+			t.Fatalf("no mapping reported for ports %v", want)
+		}
+	}
+}
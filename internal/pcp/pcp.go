@@ -0,0 +1,232 @@
+// Package pcp 实现 Port Control Protocol（RFC 6887）客户端的 MAP 请求，向默认网关申请端口映射。
+// PCP 是 NAT-PMP 的后继协议，支持更长的租期，较新的家用路由器与部分运营商级 NAT 支持它。
+//
+// 与 NAT-PMP 一样，映射只针对发起请求的主机，AddTCP/AddUDP 的 internalIP 参数
+// 仅为与 upnp.Client 保持一致的接口；PCP 报文中的客户端地址取自实际发出请求的本地地址。
+package pcp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"natter/internal/gateway"
+)
+
+// Port 是 PCP 服务端口（与 NAT-PMP 相同）
+const Port = 5351
+
+const (
+	version        = 2
+	opAnnounce     = 0
+	opMap          = 1
+	headerLen      = 24
+	mapPayloadLen  = 36
+	protoTCP       = 6
+	protoUDP       = 17
+	initialTimeout = 250 * time.Millisecond
+	maxAttempts    = 4
+)
+
+// permanentLifetime 在调用方请求“永久”（durationSec = 0）时使用；
+// PCP 中 lifetime 0 表示删除映射，因此改为最大值，由服务器自行截短。
+const permanentLifetime = 1<<31 - 1
+
+// ResultError 是服务器返回的非零结果码
+type ResultError uint8
+
+// 常见结果码（RFC 6887 7.4）
+const (
+	UnsuppVersion ResultError = 1
+	NotAuthorized ResultError = 2
+	UnsuppOpcode  ResultError = 4
+)
+
+var resultNames = map[ResultError]string{
+	1: "UNSUPP_VERSION", 2: "NOT_AUTHORIZED", 3: "MALFORMED_REQUEST", 4: "UNSUPP_OPCODE",
+	5: "UNSUPP_OPTION", 6: "MALFORMED_OPTION", 7: "NETWORK_FAILURE", 8: "NO_RESOURCES",
+	9: "UNSUPP_PROTOCOL", 10: "USER_EX_QUOTA", 11: "CANNOT_PROVIDE_EXTERNAL",
+	12: "ADDRESS_MISMATCH", 13: "EXCESSIVE_REMOTE_PEERS",
+}
+
+func (e ResultError) Error() string {
+	if name, ok := resultNames[e]; ok {
+		return "pcp: " + name
+	}
+	return "pcp: result code " + strconv.Itoa(int(e))
+}
+
+// Client 与网关上的 PCP 服务通信。零值无效，必须通过 Discover 创建。
+type Client struct {
+	gateway net.IP
+	local   *net.UDPAddr // 请求的源地址，nil 时由系统选择
+	logger  *zap.Logger
+
+	mu     sync.Mutex
+	nonces map[string][12]byte // "proto/port" -> nonce；续期同一映射时必须使用相同 nonce
+}
+
+// Discover 找到默认网关并发送 ANNOUNCE 请求，以确认网关支持 PCP。
+// 只支持 NAT-PMP 的网关会返回 UNSUPP_VERSION，此时返回的错误可用 errors.Is(err, UnsuppVersion) 判断。
+// local 是本机出口 IP：无法读取路由表时据此推测网关（见 gateway.Default），请求也从该地址发出。
+// ctx 结束时放弃等待。
+func Discover(ctx context.Context, local net.IP, logger *zap.Logger) (*Client, error) {
+	gw, err := gateway.Default(local)
+	if err != nil {
+		return nil, fmt.Errorf("pcp discover: %w", err)
+	}
+	c := &Client{gateway: gw, logger: logger, nonces: map[string][12]byte{}}
+	if ip := local.To4(); ip != nil && !ip.IsLoopback() && !ip.IsUnspecified() {
+		c.local = &net.UDPAddr{IP: ip}
+	}
+	if _, err := c.call(ctx, opAnnounce, 0, nil); err != nil {
+		return nil, fmt.Errorf("pcp discover (gateway %s): %w", gw, err)
+	}
+	logger.Info("PCP server found", zap.Stringer("gateway", gw))
+	return c, nil
+}
+
+// AddTCP 为本机 internalPort 申请 TCP 映射，建议外部端口为 externalPort，返回服务器实际分配的外部端口。
+// durationSec = 0 代表尽可能长的租期。
+func (c *Client) AddTCP(ctx context.Context, externalPort, internalPort int, internalIP string, durationSec uint32) (int, error) {
+	return c.add(ctx, protoTCP, externalPort, internalPort, durationSec)
+}
+
+// AddUDP 为本机 internalPort 申请 UDP 映射。
+func (c *Client) AddUDP(ctx context.Context, externalPort, internalPort int, internalIP string, durationSec uint32) (int, error) {
+	return c.add(ctx, protoUDP, externalPort, internalPort, durationSec)
+}
+
+// DeleteTCP 删除本机 internalPort 的 TCP 映射（租期为 0 的 MAP 请求，nonce 与申请时相同）。
+func (c *Client) DeleteTCP(ctx context.Context, externalPort, internalPort int) error {
+	return c.delete(ctx, protoTCP, externalPort, internalPort)
+}
+
+// DeleteUDP 删除本机 internalPort 的 UDP 映射。
+func (c *Client) DeleteUDP(ctx context.Context, externalPort, internalPort int) error {
+	return c.delete(ctx, protoUDP, externalPort, internalPort)
+}
+
+func (c *Client) add(ctx context.Context, proto byte, ext, in int, dur uint32) (int, error) {
+	if dur == 0 {
+		dur = permanentLifetime
+	}
+	res, err := c.mapPort(ctx, proto, ext, in, dur)
+	if err != nil {
+		return 0, fmt.Errorf("pcp map (%s %d): %w", protoName(proto), ext, err)
+	}
+	lifetime := binary.BigEndian.Uint32(res[4:])
+	p := res[headerLen:]
+	mapped := int(binary.BigEndian.Uint16(p[18:]))
+	extIP := net.IP(append([]byte(nil), p[20:36]...))
+	if mapped != ext {
+		c.logger.Debug("PCP assigned a different external port", zap.String("proto", protoName(proto)), zap.Int("requested", ext), zap.Int("assigned", mapped))
+	}
+	c.logger.Debug("PCP port-mapping added", zap.String("proto", protoName(proto)),
+		zap.String("outer", net.JoinHostPort(extIP.String(), strconv.Itoa(mapped))), zap.Int("inner", in), zap.Uint32("lifetime", lifetime))
+	return mapped, nil
+}
+
+func (c *Client) delete(ctx context.Context, proto byte, ext, in int) error {
+	if _, err := c.mapPort(ctx, proto, ext, in, 0); err != nil {
+		return fmt.Errorf("pcp unmap (%s %d): %w", protoName(proto), ext, err)
+	}
+	c.logger.Debug("PCP port-mapping deleted", zap.String("proto", protoName(proto)), zap.Int("outer", ext), zap.Int("inner", in))
+	return nil
+}
+
+// mapPort 发送 MAP 请求并返回完整响应；lifetime 为 0 时服务器删除该映射
+func (c *Client) mapPort(ctx context.Context, proto byte, ext, in int, lifetime uint32) ([]byte, error) {
+	payload := make([]byte, mapPayloadLen)
+	nonce := c.nonce(proto, in)
+	copy(payload[0:12], nonce[:])
+	payload[12] = proto
+	binary.BigEndian.PutUint16(payload[16:], uint16(in))
+	binary.BigEndian.PutUint16(payload[18:], uint16(ext))
+	copy(payload[20:36], net.IPv4zero.To16()) // 不指定外部地址（::ffff:0.0.0.0）
+	return c.call(ctx, opMap, lifetime, payload)
+}
+
+// nonce 返回映射对应的 nonce，首次使用时随机生成
+func (c *Client) nonce(proto byte, port int) [12]byte {
+	key := protoName(proto) + "/" + strconv.Itoa(port)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, ok := c.nonces[key]
+	if !ok {
+		_, _ = rand.Read(n[:])
+		c.nonces[key] = n
+	}
+	return n
+}
+
+// call 发送请求并等待操作码匹配的响应；payload 为操作码相关数据。
+func (c *Client) call(ctx context.Context, op byte, lifetime uint32, payload []byte) ([]byte, error) {
+	conn, err := net.DialUDP("udp4", c.local, &net.UDPAddr{IP: c.gateway, Port: Port})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	req := make([]byte, headerLen+len(payload))
+	req[0] = version
+	req[1] = op
+	binary.BigEndian.PutUint32(req[4:], lifetime)
+	copy(req[8:24], conn.LocalAddr().(*net.UDPAddr).IP.To16())
+	copy(req[headerLen:], payload)
+
+	buf := make([]byte, 1100) // PCP 报文最大 1100 字节
+	timeout := initialTimeout
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(timeout))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				var ne net.Error
+				if errors.As(err, &ne) && ne.Timeout() {
+					break
+				}
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				return nil, err
+			}
+			if n >= 4 && buf[0] == 0 {
+				// 只支持 NAT-PMP 的网关以版本 0 回复
+				return nil, UnsuppVersion
+			}
+			if n < headerLen || buf[0] != version || buf[1] != op|0x80 {
+				continue
+			}
+			if code := ResultError(buf[3]); code != 0 {
+				return nil, code
+			}
+			if op == opMap && (n < headerLen+mapPayloadLen || string(buf[headerLen:headerLen+12]) != string(payload[:12])) {
+				continue // 不是本次请求的响应
+			}
+			return append([]byte(nil), buf[:n]...), nil
+		}
+		timeout *= 2
+	}
+	return nil, fmt.Errorf("pcp: no response from %s", c.gateway)
+}
+
+func protoName(proto byte) string {
+	if proto == protoTCP {
+		return "TCP"
+	}
+	return "UDP"
+}
@@ -0,0 +1,65 @@
+package status
+
+import "sort"
+
+// Format 决定状态文件与 /status 的 JSON 结构
+type Format string
+
+const (
+	// FormatGrouped 按协议分组：{"tcp": [...], "udp": [...], "keepalive": [...], ...}，默认格式
+	FormatGrouped Format = "grouped"
+	// FormatFlat 所有映射组成一个数组：[{"protocol", "inner", "outer", ...}]
+	FormatFlat Format = "flat"
+	// FormatKeyed 以内部地址为键：{"IP:Port": {"tcp": {...}, "udp": {...}}}
+	FormatKeyed Format = "keyed"
+)
+
+// WithFormat 设置状态文件格式，空字符串保持默认的 FormatGrouped
+func WithFormat(f Format) Option {
+	return func(m *StatusManager) {
+		if f != "" {
+			m.format = f
+		}
+	}
+}
+
+// flatRecord 是 FormatFlat 中的一条映射，在 mappingRecord 的字段前加上协议
+type flatRecord struct {
+	Protocol string `json:"protocol"`
+	*mappingRecord
+}
+
+// renderLocked 按 m.format 构造要序列化的内容；调用方需持有 mutex。
+// flat 与 keyed 只包含映射，保活状态、转发统计等仅出现在 grouped 格式中
+func (m *StatusManager) renderLocked() any {
+	switch m.format {
+	case FormatFlat:
+		out := []flatRecord{}
+		for protocol, amap := range m.mappings {
+			for _, rec := range amap {
+				out = append(out, flatRecord{Protocol: protocol, mappingRecord: rec})
+			}
+		}
+		sort.Slice(out, func(i, j int) bool {
+			if out[i].Inner != out[j].Inner {
+				return out[i].Inner < out[j].Inner
+			}
+			return out[i].Protocol < out[j].Protocol
+		})
+		return out
+	case FormatKeyed:
+		// 同一内部地址可能同时开放 TCP 与 UDP，因此值再按协议区分
+		out := map[string]map[string]*mappingRecord{}
+		for protocol, amap := range m.mappings {
+			for inner, rec := range amap {
+				if out[inner] == nil {
+					out[inner] = map[string]*mappingRecord{}
+				}
+				out[inner][protocol] = rec
+			}
+		}
+		return out
+	default:
+		return m.snapshotLocked()
+	}
+}
@@ -0,0 +1,100 @@
+package status
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"natter/internal/clock"
+
+	"go.uber.org/zap"
+)
+
+// writeStatus 以 format 格式记录两条内部地址相同的 TCP 与 UDP 映射及一条 UDP 映射，返回状态文件内容
+func writeStatus(t *testing.T, format Format) []byte {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "status.json")
+	m, err := NewManager(path, "", zap.NewNop(), WithFormat(format), WithClock(clock.NewFake(time.Unix(1_700_000_000, 0))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.handleEvent(UpdateEvent{Protocol: "udp", InnerAddr: "10.0.0.2:5000", OuterAddr: "203.0.113.7:6000"})
+	m.handleEvent(UpdateEvent{Protocol: "tcp", InnerAddr: "10.0.0.2:5000", OuterAddr: "203.0.113.7:5000"})
+	m.handleEvent(UpdateEvent{Protocol: "udp", InnerAddr: "10.0.0.2:4000", OuterAddr: "203.0.113.7:4000", Symmetric: true})
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestFormatGrouped(t *testing.T) {
+	for _, format := range []Format{"", FormatGrouped} {
+		var got struct {
+			TCP       []mappingRecord `json:"tcp"`
+			UDP       []mappingRecord `json:"udp"`
+			KeepAlive []any           `json:"keepalive"`
+		}
+		if err := json.Unmarshal(writeStatus(t, format), &got); err != nil {
+			t.Fatalf("format %q: %v", format, err)
+		}
+		if len(got.TCP) != 1 || got.TCP[0].Inner != "10.0.0.2:5000" || got.TCP[0].Outer != "203.0.113.7:5000" {
+			t.Errorf("format %q: tcp = %+v", format, got.TCP)
+		}
+		if len(got.UDP) != 2 {
+			t.Fatalf("format %q: got %d udp mappings, want 2", format, len(got.UDP))
+		}
+		if got.KeepAlive == nil {
+			t.Errorf("format %q: grouped status has no keepalive field", format)
+		}
+	}
+}
+
+func TestFormatFlat(t *testing.T) {
+	var got []struct {
+		Protocol string `json:"protocol"`
+		mappingRecord
+	}
+	if err := json.Unmarshal(writeStatus(t, FormatFlat), &got); err != nil {
+		t.Fatal(err)
+	}
+	// 按内部地址、再按协议排序
+	want := [][3]string{
+		{"udp", "10.0.0.2:4000", "203.0.113.7:4000"},
+		{"tcp", "10.0.0.2:5000", "203.0.113.7:5000"},
+		{"udp", "10.0.0.2:5000", "203.0.113.7:6000"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d records, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		if got[i].Protocol != w[0] || got[i].Inner != w[1] || got[i].Outer != w[2] {
+			t.Errorf("record %d = %s %s -> %s, want %s %s -> %s", i, got[i].Protocol, got[i].Inner, got[i].Outer, w[0], w[1], w[2])
+		}
+		if got[i].LastUpdated.IsZero() {
+			t.Errorf("record %d has no last_updated", i)
+		}
+	}
+	if !got[0].Symmetric {
+		t.Error("symmetric flag lost in flat format")
+	}
+}
+
+func TestFormatKeyed(t *testing.T) {
+	var got map[string]map[string]mappingRecord
+	if err := json.Unmarshal(writeStatus(t, FormatKeyed), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d inner addresses, want 2", len(got))
+	}
+	both := got["10.0.0.2:5000"]
+	if both["tcp"].Outer != "203.0.113.7:5000" || both["udp"].Outer != "203.0.113.7:6000" {
+		t.Errorf("10.0.0.2:5000 = %+v, want tcp and udp mappings", both)
+	}
+	if one := got["10.0.0.2:4000"]; len(one) != 1 || one["udp"].Outer != "203.0.113.7:4000" {
+		t.Errorf("10.0.0.2:4000 = %+v, want only the udp mapping", one)
+	}
+}
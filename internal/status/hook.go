@@ -0,0 +1,193 @@
+package status
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.uber.org/zap"
+)
+
+// DefaultHookTimeout 是 Hook 命令的默认最长运行时间
+const DefaultHookTimeout = 30 * time.Second
+
+// maxHookStderr 是记录到日志中的 stderr 最大字节数
+const maxHookStderr = 4096
+
+// WithHookTimeout 设置 Hook 命令的默认最长运行时间，超时后进程被杀死；<= 0 时使用 DefaultHookTimeout
+func WithHookTimeout(d time.Duration) Option {
+	return func(m *StatusManager) {
+		if d > 0 {
+			m.hookTimeout = d
+		}
+	}
+}
+
+// commandHook 是一个命令行 Hook
+type commandHook struct {
+	cmd     string
+	timeout time.Duration // <= 0 时使用 StatusManager 的 hookTimeout
+}
+
+// WithCommandHook 追加一个命令行 Hook；可多次调用，各 Hook 互相独立执行
+func WithCommandHook(cmd string, timeout time.Duration) Option {
+	return func(m *StatusManager) {
+		if strings.TrimSpace(cmd) != "" {
+			m.commands = append(m.commands, commandHook{cmd: cmd, timeout: timeout})
+		}
+	}
+}
+
+// runHook 直接执行 h.cmd（不经过 shell），映射信息通过环境变量
+// NATTER_INNER、NATTER_OUTER、NATTER_PROTOCOL 传递，NATTER_EVENT 为 "update" 或 "remove"。
+// 各参数中的 {inner} {outer} {protocol} 占位符仍会替换，但只作为普通参数，不会被 shell 解释。
+// 命令在后台协程中运行并等待结束，受超时与 Run 的 ctx 约束；
+// 启动失败、非零退出或超时时以 warn 级别记录退出码与 stderr。
+func (m *StatusManager) runHook(h commandHook, ev UpdateEvent) {
+	args, err := splitArgs(h.cmd)
+	if err != nil {
+		m.logger.Warn("Invalid hook command", zap.String("hook", h.cmd), zap.Error(err))
+		return
+	}
+	if len(args) == 0 {
+		return
+	}
+	for i, a := range args {
+		args[i] = expandPlaceholders(a, ev)
+	}
+	m.logger.Debug("Executing hook", zap.Strings("args", args))
+
+	timeout := h.timeout
+	if timeout <= 0 {
+		timeout = m.hookTimeout
+	}
+	ctx, cancel := context.WithTimeout(m.ctx, timeout)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"NATTER_INNER="+ev.InnerAddr,
+		"NATTER_OUTER="+ev.OuterAddr,
+		"NATTER_PROTOCOL="+ev.Protocol,
+		"NATTER_EVENT="+eventName(ev),
+	)
+	stderr := &limitedBuffer{max: maxHookStderr}
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		cancel()
+		m.logger.Warn("Hook start failed", zap.String("cmd", args[0]), zap.Error(err))
+		m.audit.Info("hook_executed", zap.String("type", "command"), zap.Strings("args", args),
+			zap.String("inner", ev.InnerAddr), zap.String("outer", ev.OuterAddr), zap.Bool("ok", false), zap.Error(err))
+		return
+	}
+
+	go func() {
+		defer cancel()
+		start := time.Now()
+		err := cmd.Wait()
+		m.audit.Info("hook_executed", zap.String("type", "command"), zap.Strings("args", args),
+			zap.String("inner", ev.InnerAddr), zap.String("outer", ev.OuterAddr), zap.Bool("ok", err == nil),
+			zap.Int("exit_code", cmd.ProcessState.ExitCode()), zap.Duration("took", time.Since(start)), zap.Error(err))
+		if err == nil {
+			m.logger.Debug("Hook finished", zap.String("cmd", args[0]), zap.Duration("took", time.Since(start)))
+			return
+		}
+		fields := []zap.Field{zap.String("cmd", args[0]), zap.Error(err), zap.String("stderr", strings.TrimSpace(stderr.String()))}
+		if ctx.Err() == context.DeadlineExceeded {
+			fields = append(fields, zap.Duration("timeout", timeout))
+		}
+		if ee, ok := err.(*exec.ExitError); ok {
+			fields = append(fields, zap.Int("exit_code", ee.ExitCode()))
+		}
+		m.logger.Warn("Hook failed", fields...)
+	}()
+}
+
+// limitedBuffer 只保留前 max 字节，避免 Hook 大量输出占用内存
+type limitedBuffer struct {
+	buf bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.buf.Len(); room > 0 {
+		if len(p) > room {
+			b.buf.Write(p[:room])
+		} else {
+			b.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string { return b.buf.String() }
+
+// eventName 返回事件类型名，供 Hook 环境变量与 Webhook 使用
+func eventName(ev UpdateEvent) string {
+	if ev.Removed {
+		return "remove"
+	}
+	return "update"
+}
+
+// expandPlaceholders 用实际地址替换占位符
+func expandPlaceholders(s string, ev UpdateEvent) string {
+	s = strings.ReplaceAll(s, "{inner}", ev.InnerAddr)
+	s = strings.ReplaceAll(s, "{outer}", ev.OuterAddr)
+	s = strings.ReplaceAll(s, "{protocol}", ev.Protocol)
+	return s
+}
+
+// splitArgs 按空白拆分命令行，支持单引号、双引号与反斜杠转义（双引号内仅转义 " 与 \）
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case quote == '"':
+			switch r {
+			case '"':
+				quote = 0
+			case '\\':
+				escaped = true
+			default:
+				cur.WriteRune(r)
+			}
+		case r == '\\':
+			escaped, inArg = true, true
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape")
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
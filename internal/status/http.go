@@ -0,0 +1,85 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Handler 返回状态查询的 HTTP 处理器：
+//   - /status  返回与状态文件相同的 JSON（格式同 WithFormat）
+//   - /healthz 至少有一条映射时返回 200，否则 503
+func (m *StatusManager) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		m.mutex.Lock()
+		snap := m.renderLocked()
+		data, err := json.MarshalIndent(snap, "", "  ")
+		m.mutex.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(append(data, '\n'))
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		total := 0
+		for _, n := range m.MappingCounts() {
+			total += n
+		}
+		if total == 0 {
+			http.Error(w, "no mapping", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+	return mux
+}
+
+// MappingCounts 返回各协议当前已知的映射条数
+func (m *StatusManager) MappingCounts() map[string]int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	counts := make(map[string]int, len(m.mappings))
+	for proto, amap := range m.mappings {
+		counts[proto] = len(amap)
+	}
+	return counts
+}
+
+// KeepAliveCounts 返回各保活状态（"connected"、"sent"、"failing"）的保活循环个数
+func (m *StatusManager) KeepAliveCounts() map[string]int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	counts := make(map[string]int, 2)
+	for _, st := range m.keepAlives {
+		counts[st.State]++
+	}
+	return counts
+}
+
+// Serve 在 addr 上提供状态 HTTP 服务，直到 ctx 结束
+func (m *StatusManager) Serve(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: m.Handler(), ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		srv.Shutdown(shutCtx)
+	}()
+	m.logger.Info("Status HTTP server listening", zap.String("addr", ln.Addr().String()))
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -5,78 +5,202 @@ import (
 	"encoding/json"
 	"fmt"
 	"go.uber.org/zap"
+	"natter/internal/clock"
 	"os"
-	"os/exec"
-	"strings"
+	"path/filepath"
+	"slices"
+	"sort"
 	"sync"
+	"time"
 )
 
-// UpdateEvent 表示一个映射更新事件
+// UpdateEvent 表示一次成功的映射检测结果（外部地址可能未变化）
 type UpdateEvent struct {
 	Protocol  string // "tcp" 或 "udp"
 	InnerAddr string // 格式 "IP:Port"
 	OuterAddr string // 格式 "IP:Port"
+	Symmetric bool   // 外部端口与本地端口不同且每次检测都在变化，疑似对称型 NAT
+	Removed   bool   // 映射长时间未刷新被移除；仅由 StatusManager 内部产生并传给 Hook/Webhook
+}
+
+// KeepAliveEvent 表示一次保活尝试的结果
+type KeepAliveEvent struct {
+	Protocol  string // "tcp"、"udp" 或 "icmp"
+	LocalAddr string // 保活使用的本地地址
+	Remote    string // 保活目标
+	OK        bool
+	// Unconfirmed 表示 OK 只代表保活数据已发出、未收到回应（UDP 保活），状态记为 "sent"
+	Unconfirmed bool
+	Error       string // 失败原因
+	Time        time.Time
+}
+
+// ForwardStat 是单个转发器的流量统计，写入状态文件的 "forward" 字段
+type ForwardStat struct {
+	Protocol    string `json:"protocol"`
+	Listen      string `json:"listen"`
+	Target      string `json:"target"`
+	BytesIn     uint64 `json:"bytes_in"`  // 客户端 -> 目标
+	BytesOut    uint64 `json:"bytes_out"` // 目标 -> 客户端
+	ActiveConns int64  `json:"active_conns"`
+	TotalConns  uint64 `json:"total_conns"`
+}
+
+// RouterMapping 是 Natter 在路由器上添加的一条端口映射，写入状态文件的 "router_mappings" 字段
+type RouterMapping struct {
+	Protocol     string `json:"protocol"`
+	Inner        string `json:"inner"`         // 映射指向的内部地址 "IP:Port"
+	ExternalPort int    `json:"external_port"` // 路由器实际分配的外部端口，可能与申请的不同
+	Via          string `json:"via"`           // "UPnP"、"PCP" 或 "NAT-PMP"
+}
+
+// mappingRecord 是单条映射及其时间信息，写入状态文件的协议列表
+type mappingRecord struct {
+	Inner       string    `json:"inner"`
+	Outer       string    `json:"outer"`
+	FirstSeen   time.Time `json:"first_seen"`          // 首次观测到当前外部地址的时间
+	LastUpdated time.Time `json:"last_updated"`        // 最近一次 STUN 确认的时间
+	Symmetric   bool      `json:"symmetric,omitempty"` // 疑似对称型 NAT，外部地址对其他对端不可用
+}
+
+// keepAliveState 是单个保活循环的汇总状态，写入状态文件的 "keepalive" 字段
+type keepAliveState struct {
+	Protocol     string     `json:"protocol"`
+	Local        string     `json:"local"`
+	Remote       string     `json:"remote"`
+	State        string     `json:"state"` // "connected"、"sent"（UDP 只确认已发出）或 "failing"
+	FailingSince *time.Time `json:"failing_since,omitempty"`
+	LastSuccess  *time.Time `json:"last_success,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
 }
 
 // StatusManager 管理 NAT 映射状态，写入文件并执行 Hook
 type StatusManager struct {
-	Updates chan UpdateEvent
-	hookCmd string
-	file    *os.File
-	logger  *zap.Logger
+	Updates     chan UpdateEvent
+	KeepAlives  chan KeepAliveEvent
+	Forwards    chan []ForwardStat // 转发器统计快照，每次整体替换
+	commands    []commandHook
+	hookTimeout time.Duration   // 未单独设置超时的命令 Hook 使用
+	ctx         context.Context // Run 的 ctx，Hook 由它派生，关闭时一并取消
+	path        string          // 状态文件路径，每次写入临时文件后原子替换
+	logger      *zap.Logger
+	audit       *zap.Logger // 审计日志：映射变化与 Hook 执行，默认丢弃
 
-	mutex    sync.Mutex
-	mappings map[string]map[string]string // protocol -> inner -> outer
+	mutex      sync.Mutex
+	mappings   map[string]map[string]*mappingRecord // protocol -> inner -> record
+	keepAlives map[string]*keepAliveState           // protocol|local -> state
+	forwards   []ForwardStat
+	webhooks   []*webhook
+	staleAfter time.Duration   // 映射超过该时长未刷新即移除，0 表示不移除
+	routerIP   string          // 路由器（UPnP/NAT-PMP）报告的外部 IP，为空时不写入状态文件
+	routerMaps []RouterMapping // 路由器上由 Natter 添加的端口映射，为空时不写入状态文件
+	format     Format          // 状态文件格式，默认 FormatGrouped
+	clock      clock.Clock     // 映射时间戳、过期清理与 Webhook 重试退避的时钟，见 WithClock
+
+	listenersMu sync.Mutex
+	listeners   []*listener // 进程内监听器，按注册顺序调用
 }
 
-// NewManager 创建一个 StatusManager
-// filePath: 状态文件路径，hookCmd: 可选的命令模板，支持 {inner} {outer} 占位符
-func NewManager(filePath, hookCmd string, logger *zap.Logger) (*StatusManager, error) {
-	// 打开或创建文件
-	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
-	if err != nil {
-		return nil, fmt.Errorf("open status file: %w", err)
-	}
+// listener 包装回调，以指针区分，便于取消订阅
+type listener struct{ fn func(UpdateEvent) }
 
+// NewManager 创建一个 StatusManager
+// filePath: 状态文件路径，hookCmd: 可选的命令行，直接执行不经过 shell，
+// 映射信息通过环境变量传递，参数中也可使用 {inner} {outer} {protocol} 占位符；
+// 更多 Hook 可通过 WithCommandHook / WithWebhook 追加
+func NewManager(filePath, hookCmd string, logger *zap.Logger, opts ...Option) (*StatusManager, error) {
 	m := &StatusManager{
-		Updates:  make(chan UpdateEvent, 100),
-		hookCmd:  hookCmd,
-		file:     f,
-		logger:   logger,
-		mappings: map[string]map[string]string{"tcp": {}, "udp": {}},
+		Updates:     make(chan UpdateEvent, 100),
+		KeepAlives:  make(chan KeepAliveEvent, 100),
+		Forwards:    make(chan []ForwardStat, 1),
+		hookTimeout: DefaultHookTimeout,
+		ctx:         context.Background(),
+		path:        filePath,
+		logger:      logger,
+		audit:       zap.NewNop(),
+		mappings:    map[string]map[string]*mappingRecord{"tcp": {}, "udp": {}},
+		keepAlives:  map[string]*keepAliveState{},
+		format:      FormatGrouped,
+		clock:       clock.New(),
+	}
+	WithCommandHook(hookCmd, 0)(m)
+	for _, opt := range opts {
+		opt(m)
+	}
+	// 先写一份空状态，尽早暴露路径不可写等问题
+	if err := m.writeFile(); err != nil {
+		return nil, fmt.Errorf("write status file: %w", err)
 	}
 	return m, nil
 }
 
 // Run 启动状态管理循环，直到 ctx 结束
 func (m *StatusManager) Run(ctx context.Context) {
+	m.mutex.Lock()
+	m.ctx = ctx
+	m.mutex.Unlock()
 	m.logger.Info("StatusManager started")
+	for _, w := range m.webhooks {
+		go m.webhookLoop(ctx, w)
+	}
+
+	var prune <-chan time.Time
+	if m.staleAfter > 0 {
+		every := m.staleAfter / 4
+		if every < time.Second {
+			every = time.Second
+		}
+		ticker := m.clock.NewTicker(every)
+		defer ticker.Stop()
+		prune = ticker.C()
+	}
 	for {
 		select {
 		case <-ctx.Done():
 			m.logger.Info("StatusManager exiting")
-			m.file.Close()
 			return
 
+		case now := <-prune:
+			m.dispatch(m.pruneStale(now))
+
 		case ev := <-m.Updates:
-			m.handleEvent(ev)
+			m.dispatch(m.handleEvent(ev))
+
+		case ev := <-m.KeepAlives:
+			m.handleKeepAlive(ev)
+
+		case fs := <-m.Forwards:
+			m.handleForwards(fs)
 		}
 	}
 }
 
-// handleEvent 处理单次更新
-func (m *StatusManager) handleEvent(ev UpdateEvent) {
+// handleEvent 处理单次检测结果：映射未变化时只刷新 last_updated，变化时记录日志并执行 Hook；
+// 返回需要通知监听器的事件
+func (m *StatusManager) handleEvent(ev UpdateEvent) []UpdateEvent {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
+	now := m.clock.Now()
 	protocolMap := m.mappings[ev.Protocol]
-	old, exists := protocolMap[ev.InnerAddr]
-	if exists && old == ev.OuterAddr {
-		// 未变化，跳过
-		return
+	rec, exists := protocolMap[ev.InnerAddr]
+	if exists && rec.Outer == ev.OuterAddr {
+		// 未变化，仅刷新确认时间
+		rec.LastUpdated = now
+		rec.Symmetric = ev.Symmetric
+		if err := m.writeFile(); err != nil {
+			m.logger.Warn("Failed to write status file", zap.Error(err))
+		}
+		return nil
 	}
 	// 更新映射
-	protocolMap[ev.InnerAddr] = ev.OuterAddr
+	prev := ""
+	if exists {
+		prev = rec.Outer
+	}
+	m.audit.Info("mapping_changed", zap.String("protocol", ev.Protocol), zap.String("inner", ev.InnerAddr),
+		zap.String("outer", ev.OuterAddr), zap.String("previous", prev))
+	protocolMap[ev.InnerAddr] = &mappingRecord{Inner: ev.InnerAddr, Outer: ev.OuterAddr, FirstSeen: now, LastUpdated: now, Symmetric: ev.Symmetric}
 	m.logger.Info("Mapping updated", zap.String("protocol", ev.Protocol), zap.String("inner", ev.InnerAddr), zap.String("outer", ev.OuterAddr))
 
 	// 写入文件
@@ -84,46 +208,252 @@ func (m *StatusManager) handleEvent(ev UpdateEvent) {
 		m.logger.Warn("Failed to write status file", zap.Error(err))
 	}
 
-	// 执行 Hook
-	if m.hookCmd != "" {
-		cmdStr := m.expandHook(ev)
-		m.logger.Debug("Executing hook", zap.String("cmd", cmdStr))
-		exec.CommandContext(context.Background(), "sh", "-c", cmdStr).Start()
+	m.notify(ev, now)
+	return []UpdateEvent{ev}
+}
+
+// dispatch 依次调用监听器；在 Run 协程中调用，调用监听器时不持有任何锁
+func (m *StatusManager) dispatch(evs []UpdateEvent) {
+	if len(evs) == 0 {
+		return
+	}
+	m.listenersMu.Lock()
+	ls := slices.Clone(m.listeners)
+	m.listenersMu.Unlock()
+	for _, ev := range evs {
+		for _, l := range ls {
+			l.fn(ev)
+		}
+	}
+}
+
+// Subscribe 注册进程内监听器，映射变化或被移除时以 UpdateEvent 调用，相当于进程内的 Webhook；
+// 可在任意时刻调用，返回的函数用于取消订阅。监听器在状态管理协程中同步执行、不持有任何锁，
+// 耗时操作应自行转到其他协程
+func (m *StatusManager) Subscribe(fn func(UpdateEvent)) (unsubscribe func()) {
+	l := &listener{fn: fn}
+	m.listenersMu.Lock()
+	m.listeners = append(m.listeners, l)
+	m.listenersMu.Unlock()
+	return func() {
+		m.listenersMu.Lock()
+		defer m.listenersMu.Unlock()
+		m.listeners = slices.DeleteFunc(m.listeners, func(x *listener) bool { return x == l })
 	}
 }
 
-// writeFile 将当前 mappings 写入 JSON 文件
-func (m *StatusManager) writeFile() error {
-	// 准备结构
-	tmp := map[string][]map[string]string{"tcp": {}, "udp": {}}
+// WithListener 在创建时注册监听器，见 Subscribe
+func WithListener(fn func(UpdateEvent)) Option {
+	return func(m *StatusManager) {
+		if fn != nil {
+			m.Subscribe(fn)
+		}
+	}
+}
+
+// WithAuditLogger 将映射变化、移除以及每次 Hook/Webhook 执行的结果写入审计日志 l
+func WithAuditLogger(l *zap.Logger) Option {
+	return func(m *StatusManager) {
+		if l != nil {
+			m.audit = l
+		}
+	}
+}
+
+// notify 执行 Hook 并发送 Webhook；调用方需持有 mutex
+func (m *StatusManager) notify(ev UpdateEvent, at time.Time) {
+	// 每个 Hook 都在各自的协程中完成，一个失败或变慢不影响其他；
+	// 每个 Webhook 的通知排入各自的队列，按顺序投递
+	for _, h := range m.commands {
+		m.runHook(h, ev)
+	}
+	for _, w := range m.webhooks {
+		m.enqueueWebhook(w, ev, at)
+	}
+}
+
+// WithStaleAfter 使超过 d 未被 STUN 确认的映射从状态中移除，并以 Removed 事件通知 Hook/Webhook；d <= 0 时不移除
+func WithStaleAfter(d time.Duration) Option {
+	return func(m *StatusManager) {
+		if d > 0 {
+			m.staleAfter = d
+		}
+	}
+}
+
+// WithClock 替换映射时间戳、过期清理与 Webhook 重试退避使用的时钟，默认为真实时钟；测试中可传入 clock.Fake
+func WithClock(c clock.Clock) Option {
+	return func(m *StatusManager) {
+		if c != nil {
+			m.clock = c
+		}
+	}
+}
+
+// pruneStale 移除 last_updated 早于 now-staleAfter 的映射，返回被移除的事件
+func (m *StatusManager) pruneStale(now time.Time) []UpdateEvent {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var removed []UpdateEvent
+	for proto, amap := range m.mappings {
+		for inner, rec := range amap {
+			if now.Sub(rec.LastUpdated) <= m.staleAfter {
+				continue
+			}
+			delete(amap, inner)
+			ev := UpdateEvent{Protocol: proto, InnerAddr: inner, OuterAddr: rec.Outer, Removed: true}
+			removed = append(removed, ev)
+			m.logger.Info("Mapping removed (stale)", zap.String("protocol", proto), zap.String("inner", inner),
+				zap.String("outer", rec.Outer), zap.Time("last_updated", rec.LastUpdated))
+			m.audit.Info("mapping_removed", zap.String("protocol", proto), zap.String("inner", inner),
+				zap.String("outer", rec.Outer), zap.Time("last_updated", rec.LastUpdated))
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	if err := m.writeFile(); err != nil {
+		m.logger.Warn("Failed to write status file", zap.Error(err))
+	}
+	for _, ev := range removed {
+		m.notify(ev, now)
+	}
+	return removed
+}
+
+// handleKeepAlive 汇总保活结果，状态切换时记录日志
+func (m *StatusManager) handleKeepAlive(ev KeepAliveEvent) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	key := ev.Protocol + "|" + ev.LocalAddr
+	st, ok := m.keepAlives[key]
+	if !ok {
+		st = &keepAliveState{Protocol: ev.Protocol, Local: ev.LocalAddr}
+		m.keepAlives[key] = st
+	}
+	st.Remote = ev.Remote
+	t := ev.Time
+	if ev.OK {
+		if st.State == "failing" {
+			m.logger.Info("Keep-alive recovered", zap.String("protocol", ev.Protocol), zap.String("local", ev.LocalAddr), zap.String("remote", ev.Remote))
+		}
+		st.State = "connected"
+		if ev.Unconfirmed {
+			st.State = "sent"
+		}
+		st.FailingSince = nil
+		st.LastSuccess = &t
+		st.LastError = ""
+	} else {
+		if st.State != "failing" {
+			m.logger.Warn("Keep-alive failing", zap.String("protocol", ev.Protocol), zap.String("local", ev.LocalAddr), zap.String("remote", ev.Remote), zap.String("error", ev.Error))
+			st.FailingSince = &t
+		}
+		st.State = "failing"
+		st.LastError = ev.Error
+	}
+
+	if err := m.writeFile(); err != nil {
+		m.logger.Warn("Failed to write status file", zap.Error(err))
+	}
+}
+
+// handleForwards 记录最新的转发统计并刷新状态文件
+func (m *StatusManager) handleForwards(fs []ForwardStat) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.forwards = fs
+	if err := m.writeFile(); err != nil {
+		m.logger.Warn("Failed to write status file", zap.Error(err))
+	}
+}
+
+// SetRouterExternalIP 记录路由器报告的 WAN 地址，写入状态文件的 "router_external_ip" 字段
+func (m *StatusManager) SetRouterExternalIP(ip string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.routerIP = ip
+	if err := m.writeFile(); err != nil {
+		m.logger.Warn("Failed to write status file", zap.Error(err))
+	}
+}
+
+// SetRouterMappings 替换路由器端口映射列表，写入状态文件的 "router_mappings" 字段，为空时不写入
+func (m *StatusManager) SetRouterMappings(ms []RouterMapping) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.routerMaps = ms
+	if err := m.writeFile(); err != nil {
+		m.logger.Warn("Failed to write status file", zap.Error(err))
+	}
+}
+
+// snapshotLocked 构造状态文件内容：各协议映射、保活状态与转发统计；调用方需持有 mutex
+func (m *StatusManager) snapshotLocked() map[string]any {
+	tmp := map[string]any{}
 	for protocol, amap := range m.mappings {
-		for inner, outer := range amap {
-			rec := map[string]string{"inner": inner, "outer": outer}
-			tmp[protocol] = append(tmp[protocol], rec)
+		recs := make([]*mappingRecord, 0, len(amap))
+		for _, rec := range amap {
+			recs = append(recs, rec)
 		}
+		sort.Slice(recs, func(i, j int) bool { return recs[i].Inner < recs[j].Inner })
+		tmp[protocol] = recs
+	}
+	kas := make([]*keepAliveState, 0, len(m.keepAlives))
+	for _, st := range m.keepAlives {
+		kas = append(kas, st)
 	}
+	sort.Slice(kas, func(i, j int) bool {
+		if kas[i].Protocol != kas[j].Protocol {
+			return kas[i].Protocol < kas[j].Protocol
+		}
+		return kas[i].Local < kas[j].Local
+	})
+	tmp["keepalive"] = kas
+	if m.forwards != nil {
+		tmp["forward"] = m.forwards
+	}
+	if m.routerIP != "" {
+		tmp["router_external_ip"] = m.routerIP
+	}
+	if len(m.routerMaps) > 0 {
+		tmp["router_mappings"] = m.routerMaps
+	}
+	return tmp
+}
 
-	// 清空并写入
-	if _, err := m.file.Seek(0, 0); err != nil {
-		return err
+// writeFile 将当前状态按 m.format 写入 JSON 文件
+func (m *StatusManager) writeFile() error {
+	tmp := m.renderLocked()
+
+	// 写入同目录下的临时文件再重命名，读者不会看到写了一半的内容
+	dir, base := filepath.Split(m.path)
+	if dir == "" {
+		dir = "."
 	}
-	if err := m.file.Truncate(0); err != nil {
+	f, err := os.CreateTemp(dir, base+".tmp-*")
+	if err != nil {
 		return err
 	}
+	defer os.Remove(f.Name()) // 重命名成功后为空操作
 
-	enc := json.NewEncoder(m.file)
+	enc := json.NewEncoder(f)
 	enc.SetIndent("", "  ")
 	if err := enc.Encode(tmp); err != nil {
+		f.Close()
 		return err
 	}
-	return nil
-}
-
-// expandHook 用实际地址替换占位符
-func (m *StatusManager) expandHook(ev UpdateEvent) string {
-	s := m.hookCmd
-	s = strings.ReplaceAll(s, "{inner}", ev.InnerAddr)
-	s = strings.ReplaceAll(s, "{outer}", ev.OuterAddr)
-	s = strings.ReplaceAll(s, "{protocol}", ev.Protocol)
-	return s
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), m.path)
 }
@@ -0,0 +1,66 @@
+package status
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"natter/internal/clock"
+
+	"go.uber.org/zap"
+)
+
+func TestStaleMappingPrunedOnClockTick(t *testing.T) {
+	fake := clock.NewFake(time.Unix(1_700_000_000, 0))
+	m, err := NewManager(filepath.Join(t.TempDir(), "status.json"), "", zap.NewNop(),
+		WithClock(fake),
+		WithStaleAfter(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+
+	start := fake.Now()
+	m.Updates <- UpdateEvent{Protocol: "udp", InnerAddr: "10.0.0.2:5000", OuterAddr: "203.0.113.7:5000"}
+	deadline := time.Now().Add(2 * time.Second)
+	for m.MappingCounts()["udp"] != 1 || fake.Waiters() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("mapping was not recorded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// 每次推进一个清理周期，直到映射被移除；移除不能早于 staleAfter
+	for i := 0; i < 10; i++ {
+		fake.Add(15 * time.Second)
+		deadline := time.Now().Add(200 * time.Millisecond)
+		for time.Now().Before(deadline) {
+			if m.MappingCounts()["udp"] == 0 {
+				if age := fake.Now().Sub(start); age <= time.Minute {
+					t.Fatalf("mapping removed after %s, before staleAfter", age)
+				}
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	t.Fatal("stale mapping was never removed")
+}
+
+func TestUnconfirmedKeepAliveIsNotConnected(t *testing.T) {
+	m, err := NewManager(filepath.Join(t.TempDir(), "status.json"), "", zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.handleKeepAlive(KeepAliveEvent{Protocol: "udp", LocalAddr: "10.0.0.2:5000", Remote: "203.0.113.1:53", OK: true, Unconfirmed: true})
+	m.handleKeepAlive(KeepAliveEvent{Protocol: "tcp", LocalAddr: "10.0.0.2:5000", Remote: "203.0.113.1:80", OK: true})
+	if got := m.keepAlives["udp|10.0.0.2:5000"].State; got != "sent" {
+		t.Errorf("udp keep-alive state = %q, want sent", got)
+	}
+	if got := m.keepAlives["tcp|10.0.0.2:5000"].State; got != "connected" {
+		t.Errorf("tcp keep-alive state = %q, want connected", got)
+	}
+}
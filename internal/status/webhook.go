@@ -0,0 +1,140 @@
+package status
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Option 配置 StatusManager 的可选功能
+type Option func(*StatusManager)
+
+// webhookQueueSize 是每个 Webhook 待投递通知的上限，超出时丢弃新通知
+const webhookQueueSize = 100
+
+// webhook 是映射变化时 POST 通知的目标；通知经 queue 由单个协程按顺序投递（见 webhookLoop）
+type webhook struct {
+	url     string
+	timeout time.Duration
+	retries int
+	client  *http.Client
+	queue   chan webhookJob
+}
+
+// webhookJob 是一条待投递的通知
+type webhookJob struct {
+	ev UpdateEvent
+	at time.Time
+}
+
+// webhookPayload 是 POST 的 JSON 内容
+type webhookPayload struct {
+	Event     string    `json:"event"` // "update" 或 "remove"
+	Protocol  string    `json:"protocol"`
+	Inner     string    `json:"inner"`
+	Outer     string    `json:"outer"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// WithWebhook 追加一个 Webhook，映射变化时向 url POST JSON 通知；可多次调用。
+// timeout 为单次请求超时（<= 0 时 5 秒），retries 为失败后的重试次数（< 0 时不重试）。
+func WithWebhook(url string, timeout time.Duration, retries int) Option {
+	return func(m *StatusManager) {
+		if url == "" {
+			return
+		}
+		if timeout <= 0 {
+			timeout = 5 * time.Second
+		}
+		if retries < 0 {
+			retries = 0
+		}
+		m.webhooks = append(m.webhooks, &webhook{url: url, timeout: timeout, retries: retries,
+			client: &http.Client{Timeout: timeout}, queue: make(chan webhookJob, webhookQueueSize)})
+	}
+}
+
+// enqueueWebhook 把通知交给 w 的投递协程；队列已满时丢弃并记录日志，不阻塞调用方
+func (m *StatusManager) enqueueWebhook(w *webhook, ev UpdateEvent, at time.Time) {
+	select {
+	case w.queue <- webhookJob{ev: ev, at: at}:
+	default:
+		m.logger.Warn("Webhook queue full, dropping notification", zap.String("url", w.url),
+			zap.String("inner", ev.InnerAddr), zap.String("outer", ev.OuterAddr))
+	}
+}
+
+// webhookLoop 按入队顺序逐条投递 w 的通知，直到 ctx 结束；前一条（含重试）完成后才投递下一条
+func (m *StatusManager) webhookLoop(ctx context.Context, w *webhook) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-w.queue:
+			m.sendWebhook(ctx, w, job.ev, job.at)
+		}
+	}
+}
+
+// sendWebhook 投递一次映射变化或移除通知，失败时按 1s、2s、4s... 退避重试；ctx 结束时放弃
+func (m *StatusManager) sendWebhook(ctx context.Context, w *webhook, ev UpdateEvent, at time.Time) {
+	body, err := json.Marshal(webhookPayload{Event: eventName(ev), Protocol: ev.Protocol, Inner: ev.InnerAddr, Outer: ev.OuterAddr, Timestamp: at})
+	if err != nil {
+		m.logger.Warn("Webhook encode failed", zap.Error(err))
+		return
+	}
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err = w.post(ctx, body)
+		if err == nil {
+			m.logger.Debug("Webhook delivered", zap.String("url", w.url), zap.String("outer", ev.OuterAddr))
+			m.auditWebhook(w, ev, attempt+1, nil)
+			return
+		}
+		if attempt >= w.retries || ctx.Err() != nil {
+			m.auditWebhook(w, ev, attempt+1, err)
+			break
+		}
+		m.logger.Debug("Webhook failed, retrying", zap.String("url", w.url), zap.Int("attempt", attempt+1), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			m.auditWebhook(w, ev, attempt+1, err)
+			return
+		case <-m.clock.After(backoff):
+		}
+		backoff *= 2
+	}
+	m.logger.Warn("Webhook delivery failed", zap.String("url", w.url), zap.Error(err))
+}
+
+// auditWebhook 把一次 Webhook 投递的最终结果写入审计日志
+func (m *StatusManager) auditWebhook(w *webhook, ev UpdateEvent, attempts int, err error) {
+	m.audit.Info("hook_executed", zap.String("type", "webhook"), zap.String("url", w.url),
+		zap.String("inner", ev.InnerAddr), zap.String("outer", ev.OuterAddr), zap.Bool("ok", err == nil),
+		zap.Int("attempts", attempts), zap.Error(err))
+}
+
+func (w *webhook) post(ctx context.Context, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "natter")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
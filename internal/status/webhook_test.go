@@ -0,0 +1,108 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"natter/internal/clock"
+
+	"go.uber.org/zap"
+)
+
+// webhookRecorder 记录收到的通知；前 fail 个请求返回 500
+type webhookRecorder struct {
+	mu       sync.Mutex
+	fail     int
+	requests int
+	outers   []string
+}
+
+func (r *webhookRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var p webhookPayload
+	json.NewDecoder(req.Body).Decode(&p)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests++
+	if r.requests <= r.fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	r.outers = append(r.outers, p.Outer)
+}
+
+func (r *webhookRecorder) snapshot() (int, []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.requests, append([]string(nil), r.outers...)
+}
+
+// startWebhookManager 启动只带一个 Webhook 的 StatusManager
+func startWebhookManager(t *testing.T, url string, retries int, fake *clock.Fake) (*StatusManager, context.CancelFunc) {
+	t.Helper()
+	m, err := NewManager(filepath.Join(t.TempDir(), "status.json"), "", zap.NewNop(),
+		WithClock(fake), WithWebhook(url, time.Second, retries))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go m.Run(ctx)
+	return m, cancel
+}
+
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWebhookDeliversInOrderAcrossRetries(t *testing.T) {
+	rec := &webhookRecorder{fail: 1}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+	fake := clock.NewFake(time.Unix(1_700_000_000, 0))
+	m, _ := startWebhookManager(t, srv.URL, 3, fake)
+
+	m.Updates <- UpdateEvent{Protocol: "udp", InnerAddr: "10.0.0.2:5000", OuterAddr: "203.0.113.7:1"}
+	m.Updates <- UpdateEvent{Protocol: "udp", InnerAddr: "10.0.0.2:5000", OuterAddr: "203.0.113.7:2"}
+
+	// 第一条失败后在退避中等待，第二条不能越过它
+	waitUntil(t, "retry backoff", func() bool { return fake.Waiters() > 0 })
+	if n, got := rec.snapshot(); n != 1 || len(got) != 0 {
+		t.Fatalf("before backoff: %d requests, delivered %v; want 1 failed request", n, got)
+	}
+	fake.Add(time.Second)
+	waitUntil(t, "both deliveries", func() bool { _, got := rec.snapshot(); return len(got) == 2 })
+	if _, got := rec.snapshot(); got[0] != "203.0.113.7:1" || got[1] != "203.0.113.7:2" {
+		t.Fatalf("delivered %v, want in event order", got)
+	}
+}
+
+func TestWebhookRetryStopsOnShutdown(t *testing.T) {
+	rec := &webhookRecorder{fail: 1 << 30}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+	fake := clock.NewFake(time.Unix(1_700_000_000, 0))
+	m, cancel := startWebhookManager(t, srv.URL, 10, fake)
+
+	m.Updates <- UpdateEvent{Protocol: "tcp", InnerAddr: "10.0.0.2:80", OuterAddr: "203.0.113.7:80"}
+	waitUntil(t, "retry backoff", func() bool { return fake.Waiters() > 0 })
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	fake.Add(time.Hour)
+	time.Sleep(50 * time.Millisecond)
+	if n, _ := rec.snapshot(); n != 1 {
+		t.Fatalf("%d requests after shutdown, want the retry chain to stop at 1", n)
+	}
+}
@@ -0,0 +1,104 @@
+package stun
+
+import (
+	"fmt"
+
+	"github.com/pion/stun"
+)
+
+// maxAuthRetries 限制 401/438 质询后的重试次数，避免服务器反复质询时死循环
+const maxAuthRetries = 2
+
+// credentials 是 RFC 5389 长期凭据
+type credentials struct {
+	username string
+	password string
+	realm    string // 服务器未在质询中给出 REALM 时使用
+}
+
+// WithCredentials 为需要长期凭据的服务器设置用户名/密码。
+// 首个请求不带凭据；服务器返回 401（或 438 Stale Nonce）时，
+// 使用其给出的 REALM/NONCE 附加 USERNAME 与 MESSAGE-INTEGRITY 重试。
+// username 为空时不启用认证。
+func WithCredentials(username, password, realm string) Option {
+	return func(c *Client) {
+		if username == "" {
+			c.creds = nil
+			return
+		}
+		c.creds = &credentials{username: username, password: password, realm: realm}
+	}
+}
+
+// exchange 经 send 发送 Binding 请求并返回成功响应，必要时完成认证质询。
+// send 执行一次事务，如 pion 客户端上的 do，或共享 socket 上的 Demux.roundTrip。
+func (c *Client) exchange(send func(*stun.Message) (*stun.Message, error)) (*stun.Message, error) {
+	setters := []stun.Setter{stun.BindingRequest, stun.TransactionID, stun.Fingerprint}
+	for attempt := 0; ; attempt++ {
+		res, err := send(stun.MustBuild(setters...))
+		if err != nil {
+			return nil, err
+		}
+		if res.Type.Class != stun.ClassErrorResponse {
+			return res, nil
+		}
+
+		var code stun.ErrorCodeAttribute
+		if err := code.GetFrom(res); err != nil {
+			return nil, fmt.Errorf("error response without ERROR-CODE: %w", err)
+		}
+		challenged := code.Code == stun.CodeUnauthorized || code.Code == stun.CodeStaleNonce
+		if !challenged || c.creds == nil || attempt >= maxAuthRetries {
+			return nil, fmt.Errorf("server error %d: %s", code.Code, code.Reason)
+		}
+		setters, err = c.creds.signedRequest(res)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// signedRequest 根据质询响应中的 REALM/NONCE 构造带凭据的请求
+func (cr *credentials) signedRequest(challenge *stun.Message) ([]stun.Setter, error) {
+	realm := stun.NewRealm(cr.realm)
+	var srvRealm stun.Realm
+	if err := srvRealm.GetFrom(challenge); err == nil {
+		realm = srvRealm
+	}
+	if len(realm) == 0 {
+		return nil, fmt.Errorf("server challenge has no REALM and none is configured")
+	}
+	var nonce stun.Nonce
+	if err := nonce.GetFrom(challenge); err != nil {
+		return nil, fmt.Errorf("server challenge has no NONCE: %w", err)
+	}
+	return []stun.Setter{
+		stun.BindingRequest,
+		stun.TransactionID,
+		stun.NewUsername(cr.username),
+		realm,
+		nonce,
+		stun.NewLongTermIntegrity(cr.username, realm.String(), cr.password),
+		stun.Fingerprint,
+	}, nil
+}
+
+// do 执行一次事务并复制响应（事件中的 Message 仅在回调内有效）
+func do(client *stun.Client, req *stun.Message) (*stun.Message, error) {
+	res := new(stun.Message)
+	var txnErr error
+	err := client.Do(req, func(ev stun.Event) {
+		if ev.Error != nil {
+			txnErr = ev.Error
+			return
+		}
+		txnErr = ev.Message.CloneTo(res)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if txnErr != nil {
+		return nil, txnErr
+	}
+	return res, nil
+}
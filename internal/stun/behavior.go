@@ -0,0 +1,223 @@
+package stun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pion/stun"
+	"go.uber.org/zap"
+)
+
+// NATType 表示按 RFC 5780 映射行为 + 过滤行为归纳出的经典 NAT 类型
+type NATType int
+
+const (
+	NATUnknown            NATType = iota
+	NATOpenInternet               // 无 NAT，外部地址与本地地址一致
+	NATFullCone                   // 端点无关映射 + 端点无关过滤
+	NATRestrictedCone             // 端点无关映射 + 地址相关过滤
+	NATPortRestrictedCone         // 端点无关映射 + 地址和端口相关过滤
+	NATSymmetric                  // 映射随目的地址变化，打洞基本不可行
+)
+
+func (t NATType) String() string {
+	switch t {
+	case NATOpenInternet:
+		return "open internet"
+	case NATFullCone:
+		return "full cone"
+	case NATRestrictedCone:
+		return "restricted cone"
+	case NATPortRestrictedCone:
+		return "port restricted cone"
+	case NATSymmetric:
+		return "symmetric"
+	default:
+		return "unknown"
+	}
+}
+
+// CHANGE-REQUEST 标志位（RFC 5780 7.2）
+const (
+	changePort = 0x02
+	changeIP   = 0x04
+)
+
+// errNoResponse 表示在超时内未收到响应，过滤测试中这是预期结果之一
+var errNoResponse = errors.New("no STUN response")
+
+// errNoOtherAddress 表示服务器不支持 RFC 5780（未返回 OTHER-ADDRESS）
+var errNoOtherAddress = errors.New("server does not advertise OTHER-ADDRESS")
+
+// DiscoverNATBehavior 按 RFC 5780 第 4 节依次执行映射行为测试和过滤行为测试，
+// 返回 NAT 类型以及测试 I 观测到的外部映射。
+// 依次尝试 UDP 服务器，直到找到一个返回 OTHER-ADDRESS 的服务器。
+func (c *Client) DiscoverNATBehavior(ctx context.Context) (NATType, *Mapping, error) {
+	_, udp := c.servers()
+	for _, server := range udp {
+		t, m, err := c.discoverWith(ctx, server)
+		if err == nil {
+			return t, m, nil
+		}
+		if ctx.Err() != nil {
+			return NATUnknown, nil, ctx.Err()
+		}
+		c.logger.Debug("NAT behavior discovery failed", zap.String("server", server), zap.Error(err))
+	}
+	return NATUnknown, nil, fmt.Errorf("no UDP STUN server supports RFC 5780")
+}
+
+func (c *Client) discoverWith(ctx context.Context, server string) (NATType, *Mapping, error) {
+	raddr, err := net.ResolveUDPAddr(c.network("udp"), serverAddr(server))
+	if err != nil {
+		return NATUnknown, nil, err
+	}
+	// 使用临时端口，避免干扰正在保活的开放端口
+	conn, err := net.ListenUDP(c.network("udp"), &net.UDPAddr{IP: c.localIP()})
+	if err != nil {
+		return NATUnknown, nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	local := conn.LocalAddr().(*net.UDPAddr)
+
+	// 测试 I：向主地址发送普通 Binding 请求
+	res, err := c.roundTrip(conn, raddr)
+	if err != nil {
+		return NATUnknown, nil, err
+	}
+	mapped1, err := mappedAddr(res)
+	if err != nil {
+		return NATUnknown, nil, err
+	}
+	other, err := otherAddr(res)
+	if err != nil {
+		return NATUnknown, nil, err
+	}
+	mapping := &Mapping{
+		InternalIP:   local.IP,
+		InternalPort: local.Port,
+		ExternalIP:   mapped1.IP,
+		ExternalPort: mapped1.Port,
+	}
+	if ip := c.localIP(); ip != nil && mapped1.IP.Equal(ip) && mapped1.Port == local.Port {
+		return NATOpenInternet, mapping, nil
+	}
+
+	// 映射测试 II：发往备用 IP + 主端口
+	mapped2, err := c.mappedVia(conn, &net.UDPAddr{IP: other.IP, Port: raddr.Port})
+	if err != nil {
+		return NATUnknown, mapping, fmt.Errorf("mapping test II: %w", err)
+	}
+	if !sameAddr(mapped1, mapped2) {
+		c.logger.Debug("NAT mapping is endpoint dependent", zap.Stringer("test1", mapped1), zap.Stringer("test2", mapped2))
+		return NATSymmetric, mapping, nil
+	}
+
+	// 过滤测试 II：要求服务器从备用 IP 和备用端口回复
+	if _, err := c.roundTrip(conn, raddr, changeRequest(changeIP|changePort)); err == nil {
+		return NATFullCone, mapping, nil
+	} else if !errors.Is(err, errNoResponse) {
+		return NATUnknown, mapping, fmt.Errorf("filtering test II: %w", err)
+	}
+
+	// 过滤测试 III：仅要求更换端口
+	if _, err := c.roundTrip(conn, raddr, changeRequest(changePort)); err == nil {
+		return NATRestrictedCone, mapping, nil
+	} else if !errors.Is(err, errNoResponse) {
+		return NATUnknown, mapping, fmt.Errorf("filtering test III: %w", err)
+	}
+	return NATPortRestrictedCone, mapping, nil
+}
+
+// mappedVia 向 raddr 发送 Binding 请求并返回其看到的映射地址
+func (c *Client) mappedVia(conn *net.UDPConn, raddr *net.UDPAddr) (*net.UDPAddr, error) {
+	res, err := c.roundTrip(conn, raddr)
+	if err != nil {
+		return nil, err
+	}
+	return mappedAddr(res)
+}
+
+// roundTrip 在未连接的 UDP socket 上发送一次 Binding 请求，并等待同一事务 ID 的响应。
+// 响应可能来自与 raddr 不同的地址（CHANGE-REQUEST），因此只按事务 ID 匹配。
+// 超时内会重传一次；始终无响应时返回 errNoResponse。
+func (c *Client) roundTrip(conn *net.UDPConn, raddr *net.UDPAddr, setters ...stun.Setter) (*stun.Message, error) {
+	res, _, err := c.roundTripFrom(conn, raddr, setters...)
+	return res, err
+}
+
+// roundTripFrom 同 roundTrip，另外返回响应的来源地址
+func (c *Client) roundTripFrom(conn *net.UDPConn, raddr *net.UDPAddr, setters ...stun.Setter) (*stun.Message, *net.UDPAddr, error) {
+	req, err := stun.Build(append([]stun.Setter{stun.BindingRequest, stun.TransactionID}, append(setters, stun.Fingerprint)...)...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	buf := make([]byte, 1500)
+	for attempt := 0; attempt < 2; attempt++ {
+		if _, err := conn.WriteToUDP(req.Raw, raddr); err != nil {
+			return nil, nil, err
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(c.timeout))
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				var ne net.Error
+				if errors.As(err, &ne) && ne.Timeout() {
+					break
+				}
+				return nil, nil, err
+			}
+			if !stun.IsMessage(buf[:n]) {
+				continue
+			}
+			res := &stun.Message{Raw: append([]byte(nil), buf[:n]...)}
+			if err := res.Decode(); err != nil || res.TransactionID != req.TransactionID {
+				continue
+			}
+			return res, from, nil
+		}
+	}
+	return nil, nil, errNoResponse
+}
+
+// changeRequest 构造 CHANGE-REQUEST 属性
+func changeRequest(flags byte) stun.Setter {
+	return stun.RawAttribute{Type: stun.AttrChangeRequest, Value: []byte{0, 0, 0, flags}}
+}
+
+// mappedAddr 读取 XOR-MAPPED-ADDRESS，旧服务器回退到 MAPPED-ADDRESS
+func mappedAddr(m *stun.Message) (*net.UDPAddr, error) {
+	var xor stun.XORMappedAddress
+	if err := xor.GetFrom(m); err == nil {
+		return &net.UDPAddr{IP: xor.IP, Port: xor.Port}, nil
+	}
+	var plain stun.MappedAddress
+	if err := plain.GetFrom(m); err != nil {
+		return nil, fmt.Errorf("no mapped address in response: %w", err)
+	}
+	return &net.UDPAddr{IP: plain.IP, Port: plain.Port}, nil
+}
+
+// otherAddr 读取 OTHER-ADDRESS，RFC 3489 服务器回退到 CHANGED-ADDRESS
+func otherAddr(m *stun.Message) (*net.UDPAddr, error) {
+	var other stun.OtherAddress
+	if err := other.GetFrom(m); err == nil {
+		return &net.UDPAddr{IP: other.IP, Port: other.Port}, nil
+	}
+	var changed stun.MappedAddress
+	if err := changed.GetFromAs(m, stun.AttrChangedAddress); err == nil {
+		return &net.UDPAddr{IP: changed.IP, Port: changed.Port}, nil
+	}
+	return nil, errNoOtherAddress
+}
+
+func sameAddr(a, b *net.UDPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
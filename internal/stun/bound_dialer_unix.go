@@ -10,7 +10,7 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-func newBoundDialer(laddr *net.TCPAddr, timeout time.Duration) net.Dialer {
+func newBoundDialer(laddr net.Addr, timeout time.Duration) net.Dialer {
 	return net.Dialer{
 		LocalAddr: laddr,
 		Timeout:   timeout,
@@ -13,7 +13,7 @@ import (
 const soExclusiveAddrUse = 0x0004
 
 // 绑定到指定本地 IP:Port，关闭排他占用，开启 REUSEADDR
-func newBoundDialer(laddr *net.TCPAddr, timeout time.Duration) net.Dialer {
+func newBoundDialer(laddr net.Addr, timeout time.Duration) net.Dialer {
 	return net.Dialer{
 		LocalAddr: laddr,
 		Timeout:   timeout,
@@ -0,0 +1,98 @@
+package stun
+
+import (
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// breakerThreshold 是服务器连续失败多少次后暂停使用
+	breakerThreshold = 3
+	// breakerCooldown 是首次暂停的时长，恢复后再次连续失败时翻倍，最长 breakerMaxCooldown
+	breakerCooldown    = 30 * time.Second
+	breakerMaxCooldown = 10 * time.Minute
+)
+
+// breaker 是单个服务器的熔断状态
+type breaker struct {
+	failures  int           // 连续失败次数
+	cooldown  time.Duration // 最近一次暂停的时长，成功后清零
+	openUntil time.Time     // 暂停截止时间，零值表示可用
+}
+
+// order 返回本次查询的服务器顺序：起点每次后移一位以分摊负载，暂停中的服务器被跳过；
+// 全部暂停时只返回最早恢复的一个，保证每次查询至少探测一个服务器
+func (c *Client) order(proto string, servers []string) []string {
+	if len(servers) == 0 {
+		return nil
+	}
+	now := time.Now()
+	c.breakerMu.Lock()
+	defer c.breakerMu.Unlock()
+	if c.rotation == nil {
+		c.rotation = make(map[string]int)
+	}
+	start := c.rotation[proto] % len(servers)
+	c.rotation[proto]++
+
+	out := make([]string, 0, len(servers))
+	var soonest string
+	var soonestAt time.Time
+	for i := range servers {
+		server := servers[(start+i)%len(servers)]
+		b := c.breakers[breakerKey(proto, server)]
+		if b == nil || !now.Before(b.openUntil) {
+			out = append(out, server)
+			continue
+		}
+		if soonest == "" || b.openUntil.Before(soonestAt) {
+			soonest, soonestAt = server, b.openUntil
+		}
+	}
+	if len(out) == 0 {
+		c.logger.Debug("All STUN servers cooling down, probing the next to recover",
+			zap.String("proto", proto), zap.String("server", soonest))
+		return []string{soonest}
+	}
+	if skipped := len(servers) - len(out); skipped > 0 {
+		c.logger.Debug("Skipping cooling down STUN servers", zap.String("proto", proto), zap.Int("skipped", skipped))
+	}
+	return out
+}
+
+// trip 记录一次查询结果：成功时恢复服务器；连续失败达到阈值时暂停，暂停后再次失败则暂停时长翻倍
+func (c *Client) trip(proto, server string, err error) {
+	key := breakerKey(proto, server)
+	c.breakerMu.Lock()
+	defer c.breakerMu.Unlock()
+	if c.breakers == nil {
+		c.breakers = make(map[string]*breaker)
+	}
+	b, ok := c.breakers[key]
+	if !ok {
+		b = &breaker{}
+		c.breakers[key] = b
+	}
+	if err == nil {
+		*b = breaker{}
+		return
+	}
+	b.failures++
+	if b.failures < breakerThreshold {
+		return
+	}
+	if b.cooldown == 0 {
+		b.cooldown = breakerCooldown
+	} else {
+		b.cooldown = min(2*b.cooldown, breakerMaxCooldown)
+	}
+	b.openUntil = time.Now().Add(b.cooldown)
+	c.logger.Warn("STUN server failing repeatedly, pausing it",
+		zap.String("server", key), zap.Int("failures", b.failures), zap.Duration("cooldown", b.cooldown))
+}
+
+func breakerKey(proto, server string) string {
+	return strings.ToLower(proto) + "://" + serverAddr(server)
+}
@@ -1,14 +1,20 @@
 package stun
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/pion/stun"
 	"go.uber.org/zap"
 )
-import "context"
+
+// defaultPort 是 STUN 服务的标准端口，服务器未写端口时使用
+const defaultPort = "3478"
 
 // Mapping 表示 STUN 映射的内部/外部地址
 type Mapping struct {
@@ -18,137 +24,281 @@ type Mapping struct {
 	ExternalPort int
 }
 
+// ExternalAddr 返回 "IP:Port" 形式的外部地址，IPv6 带方括号
+func (m *Mapping) ExternalAddr() string {
+	return net.JoinHostPort(m.ExternalIP.String(), strconv.Itoa(m.ExternalPort))
+}
+
 // Client 是 STUN 客户端，用于获取 UDP/TCP 映射
 type Client struct {
+	serversMu  sync.RWMutex // 保护 tcpServers/udpServers，配置热加载时整体替换
 	tcpServers []string
 	udpServers []string
 	timeout    time.Duration
 	logger     *zap.Logger
 	bindIP     net.IP
+	race       bool
+	family     string
+	creds      *credentials
+	proxy      ContextDialer // 非 nil 时 TCP 查询经该代理连出
+
+	statsMu sync.Mutex
+	stats   map[string]*ServerStat
+
+	// 熔断：连续失败的服务器暂停一段时间；rotation 为每个协议轮转起始服务器
+	breakerMu sync.Mutex
+	breakers  map[string]*breaker
+	rotation  map[string]int
+}
+
+// Option 调整 Client 的行为
+type Option func(*Client)
+
+// WithRace 开启并发模式：同时向所有服务器发起请求，取最先成功的结果并取消其余请求。
+// 默认按配置顺序逐个尝试。
+func WithRace(race bool) Option {
+	return func(c *Client) { c.race = race }
+}
+
+// ContextDialer 是经代理建立 TCP 连接的拨号器，golang.org/x/net/proxy 的 SOCKS5 拨号器满足该接口
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// WithProxy 让 TCP 查询经 d（如 SOCKS5 代理）连到服务器，UDP 查询仍直连。
+// 此时服务器看到的是代理的出口，返回的映射是代理所在 NAT 的地址，而不是本机的。
+func WithProxy(d ContextDialer) Option {
+	return func(c *Client) { c.proxy = d }
+}
+
+// WithFamily 指定地址族："ipv4"、"ipv6"，为空时根据绑定 IP 自动选择（默认 IPv4）。
+func WithFamily(family string) Option {
+	return func(c *Client) { c.family = family }
 }
 
 // NewClient 创建一个 STUN 客户端实例。
 // tcpServers, udpServers 是 STUN 服务器域名或 IP 列表；timeout 用于连接和请求的超时时间；logger 用于日志。
-func NewClient(tcpServers, udpServers []string, timeout time.Duration, logger *zap.Logger) *Client {
-	return &Client{
+func NewClient(tcpServers, udpServers []string, timeout time.Duration, logger *zap.Logger, opts ...Option) *Client {
+	c := &Client{
 		tcpServers: tcpServers,
 		udpServers: udpServers,
 		timeout:    timeout,
 		logger:     logger,
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
 }
 
-// GetUDPMapping 获取给定本地 UDP 端口的映射地址
-func (c *Client) GetUDPMapping(srcPort int) (*Mapping, error) {
-	for _, server := range c.udpServers {
-		addr := fmt.Sprintf("%s:3478", server)
-		c.logger.Debug("STUN UDP dialing", zap.String("server", addr))
+// GetUDPMapping 获取给定本地 UDP 端口的映射地址。
+// ctx 取消时会立即关闭正在使用的连接并返回。
+func (c *Client) GetUDPMapping(ctx context.Context, srcPort int) (*Mapping, error) {
+	_, udp := c.servers()
+	return c.mapping(ctx, "UDP", udp, srcPort, c.queryUDP)
+}
 
-		// 本地监听指定端口
-		laddr := &net.UDPAddr{IP: c.bindIP, Port: srcPort}
-		raddr, err := net.ResolveUDPAddr("udp4", addr)
-		if err != nil {
-			c.logger.Warn("Failed to resolve STUN server", zap.String("server", server), zap.Error(err))
-			continue
-		}
+// GetTCPMapping 获取给定本地 TCP 端口的映射地址。
+// 注意：不同服务器支持情况略有差异。
+func (c *Client) GetTCPMapping(ctx context.Context, srcPort int) (*Mapping, error) {
+	tcp, _ := c.servers()
+	return c.mapping(ctx, "TCP", tcp, srcPort, c.queryTCP)
+}
+
+// SetServers 替换 STUN 服务器列表，之后的请求使用新列表，进行中的请求不受影响
+func (c *Client) SetServers(tcpServers, udpServers []string) {
+	c.serversMu.Lock()
+	defer c.serversMu.Unlock()
+	c.tcpServers, c.udpServers = tcpServers, udpServers
+}
 
-		conn, err := net.DialUDP("udp4", laddr, raddr)
-		if err != nil {
-			c.logger.Warn("UDP dial failed", zap.String("server", server), zap.Error(err))
-			continue
+func (c *Client) servers() (tcp, udp []string) {
+	c.serversMu.RLock()
+	defer c.serversMu.RUnlock()
+	return c.tcpServers, c.udpServers
+}
+
+// queryFunc 向单个服务器查询 srcPort 的映射
+type queryFunc func(ctx context.Context, server string, srcPort int) (*Mapping, error)
+
+// mapping 根据模式选择顺序尝试或并发竞速；服务器顺序与熔断见 order
+func (c *Client) mapping(ctx context.Context, proto string, servers []string, srcPort int, query queryFunc) (*Mapping, error) {
+	servers = c.order(proto, servers)
+	if c.race && len(servers) > 1 {
+		return c.raceServers(ctx, proto, servers, srcPort, query)
+	}
+	for _, server := range servers {
+		m, err := c.timed(ctx, proto, server, srcPort, query)
+		if err == nil {
+			return m, nil
 		}
-		conn.SetDeadline(time.Now().Add(c.timeout))
-
-		// 构建绑定请求
-		message := stun.MustBuild(stun.BindingRequest, stun.TransactionID, stun.Fingerprint)
-
-		// 创建 STUN 事务客户端
-		client, _ := stun.NewClient(conn)
-		defer client.Close()
-
-		var xorAddr stun.XORMappedAddress
-		err = client.Do(message, func(ev stun.Event) {
-			if ev.Error != nil {
-				err = ev.Error
-				return
-			}
-			if getErr := xorAddr.GetFrom(ev.Message); getErr != nil {
-				err = getErr
-			}
-		})
-		conn.Close()
-		if err != nil {
-			c.logger.Warn("STUN transaction failed", zap.String("server", server), zap.Error(err))
-			continue
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
 		}
+		c.logger.Warn("STUN query failed", zap.String("proto", proto), zap.String("server", server), zap.Error(err))
+	}
+	return nil, fmt.Errorf("all %s STUN servers failed", proto)
+}
+
+// raceServers 同时查询所有服务器，返回最先成功的结果，其余请求随 ctx 一并取消
+func (c *Client) raceServers(ctx context.Context, proto string, servers []string, srcPort int, query queryFunc) (*Mapping, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-		mapping := &Mapping{
-			InternalIP:   laddr.IP,
-			InternalPort: laddr.Port,
-			ExternalIP:   xorAddr.IP,
-			ExternalPort: xorAddr.Port,
+	type result struct {
+		server  string
+		mapping *Mapping
+		err     error
+	}
+	results := make(chan result, len(servers))
+	for _, server := range servers {
+		go func(server string) {
+			m, err := c.timed(ctx, proto, server, srcPort, query)
+			results <- result{server: server, mapping: m, err: err}
+		}(server)
+	}
+
+	for range servers {
+		r := <-results
+		if r.err == nil {
+			c.logger.Debug("STUN race won", zap.String("proto", proto), zap.String("server", r.server))
+			return r.mapping, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
 		}
-		return mapping, nil
+		c.logger.Warn("STUN query failed", zap.String("proto", proto), zap.String("server", r.server), zap.Error(r.err))
 	}
-	return nil, fmt.Errorf("all UDP STUN servers failed")
+	return nil, fmt.Errorf("all %s STUN servers failed", proto)
 }
 
-// GetTCPMapping 获取给定本地 TCP 端口的映射地址。
-// 注意：不同服务器支持情况略有差异。
-func (c *Client) GetTCPMapping(srcPort int) (*Mapping, error) {
-	for _, server := range c.tcpServers {
-		addr := fmt.Sprintf("%s:3478", server)
-		c.logger.Debug("STUN TCP dialing", zap.String("server", addr))
+// queryUDP 从本地 srcPort 向单个服务器发起一次 UDP Binding 请求
+func (c *Client) queryUDP(ctx context.Context, server string, srcPort int) (*Mapping, error) {
+	addr := serverAddr(server)
+	c.logger.Debug("STUN UDP dialing", zap.String("server", addr))
 
-		// 建立 TCP 连接并绑定本地端口
-		laddr := &net.TCPAddr{IP: c.bindIP, Port: srcPort}
+	// 本地监听指定端口
+	laddr := &net.UDPAddr{IP: c.localIP(), Port: srcPort}
+	d := newBoundDialer(laddr, c.timeout)
+	conn, err := d.DialContext(ctx, c.network("udp"), addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+
+	xorAddr, err := c.transact(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	return &Mapping{
+		InternalIP:   laddr.IP,
+		InternalPort: laddr.Port,
+		ExternalIP:   xorAddr.IP,
+		ExternalPort: xorAddr.Port,
+	}, nil
+}
+
+// queryTCP 从本地 srcPort 向单个服务器发起一次 TCP Binding 请求
+func (c *Client) queryTCP(ctx context.Context, server string, srcPort int) (*Mapping, error) {
+	addr := serverAddr(server)
+	c.logger.Debug("STUN TCP dialing", zap.String("server", addr))
+
+	// 建立 TCP 连接并绑定本地端口；经代理时由代理连出，本地端口不参与映射
+	laddr := &net.TCPAddr{IP: c.localIP(), Port: srcPort}
+	var conn net.Conn
+	var err error
+	if c.proxy != nil {
+		dctx, cancel := context.WithTimeout(ctx, c.timeout)
+		conn, err = c.proxy.DialContext(dctx, c.network("tcp"), addr)
+		cancel()
+	} else {
 		d := newBoundDialer(laddr, c.timeout)
-		conn, err := d.DialContext(context.Background(), "tcp4", addr)
-		if err != nil {
-			c.logger.Warn("TCP dial failed", zap.String("server", server), zap.Error(err))
-			continue
-		}
-		// 验证是否真用到了同一个本地端口
-		//c.logger.Info("stun tcp connected",
-		//	zap.String("local", conn.LocalAddr().String()),
-		//	zap.String("remote", addr),
-		//)
-
-		// 用这条连接跑 STUN 事务
-		_ = conn.SetDeadline(time.Now().Add(c.timeout))
-		message := stun.MustBuild(stun.BindingRequest, stun.TransactionID, stun.Fingerprint)
-		client, _ := stun.NewClient(conn)
-
-		var xorAddr stun.XORMappedAddress
-		var txnErr error
-		err = client.Do(message, func(ev stun.Event) {
-			if ev.Error != nil {
-				txnErr = ev.Error
-				return
-			}
-			if getErr := xorAddr.GetFrom(ev.Message); getErr != nil {
-				txnErr = getErr
-			}
-		})
-		// 关闭 client（它会关 conn）；不要再重复 conn.Close()
-		client.Close()
-
-		if err != nil || txnErr != nil {
-			if err == nil {
-				err = txnErr
-			}
-			c.logger.Warn("STUN TCP transaction failed", zap.String("server", server), zap.Error(err))
-			continue
-		}
+		conn, err = d.DialContext(ctx, c.network("tcp"), addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+
+	xorAddr, err := c.transact(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	return &Mapping{
+		InternalIP:   laddr.IP,
+		InternalPort: laddr.Port,
+		ExternalIP:   xorAddr.IP,
+		ExternalPort: xorAddr.Port,
+	}, nil
+}
+
+// transact 在 conn 上执行一次 Binding 事务并返回 XOR-MAPPED-ADDRESS。
+// conn 的所有权转交给 transact，返回前一定会被关闭；ctx 取消时提前关闭以打断事务。
+func (c *Client) transact(ctx context.Context, conn net.Conn) (*stun.XORMappedAddress, error) {
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = conn.SetDeadline(deadline)
 
-		return &Mapping{
-			InternalIP:   laddr.IP,
-			InternalPort: laddr.Port,
-			ExternalIP:   xorAddr.IP,
-			ExternalPort: xorAddr.Port,
-		}, nil
+	client, err := stun.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// 关闭 client（它会关 conn）；不要再重复 conn.Close()
+	defer client.Close()
+	stop := context.AfterFunc(ctx, func() { client.Close() })
+	defer stop()
+
+	res, err := c.exchange(func(req *stun.Message) (*stun.Message, error) { return do(client, req) })
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("transaction: %w", err)
+	}
+	var xorAddr stun.XORMappedAddress
+	if err := xorAddr.GetFrom(res); err != nil {
+		return nil, fmt.Errorf("transaction: %w", err)
 	}
-	return nil, fmt.Errorf("all TCP STUN servers failed")
+	return &xorAddr, nil
 }
 
 func (c *Client) SetBindIP(ip net.IP) { c.bindIP = ip }
+
+// ipv6 判断是否使用 IPv6：显式配置优先，否则看绑定 IP 的地址族
+func (c *Client) ipv6() bool {
+	switch c.family {
+	case "ipv6":
+		return true
+	case "ipv4":
+		return false
+	}
+	return c.bindIP != nil && c.bindIP.To4() == nil
+}
+
+// network 返回 proto（"udp"/"tcp"）在当前地址族下的网络名
+func (c *Client) network(proto string) string {
+	if c.ipv6() {
+		return proto + "6"
+	}
+	return proto + "4"
+}
+
+// localIP 返回本地绑定 IP；与所选地址族不一致时返回 nil（绑定通配地址）
+func (c *Client) localIP() net.IP {
+	if c.bindIP == nil || (c.bindIP.To4() == nil) != c.ipv6() {
+		return nil
+	}
+	return c.bindIP
+}
+
+// serverAddr 将配置中的服务器转换为 "host:port"。
+// 支持 "host"、"host:port"、"[v6]"、"[v6]:port" 以及不带方括号的 IPv6 字面量，
+// 未指定端口时使用 3478。
+func serverAddr(server string) string {
+	if host, port, err := net.SplitHostPort(server); err == nil {
+		return net.JoinHostPort(host, port)
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(server, "["), "]")
+	return net.JoinHostPort(host, defaultPort)
+}
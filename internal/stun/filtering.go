@@ -0,0 +1,92 @@
+package stun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/pion/stun"
+	"go.uber.org/zap"
+)
+
+// Filtering 表示 NAT 对入站 UDP 的过滤行为（RFC 4787），决定陌生地址能否直接连入已打开的端口
+type Filtering int
+
+const (
+	FilteringUnknown             Filtering = iota
+	FilteringEndpointIndependent           // 任何地址都能发入已映射的端口（全锥形），最利于打洞
+	FilteringDependent                     // 只接受曾经联系过的地址（或地址+端口），需要双方同时打洞
+)
+
+func (f Filtering) String() string {
+	switch f {
+	case FilteringEndpointIndependent:
+		return "endpoint independent"
+	case FilteringDependent:
+		return "address dependent"
+	default:
+		return "unknown"
+	}
+}
+
+// TestFiltering 从本地 srcPort（0 表示临时端口）向 UDP 服务器发送带 CHANGE-REQUEST（更换 IP 与端口）的
+// Binding 请求：收到从另一地址发回的响应说明 NAT 不限制入站来源，否则说明入站被过滤。
+// 服务器需先通过普通请求确认支持 RFC 5780（返回 OTHER-ADDRESS），否则无响应无法说明问题；
+// 依次尝试 UDP 服务器，直到得到结论。srcPort 非 0 时以端口复用方式绑定，
+// 但同一端口上的其他未连接 socket（如 UDP 转发器）可能分走响应，一般应使用临时端口。
+func (c *Client) TestFiltering(ctx context.Context, srcPort int) (Filtering, error) {
+	_, udp := c.servers()
+	for _, server := range udp {
+		f, err := c.filteringWith(ctx, server, srcPort)
+		if err == nil {
+			return f, nil
+		}
+		if ctx.Err() != nil {
+			return FilteringUnknown, ctx.Err()
+		}
+		c.logger.Debug("NAT filtering test failed", zap.String("server", server), zap.Error(err))
+	}
+	return FilteringUnknown, fmt.Errorf("no UDP STUN server supports CHANGE-REQUEST")
+}
+
+func (c *Client) filteringWith(ctx context.Context, server string, srcPort int) (Filtering, error) {
+	raddr, err := net.ResolveUDPAddr(c.network("udp"), serverAddr(server))
+	if err != nil {
+		return FilteringUnknown, err
+	}
+	d := newBoundDialer(nil, c.timeout)
+	lc := net.ListenConfig{Control: d.Control}
+	pc, err := lc.ListenPacket(ctx, c.network("udp"), (&net.UDPAddr{IP: c.localIP(), Port: srcPort}).String())
+	if err != nil {
+		return FilteringUnknown, err
+	}
+	conn := pc.(*net.UDPConn)
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	// 普通请求：打开映射，并确认服务器有备用地址
+	res, _, err := c.roundTripFrom(conn, raddr)
+	if err != nil {
+		return FilteringUnknown, err
+	}
+	if _, err := otherAddr(res); err != nil {
+		return FilteringUnknown, err
+	}
+
+	// 要求服务器从备用 IP 和备用端口回复
+	res, from, err := c.roundTripFrom(conn, raddr, changeRequest(changeIP|changePort))
+	switch {
+	case errors.Is(err, errNoResponse):
+		return FilteringDependent, nil
+	case err != nil:
+		return FilteringUnknown, err
+	case res.Type.Class == stun.ClassErrorResponse:
+		return FilteringUnknown, fmt.Errorf("server rejected CHANGE-REQUEST")
+	case from.IP.Equal(raddr.IP):
+		// 服务器忽略了 CHANGE-REQUEST，仍从原地址回复，结果不能说明过滤行为
+		return FilteringUnknown, fmt.Errorf("server answered CHANGE-REQUEST from its primary address")
+	}
+	return FilteringEndpointIndependent, nil
+}
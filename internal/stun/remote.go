@@ -0,0 +1,71 @@
+package stun
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxServerListSize 限制服务器列表响应的大小，防止异常响应占满内存
+const maxServerListSize = 1 << 20
+
+// FetchServers 从 url 获取 STUN 服务器列表。内容可以是 JSON 字符串数组，
+// 也可以每行一个服务器（忽略空行与 # 开头的注释行）；列表为空视为失败
+func FetchServers(ctx context.Context, url string) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server list returned %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxServerListSize))
+	if err != nil {
+		return nil, err
+	}
+	servers, err := parseServerList(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("server list is empty")
+	}
+	return servers, nil
+}
+
+// parseServerList 解析 JSON 数组或按行分隔的服务器列表
+func parseServerList(data []byte) ([]string, error) {
+	var out []string
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var list []string
+		if err := json.Unmarshal(trimmed, &list); err != nil {
+			return nil, fmt.Errorf("parse server list: %w", err)
+		}
+		for _, s := range list {
+			if s = strings.TrimSpace(s); s != "" {
+				out = append(out, s)
+			}
+		}
+		return out, nil
+	}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		out = append(out, line)
+	}
+	return out, sc.Err()
+}
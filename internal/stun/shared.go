@@ -0,0 +1,119 @@
+package stun
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+// Demux 把共享 socket 上收到的 STUN 响应交给等待中的事务。
+// socket 由别处（如 UDP 转发器）读取，读到的每个数据报先交给 Handle：
+// 只有事务 ID 与进行中的请求匹配的响应会被消费，其余数据照常处理。
+type Demux struct {
+	active  atomic.Int32 // 进行中的事务数，为 0 时 Handle 不做任何解析
+	mu      sync.Mutex
+	pending map[[stun.TransactionIDSize]byte]chan *stun.Message
+}
+
+// NewDemux 创建一个 Demux，可被多个 socket 共用（事务 ID 随机，不会冲突）
+func NewDemux() *Demux {
+	return &Demux{pending: map[[stun.TransactionIDSize]byte]chan *stun.Message{}}
+}
+
+// Handle 检查读取方收到的数据报 b，属于进行中的事务时转交并返回 true，调用方应丢弃该数据报。
+// 重传导致的重复响应同样被消费，不会漏给转发目标
+func (d *Demux) Handle(b []byte) bool {
+	if d.active.Load() == 0 || !stun.IsMessage(b) {
+		return false
+	}
+	m := &stun.Message{Raw: append([]byte(nil), b...)}
+	if err := m.Decode(); err != nil {
+		return false
+	}
+	d.mu.Lock()
+	ch, ok := d.pending[m.TransactionID]
+	d.mu.Unlock()
+	if !ok {
+		return false
+	}
+	select {
+	case ch <- m:
+	default: // 已有响应待取
+	}
+	return true
+}
+
+// roundTrip 从 conn 向 raddr 发送 req 并等待 Handle 转交的响应，超时内重传一次
+func (d *Demux) roundTrip(ctx context.Context, conn net.PacketConn, raddr net.Addr, req *stun.Message, timeout time.Duration) (*stun.Message, error) {
+	ch := make(chan *stun.Message, 1)
+	d.mu.Lock()
+	d.pending[req.TransactionID] = ch
+	d.mu.Unlock()
+	d.active.Add(1)
+	defer func() {
+		d.active.Add(-1)
+		d.mu.Lock()
+		delete(d.pending, req.TransactionID)
+		d.mu.Unlock()
+	}()
+
+	for attempt := 0; attempt < 2; attempt++ {
+		if _, err := conn.WriteTo(req.Raw, raddr); err != nil {
+			return nil, err
+		}
+		t := time.NewTimer(timeout)
+		select {
+		case res := <-ch:
+			t.Stop()
+			return res, nil
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+	}
+	return nil, errNoResponse
+}
+
+// GetUDPMappingShared 同 GetUDPMapping，但请求经已打开的 conn 发出，响应由 d 从 conn 的读取方转交。
+// 得到的映射正是 conn 这个 socket 的 5 元组，而不是另行绑定同一端口的新 socket 的映射。
+func (c *Client) GetUDPMappingShared(ctx context.Context, conn net.PacketConn, d *Demux) (*Mapping, error) {
+	_, udp := c.servers()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	query := func(ctx context.Context, server string, _ int) (*Mapping, error) {
+		return c.queryShared(ctx, server, conn, d)
+	}
+	return c.mapping(ctx, "UDP", udp, port, query)
+}
+
+// queryShared 经共享的 conn 向单个服务器发起一次 UDP Binding 请求
+func (c *Client) queryShared(ctx context.Context, server string, conn net.PacketConn, d *Demux) (*Mapping, error) {
+	raddr, err := net.ResolveUDPAddr(c.network("udp"), serverAddr(server))
+	if err != nil {
+		return nil, fmt.Errorf("resolve: %w", err)
+	}
+	res, err := c.exchange(func(req *stun.Message) (*stun.Message, error) {
+		return d.roundTrip(ctx, conn, raddr, req, c.timeout)
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("transaction: %w", err)
+	}
+	xorAddr, err := mappedAddr(res)
+	if err != nil {
+		return nil, fmt.Errorf("transaction: %w", err)
+	}
+	return &Mapping{
+		InternalIP:   c.localIP(),
+		InternalPort: conn.LocalAddr().(*net.UDPAddr).Port,
+		ExternalIP:   xorAddr.IP,
+		ExternalPort: xorAddr.Port,
+	}, nil
+}
@@ -0,0 +1,65 @@
+package stun
+
+import (
+	"context"
+	"time"
+)
+
+// rttAlpha 是 RTT 指数移动平均的平滑系数
+const rttAlpha = 0.2
+
+// ServerStat 记录单个 STUN 服务器的事务统计
+type ServerStat struct {
+	Success int64         // 成功事务数
+	Failure int64         // 失败事务数（不含因取消而中止的请求）
+	AvgRTT  time.Duration // 成功事务 RTT 的移动平均
+}
+
+// Stats 返回每个服务器的统计快照，键为 "udp://host:port" / "tcp://host:port"。
+func (c *Client) Stats() map[string]ServerStat {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	out := make(map[string]ServerStat, len(c.stats))
+	for k, v := range c.stats {
+		out[k] = *v
+	}
+	return out
+}
+
+// timed 执行一次查询并记录结果与耗时
+func (c *Client) timed(ctx context.Context, proto, server string, srcPort int, query queryFunc) (*Mapping, error) {
+	start := time.Now()
+	m, err := query(ctx, server, srcPort)
+	if err != nil && ctx.Err() != nil {
+		// 被取消（关闭或竞速落败）的请求不计入统计
+		return m, err
+	}
+	c.record(proto, server, time.Since(start), err)
+	c.trip(proto, server, err)
+	return m, err
+}
+
+func (c *Client) record(proto, server string, rtt time.Duration, err error) {
+	key := breakerKey(proto, server)
+
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	if c.stats == nil {
+		c.stats = make(map[string]*ServerStat)
+	}
+	st, ok := c.stats[key]
+	if !ok {
+		st = &ServerStat{}
+		c.stats[key] = st
+	}
+	if err != nil {
+		st.Failure++
+		return
+	}
+	if st.Success == 0 {
+		st.AvgRTT = rtt
+	} else {
+		st.AvgRTT = time.Duration(rttAlpha*float64(rtt) + (1-rttAlpha)*float64(st.AvgRTT))
+	}
+	st.Success++
+}
@@ -3,28 +3,61 @@
 //
 // Notes for Windows:
 //   - Windows 自带的家庭/路由器设备几乎都支持 IGDv1/v2；
-//   - 代码基于 github.com/huin/goupnp/v2（最成熟的 UPnP 实现），
-//     直接 `go get github.com/huin/goupnp/v2@latest` 即可；
-//   - 只在程序启动时尝试一次，如果失败不会影响主逻辑。
+//   - 代码基于 github.com/huin/goupnp v1（go.mod 中为 v1.3.0），优先使用
+//     dcps/internetgateway2（IGDv2），找不到时回退到 dcps/internetgateway1；
+//   - 发现失败时由调用方按配置重试（路由器刚开机时 UPnP 服务可能尚未就绪），
+//     始终失败也不会影响主逻辑。
 //
 // Example:
 //
-//	cli, _ := upnp.Discover(logger)
-//	_ = cli.AddTCP(33888, 33888, "192.168.1.199")
+//	cli, _ := upnp.Discover(ctx, 0, logger)
+//	port, _ := cli.AddTCP(ctx, 33888, 33888, "192.168.1.199", 0)
 //	// 外网 33888 → 192.168.1.199:33888
 package upnp
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"time"
 
 	"github.com/huin/goupnp/dcps/internetgateway1"
+	"github.com/huin/goupnp/dcps/internetgateway2"
+	"github.com/huin/goupnp/soap"
 	"go.uber.org/zap"
 )
 
-// Client wraps a WANIPConnection1 service.
+// igdService is the subset of WANIPConnection1/WANIPConnection2 used by Client;
+// both generated clients share these method signatures.
+type igdService interface {
+	AddPortMappingCtx(ctx context.Context, remoteHost string, externalPort uint16, protocol string,
+		internalPort uint16, internalClient string, enabled bool, description string, leaseDuration uint32) error
+	DeletePortMappingCtx(ctx context.Context, remoteHost string, externalPort uint16, protocol string) error
+	GetExternalIPAddressCtx(ctx context.Context) (string, error)
+}
+
+// anyPortMapper is implemented by WANIPConnection2 only: AddAnyPortMapping lets the IGD
+// reserve another external port when the requested one is already taken.
+type anyPortMapper interface {
+	AddAnyPortMappingCtx(ctx context.Context, remoteHost string, externalPort uint16, protocol string,
+		internalPort uint16, internalClient string, enabled bool, description string, leaseDuration uint32) (uint16, error)
+}
+
+// errConflictInMappingEntry is the UPnP error code (718) an IGD returns when the external
+// port is already mapped to another internal client.
+const errConflictInMappingEntry = 718
+
+// MaxConflictRetries bounds how many following external ports add tries after a 718 conflict.
+const MaxConflictRetries = 10
+
+// isConflict reports whether err is the IGD's ConflictInMappingEntry fault.
+func isConflict(err error) bool {
+	var fault *soap.SOAPFaultError
+	return errors.As(err, &fault) && fault.Detail.UPnPError.Errorcode == errConflictInMappingEntry
+}
+
+// Client wraps a WANIPConnection2 (IGDv2) or WANIPConnection1 service.
 // Only minimal methods required by Natter are exposed.
 // If Discover returns (nil, err) caller should treat UPnP as unavailable.
 //
@@ -32,50 +65,143 @@ import (
 //
 // Zero‑value is not valid – must come from Discover().
 type Client struct {
-	svc    *internetgateway1.WANIPConnection1
+	svc    igdService
 	logger *zap.Logger
 }
 
-// Discover searches for the first IGD that exposes WANIPConnection1.
+// DefaultDiscoverTimeout is how long Discover searches for each IGD version by default.
+const DefaultDiscoverTimeout = 3 * time.Second
+
+// Discover searches for the first IGD that exposes WANIPConnection2, falling back to
+// WANIPConnection1 for older routers. Each search lasts at most timeout
+// (DefaultDiscoverTimeout when <= 0) and stops early when ctx is done.
 // Typical latency < 1s。若找不到设备，返回 (nil, error)。
-func Discover(logger *zap.Logger) (*Client, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func Discover(ctx context.Context, timeout time.Duration, logger *zap.Logger) (*Client, error) {
+	if timeout <= 0 {
+		timeout = DefaultDiscoverTimeout
+	}
+	cli, err := discoverV2(ctx, timeout, logger)
+	if err == nil {
+		return cli, nil
+	}
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("upnp discover: %w", ctx.Err())
+	}
+	logger.Debug("UPnP IGDv2 not found, trying IGDv1", zap.Error(err))
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	devs, err, _ := internetgateway1.NewWANIPConnection1ClientsCtx(ctx)
+	devs, _, err := internetgateway1.NewWANIPConnection1ClientsCtx(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("upnp discover: %w", err)
 	}
 	if len(devs) == 0 {
 		return nil, fmt.Errorf("upnp discover: no IGD found")
 	}
-	cli := &Client{svc: devs[0], logger: logger}
-	logger.Info("UPnP IGD found", zap.String("url", devs[0].Location.String()))
+	cli = &Client{svc: devs[0], logger: logger}
+	logger.Info("UPnP IGD found", zap.String("url", devs[0].Location.String()), zap.String("version", "IGDv1"))
 	return cli, nil
 }
 
-// AddTCP maps externalPort on the gateway to internalIP:internalPort (TCP).
-// durationSec = 0 代表永久映射。
-func (c *Client) AddTCP(externalPort, internalPort int, internalIP string, durationSec uint32) error {
-	return c.add("TCP", externalPort, internalPort, internalIP, durationSec)
+func discoverV2(ctx context.Context, timeout time.Duration, logger *zap.Logger) (*Client, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	devs, _, err := internetgateway2.NewWANIPConnection2ClientsCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(devs) == 0 {
+		return nil, fmt.Errorf("no IGDv2 found")
+	}
+	logger.Info("UPnP IGD found", zap.String("url", devs[0].Location.String()), zap.String("version", "IGDv2"))
+	return &Client{svc: devs[0], logger: logger}, nil
+}
+
+// ExternalIP asks the IGD for its WAN address (GetExternalIPAddress).
+func (c *Client) ExternalIP(ctx context.Context) (net.IP, error) {
+	s, err := c.svc.GetExternalIPAddressCtx(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("upnp external ip: %w", err)
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("upnp external ip: invalid address %q", s)
+	}
+	return ip, nil
+}
+
+// AddTCP maps externalPort on the gateway to internalIP:internalPort (TCP) and returns the
+// external port actually reserved: an IGDv2 may pick another one when externalPort is taken,
+// and when the IGD reports a conflict the following ports are tried, up to MaxConflictRetries.
+// durationSec = 0 代表永久映射。The request is abandoned when ctx is done, so ctx
+// should carry a deadline; a slow IGD would otherwise block the caller.
+func (c *Client) AddTCP(ctx context.Context, externalPort, internalPort int, internalIP string, durationSec uint32) (int, error) {
+	return c.add(ctx, "TCP", externalPort, internalPort, internalIP, durationSec)
 }
 
 // AddUDP maps UDP port.
-func (c *Client) AddUDP(externalPort, internalPort int, internalIP string, durationSec uint32) error {
-	return c.add("UDP", externalPort, internalPort, internalIP, durationSec)
+func (c *Client) AddUDP(ctx context.Context, externalPort, internalPort int, internalIP string, durationSec uint32) (int, error) {
+	return c.add(ctx, "UDP", externalPort, internalPort, internalIP, durationSec)
 }
 
-func (c *Client) add(proto string, ext, in int, host string, dur uint32) error {
+// DeleteTCP removes the TCP mapping of externalPort. internalPort is unused and only
+// keeps the signature in line with the NAT-PMP and PCP clients.
+func (c *Client) DeleteTCP(ctx context.Context, externalPort, internalPort int) error {
+	return c.delete(ctx, "TCP", externalPort)
+}
+
+// DeleteUDP removes the UDP mapping of externalPort.
+func (c *Client) DeleteUDP(ctx context.Context, externalPort, internalPort int) error {
+	return c.delete(ctx, "UDP", externalPort)
+}
+
+func (c *Client) add(ctx context.Context, proto string, ext, in int, host string, dur uint32) (int, error) {
 	if net.ParseIP(host) == nil {
-		return fmt.Errorf("invalid internal IP: %s", host)
+		return 0, fmt.Errorf("invalid internal IP: %s", host)
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
 
+	granted, err := c.tryAdd(ctx, proto, ext, in, host, dur)
+	// 外部端口已被其他主机占用（常见于多台设备共用路由器）时依次尝试后面的端口
+	for next := ext + 1; isConflict(err) && next <= ext+MaxConflictRetries && next <= 65535; next++ {
+		c.logger.Info("UPnP external port already mapped, trying the next one", zap.String("proto", proto), zap.Int("port", next-1))
+		granted, err = c.tryAdd(ctx, proto, next, in, host, dur)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("add port‑mapping (%s %d): %w", proto, ext, err)
+	}
+	if granted != ext {
+		c.logger.Debug("UPnP IGD assigned a different external port", zap.String("proto", proto), zap.Int("requested", ext), zap.Int("assigned", granted))
+	}
+	c.logger.Debug("UPnP port‑mapping added", zap.String("proto", proto), zap.Int("outer", granted), zap.String("inner", fmt.Sprintf("%s:%d", host, in)))
+	return granted, nil
+}
+
+// tryAdd sends one AddAnyPortMapping (IGDv2) or AddPortMapping request for ext
+// and returns the reserved external port.
+func (c *Client) tryAdd(ctx context.Context, proto string, ext, in int, host string, dur uint32) (int, error) {
 	// remoteHost="" 表示映射所有来源
+	if svc, ok := c.svc.(anyPortMapper); ok {
+		p, err := svc.AddAnyPortMappingCtx(ctx, "", uint16(ext), proto, uint16(in), host, true, "natter-go", dur)
+		if err != nil {
+			return 0, err
+		}
+		if p != 0 {
+			return int(p), nil
+		}
+		return ext, nil
+	}
 	if err := c.svc.AddPortMappingCtx(ctx, "", uint16(ext), proto, uint16(in), host, true, "natter-go", dur); err != nil {
-		return fmt.Errorf("add port‑mapping (%s %d): %w", proto, ext, err)
+		return 0, err
+	}
+	return ext, nil
+}
+
+func (c *Client) delete(ctx context.Context, proto string, ext int) error {
+	if err := c.svc.DeletePortMappingCtx(ctx, "", uint16(ext), proto); err != nil {
+		return fmt.Errorf("delete port‑mapping (%s %d): %w", proto, ext, err)
 	}
-	c.logger.Info("UPnP port‑mapping added", zap.String("proto", proto), zap.Int("outer", ext), zap.String("inner", fmt.Sprintf("%s:%d", host, in)))
+	c.logger.Debug("UPnP port‑mapping deleted", zap.String("proto", proto), zap.Int("outer", ext))
 	return nil
 }
@@ -0,0 +1,86 @@
+// Package natter 是 Natter 的可嵌入 API：在自己的 Go 程序中加载配置、运行 STUN 打洞、
+// 保活与端口转发，并通过回调接收映射变化，而不必调用可执行文件或读取状态文件。
+//
+//	cfg, err := natter.LoadConfig("config.json")
+//	...
+//	n, err := natter.New(cfg, logger, natter.WithMappingHandler(func(ev natter.MappingEvent) {
+//		fmt.Println(ev.Protocol, ev.InnerAddr, "->", ev.OuterAddr)
+//	}))
+//	...
+//	if err := n.Run(ctx); err != nil { // 阻塞直到 ctx 结束
+//		// 所有转发端口都无法监听
+//	}
+//
+// 需要区分部分失败时，可改用 Start（立即返回，部分端口失败时返回非致命的 *StartError）与 Wait。
+package natter
+
+import (
+	"go.uber.org/zap"
+
+	"natter/internal/config"
+	"natter/internal/orchestrator"
+	"natter/internal/status"
+)
+
+// 配置类型，字段与 JSON 配置文件一一对应
+type (
+	Config         = config.Config
+	StunServer     = config.StunServer
+	OpenPort       = config.OpenPort
+	PortList       = config.PortList
+	OpenAddr       = config.OpenAddr
+	ForwardPort    = config.ForwardPort
+	TargetList     = config.TargetList
+	ForwardTarget  = config.ForwardTarget
+	ForwardOptions = config.ForwardOptions
+	HostList       = config.HostList
+	StatusReport   = config.StatusReport
+	Logging        = config.Logging
+)
+
+// Natter 是运行中的实例，Run 阻塞直到 ctx 结束，Reload 可在运行时应用新配置
+type Natter = orchestrator.Natter
+
+// Option 调整 New 创建的实例
+type Option = orchestrator.Option
+
+// StartError 列出启动失败的转发端口；Fatal 为 true 时没有任何端口在监听，实例未运行
+type (
+	StartError = orchestrator.StartError
+	PortError  = orchestrator.PortError
+)
+
+// ErrNoPortsBound 可用 errors.Is 判断致命的启动错误
+var ErrNoPortsBound = orchestrator.ErrNoPortsBound
+
+// MappingEvent 描述一次映射变化：Removed 为 true 时表示映射长时间未刷新已被移除
+type MappingEvent = status.UpdateEvent
+
+// LoadConfig 读取 JSON/YAML 配置文件，应用环境变量覆盖与缺省值并校验
+func LoadConfig(path string) (*Config, error) {
+	return config.Load(path)
+}
+
+// New 为 cfg 中未设置的字段填入缺省值并校验，然后创建实例；logger 为 nil 时不输出日志
+func New(cfg *Config, logger *zap.Logger, opts ...Option) (*Natter, error) {
+	cfg.ApplyDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	return orchestrator.New(cfg, logger, opts...)
+}
+
+// WithMappingHandler 在创建时注册映射变化回调，每次映射变化或被移除时调用；
+// 回调在状态管理协程中同步执行、不持有任何锁，耗时操作应自行转到其他协程。
+// 运行期间增减回调可使用 Natter.Subscribe，它返回取消订阅的函数
+func WithMappingHandler(fn func(MappingEvent)) Option {
+	return orchestrator.WithMappingHandler(fn)
+}
+
+// WithAuditLogger 将客户端接入、映射变化与 Hook 执行以结构化记录写入 l，与主日志级别无关
+func WithAuditLogger(l *zap.Logger) Option {
+	return orchestrator.WithAuditLogger(l)
+}